@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// accountsVarName is the environment variable listing the accounts processed in one run, when -account is not set.
+const accountsVarName = "FRECKLE_APP_TOKENS"
+
+// Account is a Freckle or Noko account processed by the run. The unnamed account is the single one
+// of $FRECKLE_APP_TOKEN or $NOKO_TOKEN, it adds no account dimension to the metrics.
+type Account struct {
+	Name  string
+	Token string
+}
+
+// logPrefix prefixes the diagnostics about the account, it is empty for the unnamed account.
+func (a Account) logPrefix() string {
+	if a.Name == "" {
+		return ""
+	}
+	return "account " + a.Name + " : "
+}
+
+// parseAccount parses a name=token account, a bare token is named after its position n, e.g. account2.
+func parseAccount(value string, n int) (Account, error) {
+	parts := strings.SplitN(strings.TrimSpace(value), "=", 2)
+	if len(parts) == 1 {
+		parts = []string{fmt.Sprintf("account%d", n), parts[0]}
+	}
+	a := Account{Name: strings.TrimSpace(parts[0]), Token: strings.TrimSpace(parts[1])}
+	if a.Name == "" || a.Token == "" {
+		return Account{}, fmt.Errorf("%q is not a valid account, e.g. acme=<API TOKEN>", value)
+	}
+	return a, nil
+}
+
+// parseAccounts parses the comma or space separated accounts of $FRECKLE_APP_TOKENS, see parseAccount.
+func parseAccounts(value string) ([]Account, error) {
+	var accounts accountsFlag
+	for _, s := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' }) {
+		if err := accounts.Set(s); err != nil {
+			return nil, err
+		}
+	}
+	return accounts, nil
+}
+
+// accountsFlag implements flag.Value for the repeated -account flags, the account names must be unique.
+type accountsFlag []Account
+
+func (f *accountsFlag) String() string {
+	names := make([]string, len(*f))
+	for i, a := range *f {
+		names[i] = a.Name
+	}
+	return strings.Join(names, ",")
+}
+
+// Set implements flag.Value.
+func (f *accountsFlag) Set(value string) error {
+	a, err := parseAccount(value, len(*f)+1)
+	if err != nil {
+		return err
+	}
+	for _, other := range *f {
+		if other.Name == a.Name {
+			return fmt.Errorf("the account %s is set twice", a.Name)
+		}
+	}
+	*f = append(*f, a)
+	return nil
+}
+
+// AccountReport is the report of the projects of an account.
+type AccountReport struct {
+	// Account is the name of the account, empty for the unnamed one
+	Account string
+	Report
+}
+
+// mergeReports concatenates the projects and the clients of the reports of the accounts, e.g. for the digest of the run.
+func mergeReports(reports []AccountReport) Report {
+	var merged Report
+	for _, r := range reports {
+		merged.Projects = append(merged.Projects, r.Projects...)
+		merged.Clients = append(merged.Clients, r.Clients...)
+		merged.SkippedArchived += r.SkippedArchived
+		merged.Failed = append(merged.Failed, r.Failed...)
+		merged.SkippedEntries += r.SkippedEntries
+		merged.SkippedInvoices += r.SkippedInvoices
+	}
+	return merged
+}
+
+// reportTotals sums the KPIs of the projects of one or several reports.
+type reportTotals struct {
+	Name              string
+	Projects          int
+	Invoiced          kpi.Amounts
+	InvoicedMinutes   int
+	BillableMinutes   int
+	UnbillableMinutes int
+}
+
+func newReportTotals(name string, report Report) reportTotals {
+	t := reportTotals{Name: name, Projects: len(report.Projects), Invoiced: make(kpi.Amounts)}
+	for _, project := range report.Projects {
+		for currency, amount := range project.GetInvoicedTotalPerCurrency() {
+			t.Invoiced[currency] += amount
+		}
+		t.InvoicedMinutes += project.InvoicedMinutes
+		t.BillableMinutes += project.BillableMinutes
+		t.UnbillableMinutes += project.UnbillableMinutes
+	}
+	return t
+}
+
+// Format prints the totals with the display settings of f.
+func (t reportTotals) Format(f kpi.Formatter) string {
+	return fmt.Sprintf(
+		"%s (%d projects) total invoiced : %s, %s - Billable : %s - Unbillable : %s",
+		t.Name, t.Projects,
+		f.FormatAmounts(t.Invoiced), f.FormatDuration(float64(t.InvoicedMinutes)),
+		f.FormatDuration(float64(t.BillableMinutes)),
+		f.FormatDuration(float64(t.UnbillableMinutes)))
+}
+
+// printReports prints the reports of the accounts to w. The report of the unnamed account is printed as is,
+// the named ones are printed under a header and followed by the totals of each account and of all of them.
+func printReports(w io.Writer, reports []AccountReport, f kpi.Formatter) {
+	renderReports(w, reports, f, func(w io.Writer, report Report) {
+		printReport(w, report, f)
+	})
+}
+
+// renderReports is printReports with the layout of each report set by render, e.g. printTable.
+func renderReports(w io.Writer, reports []AccountReport, f kpi.Formatter, render func(io.Writer, Report)) {
+	if len(reports) == 1 && reports[0].Account == "" {
+		render(w, reports[0].Report)
+		return
+	}
+	for _, r := range reports {
+		fmt.Fprintf(w, "== Account %s ==\n\n", r.Account)
+		render(w, r.Report)
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "Accounts")
+	for _, r := range reports {
+		fmt.Fprintln(w, newReportTotals(r.Account, r.Report).Format(f))
+	}
+	fmt.Fprintln(w, newReportTotals("all accounts", mergeReports(reports)).Format(f))
+}
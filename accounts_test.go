@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-librato/librato"
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+func TestParseAccounts(t *testing.T) {
+	accounts, err := parseAccounts("acme=secret1, globex=secret2 secret3")
+	assert.NoError(t, err)
+	assert.Equal(t, []Account{{"acme", "secret1"}, {"globex", "secret2"}, {"account3", "secret3"}}, accounts)
+
+	accounts, err = parseAccounts("")
+	assert.NoError(t, err)
+	assert.Len(t, accounts, 0)
+
+	_, err = parseAccounts("acme=secret1,acme=secret2")
+	assert.Error(t, err)
+	_, err = parseAccounts("acme=")
+	assert.Error(t, err)
+
+	var f accountsFlag
+	assert.NoError(t, f.Set("acme=secret1"))
+	assert.NoError(t, f.Set("globex=secret2"))
+	assert.Equal(t, "acme,globex", f.String())
+}
+
+// accountReports returns the reports of two accounts holding the fixture projects.
+func accountReports(t *testing.T) []AccountReport {
+	var reports []AccountReport
+	for _, account := range []string{"acme", "globex"} {
+		report, err := Run(context.Background(), fixtureDataSource(t), monthlyOptions())
+		assert.NoError(t, err)
+		reports = append(reports, AccountReport{Account: account, Report: report})
+	}
+	return reports
+}
+
+func TestPrintReports(t *testing.T) {
+	reports := accountReports(t)
+
+	var single, buf bytes.Buffer
+	printReport(&single, reports[0].Report, kpi.DefaultFormatter)
+	printReports(&buf, []AccountReport{{Report: reports[0].Report}}, kpi.DefaultFormatter)
+	assert.Equal(t, single.String(), buf.String(), "the unnamed account is printed as is")
+
+	buf.Reset()
+	printReports(&buf, reports, kpi.DefaultFormatter)
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "== Account acme ==\n\n"+single.String()))
+	assert.Contains(t, out, "== Account globex ==\n\n")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	assert.Equal(t, []string{
+		"Accounts",
+		"acme (2 projects) total invoiced : $4,800.00, 8.0h - Billable : 14.0h - Unbillable : 3.2h",
+		"globex (2 projects) total invoiced : $4,800.00, 8.0h - Billable : 14.0h - Unbillable : 3.2h",
+		"all accounts (4 projects) total invoiced : $9,600.00, 16.0h - Billable : 28.0h - Unbillable : 6.5h",
+	}, lines[len(lines)-4:])
+}
+
+func TestRegisterMetricsPerAccount(t *testing.T) {
+	gauges := &libratoexport.RecordingSink{}
+	for _, r := range accountReports(t) {
+		registerMetrics(libratoexport.AccountSink{Sink: gauges, Account: r.Account}, r.Report)
+	}
+
+	// The accounts are separate series, they are neither collapsed nor conflicting
+	deduplicated, conflicts := libratoexport.Deduplicate(gauges.Gauges, libratoexport.DuplicateMax)
+	assert.Len(t, deduplicated, len(gauges.Gauges))
+	assert.Len(t, conflicts, 0)
+
+	metrics := &librato.Metrics{}
+	sink := &libratoexport.MetricsSink{Metrics: metrics}
+	measurements := &libratoexport.MeasurementsSink{}
+	for _, g := range deduplicated {
+		sink.AddGauge(g)
+		measurements.AddGauge(g)
+	}
+	assert.Equal(t, "acme:Acme-Web", metrics.Gauges[0].(librato.Gauge).Source)
+	assert.Equal(t, "acme", measurements.Measurements[0].Tags[libratoexport.LabelAccount])
+
+	groups, err := promGroups(deduplicated, time.Now())
+	assert.NoError(t, err)
+	var keys []string
+	for _, g := range groups {
+		keys = append(keys, g.Account+"/"+g.Project)
+	}
+	assert.Equal(t, []string{"/", "acme/Acme Web", "acme/Globex Mobile", "globex/Acme Web", "globex/Globex Mobile"}, keys)
+	assert.Equal(t, "http://localhost:9091/metrics/job/freckle_indicators/account@base64/YWNtZQ/project@base64/QWNtZS1XZWI",
+		pushgatewayURL("http://localhost:9091", "acme", "Acme-Web"))
+}
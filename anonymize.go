@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gertv/go-freckle"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// anonymizedDomain is the domain of the emails of the pseudonyms, .invalid is reserved so they reach nobody.
+const anonymizedDomain = "anonymized.invalid"
+
+// pseudonym replaces an identity: Tag is the number or the hash naming it, e.g. 01 for Person 01, and ID its numeric ID.
+type pseudonym struct {
+	ID  int
+	Tag string
+}
+
+// assignPseudonyms returns the pseudonyms of the identities keyed in totals. Without salt, they are numbered
+// by descending totals, the ties broken by key. With a salt, they are a hash of the salt and the key,
+// so an identity keeps its pseudonym across runs whatever the others.
+func assignPseudonyms(totals map[string]int, salt string) map[string]pseudonym {
+	keys := make([]string, 0, len(totals))
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if totals[keys[i]] != totals[keys[j]] {
+			return totals[keys[i]] > totals[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	assigned := make(map[string]pseudonym, len(keys))
+	width := len(strconv.Itoa(len(keys)))
+	if width < 2 {
+		width = 2
+	}
+	for i, key := range keys {
+		if salt == "" {
+			assigned[key] = pseudonym{ID: i + 1, Tag: fmt.Sprintf("%0*d", width, i+1)}
+			continue
+		}
+		sum := sha256.Sum256([]byte(salt + "\x00" + key))
+		assigned[key] = pseudonym{ID: int(binary.BigEndian.Uint32(sum[:4]) >> 1), Tag: hex.EncodeToString(sum[:4])}
+	}
+	return assigned
+}
+
+// participantIdentity keys the participant by its email, so it has the same pseudonym in all the accounts,
+// or by its ID in the account without email.
+func participantIdentity(account string, p freckle.Participant) string {
+	if email := strings.ToLower(strings.TrimSpace(p.Email)); email != "" {
+		return email
+	}
+	return account + "/" + strconv.Itoa(p.Id)
+}
+
+// anonymizer replaces the identities of the participants, and with -anonymize-projects the names of the projects
+// and of the clients, in the reports before they are printed, emailed or pushed.
+type anonymizer struct {
+	participants map[string]pseudonym
+	// emails maps the lower cased emails of the participants to the ones of their pseudonyms
+	emails map[string]string
+	// projects and clients are nil when their names are kept
+	projects map[string]pseudonym
+	clients  map[string]pseudonym
+}
+
+// newAnonymizer assigns the pseudonyms of the identities found in the reports, see assignPseudonyms.
+// The participants and the projects are ranked by their total minutes.
+func newAnonymizer(reports []AccountReport, salt string, projects bool) *anonymizer {
+	participants := make(map[string]int)
+	projectTotals := make(map[string]int)
+	clients := make(map[string]int)
+	for _, r := range reports {
+		for _, project := range r.Projects {
+			for _, p := range project.Project.Participants {
+				participants[participantIdentity(r.Account, p)] += 0
+			}
+			for _, p := range project.Participants {
+				participants[participantIdentity(r.Account, p.Participant)] += p.BillableMinutes + p.UnbillableMinutes
+			}
+			projectTotals[r.Account+"/"+project.Name] += project.BillableMinutes + project.UnbillableMinutes
+			if project.Group.Name != "" {
+				clients[r.Account+"/"+project.Group.Name] += 0
+			}
+		}
+		for _, f := range r.Failed {
+			projectTotals[r.Account+"/"+f.Name] += 0
+		}
+		for _, c := range r.Clients {
+			if c.Name != kpi.UnassignedClient {
+				clients[r.Account+"/"+c.Name] += c.BillableMinutes + c.UnbillableMinutes
+			}
+		}
+	}
+
+	a := &anonymizer{participants: assignPseudonyms(participants, salt), emails: make(map[string]string)}
+	for key, p := range a.participants {
+		if !strings.Contains(key, "/") {
+			a.emails[key] = participantEmail(p)
+		}
+	}
+	if projects {
+		a.projects = assignPseudonyms(projectTotals, salt)
+		a.clients = assignPseudonyms(clients, salt)
+	}
+	return a
+}
+
+// participantEmail returns the email of the participant of the pseudonym, its local part is the metric key with
+// -participant-metric-key email.
+func participantEmail(p pseudonym) string {
+	return "person-" + p.Tag + "@" + anonymizedDomain
+}
+
+// participant returns the pseudonym of the participant, named Person <tag>.
+func (a *anonymizer) participant(account string, p freckle.Participant) freckle.Participant {
+	ps, ok := a.participants[participantIdentity(account, p)]
+	if !ok {
+		return freckle.Participant{}
+	}
+	return freckle.Participant{Id: ps.ID, FirstName: "Person", LastName: ps.Tag, Email: participantEmail(ps)}
+}
+
+func (a *anonymizer) participantKpis(account string, participants []kpi.ParticipantKpi) kpi.ParticipantKpis {
+	if participants == nil {
+		return nil
+	}
+	anonymized := make(kpi.ParticipantKpis, len(participants))
+	for i, p := range participants {
+		anonymized[i] = p
+		anonymized[i].Participant = a.participant(account, p.Participant)
+	}
+	return anonymized
+}
+
+// projectName returns the pseudonym of the project name, named Project <tag>, or the name when it is kept.
+func (a *anonymizer) projectName(account, name string) string {
+	ps, ok := a.projects[account+"/"+name]
+	if !ok {
+		return name
+	}
+	return "Project " + ps.Tag
+}
+
+// clientName returns the pseudonym of the client, named Client <tag>, or the name when it is kept.
+// The UnassignedClient is kept.
+func (a *anonymizer) clientName(account, name string) string {
+	ps, ok := a.clients[account+"/"+name]
+	if !ok {
+		return name
+	}
+	return "Client " + ps.Tag
+}
+
+// project returns a copy of the project with its identities replaced.
+func (a *anonymizer) project(account string, project kpi.ProjectKpi) kpi.ProjectKpi {
+	project.Name = a.projectName(account, project.Name)
+	project.Group.Name = a.clientName(account, project.Group.Name)
+	if project.Project.Participants != nil {
+		participants := make([]freckle.Participant, len(project.Project.Participants))
+		for i, p := range project.Project.Participants {
+			participants[i] = a.participant(account, p)
+		}
+		project.Project.Participants = participants
+	}
+	if project.DetailedEntries != nil {
+		entries := make([]freckle.Entry, len(project.DetailedEntries))
+		for i, entry := range project.DetailedEntries {
+			entries[i] = entry
+			entries[i].User = a.participant(account, entry.User)
+		}
+		project.DetailedEntries = entries
+	}
+	return project
+}
+
+// periods returns a copy of the periods with their identities replaced.
+func (a *anonymizer) periods(account string, periods []kpi.ProjectPeriodKpi) []kpi.ProjectPeriodKpi {
+	if periods == nil {
+		return nil
+	}
+	anonymized := make([]kpi.ProjectPeriodKpi, len(periods))
+	for i, ppm := range periods {
+		anonymized[i] = ppm
+		anonymized[i].Name = a.projectName(account, ppm.Name)
+		anonymized[i].Participants = a.participantKpis(account, ppm.Participants)
+	}
+	return anonymized
+}
+
+// report returns a copy of the report of the account with its identities replaced, the report is left untouched.
+func (a *anonymizer) report(account string, r Report) Report {
+	anonymized := r
+	anonymized.Projects = make([]ProjectReport, len(r.Projects))
+	for i, project := range r.Projects {
+		project.ProjectKpi = a.project(account, project.ProjectKpi)
+		project.Participants = a.participantKpis(account, project.Participants)
+		project.Periods = a.periods(account, project.Periods)
+		breakdowns := make([]Breakdown, len(project.Breakdowns))
+		for j, b := range project.Breakdowns {
+			breakdowns[j] = Breakdown{TimeAgg: b.TimeAgg, Periods: a.periods(account, b.Periods)}
+		}
+		if len(breakdowns) > 0 {
+			// Periods is the first breakdown, they share their periods
+			project.Periods = breakdowns[0].Periods
+		}
+		project.Breakdowns = breakdowns
+		anonymized.Projects[i] = project
+	}
+
+	anonymized.Clients = nil
+	for _, c := range r.Clients {
+		c.Name = a.clientName(account, c.Name)
+		projects := make([]kpi.ProjectKpi, len(c.Projects))
+		for j, project := range c.Projects {
+			projects[j] = a.project(account, project)
+		}
+		c.Projects = projects
+		c.Participants = a.participantKpis(account, c.Participants)
+		anonymized.Clients = append(anonymized.Clients, c)
+	}
+
+	anonymized.Utilization = nil
+	for _, up := range r.Utilization {
+		up.Participants = a.participantKpis(account, up.Participants)
+		anonymized.Utilization = append(anonymized.Utilization, up)
+	}
+
+	anonymized.Failed = nil
+	for _, f := range r.Failed {
+		anonymized.Failed = append(anonymized.Failed, ProjectFailure{Name: a.projectName(account, f.Name), Err: f.Err})
+	}
+	return anonymized
+}
+
+// reports returns a copy of the reports with their identities replaced.
+func (a *anonymizer) reports(reports []AccountReport) []AccountReport {
+	anonymized := make([]AccountReport, len(reports))
+	for i, r := range reports {
+		anonymized[i] = AccountReport{Account: r.Account, Report: a.report(r.Account, r.Report)}
+	}
+	return anonymized
+}
+
+// capacity returns the capacity with the -capacity-for overrides keyed by the emails of the pseudonyms,
+// the overrides of the participants absent from the reports are dropped.
+func (a *anonymizer) capacity(c kpi.Capacity) kpi.Capacity {
+	if c.Overrides == nil {
+		return c
+	}
+	overrides := make(map[string]float64)
+	for email, minutes := range c.Overrides {
+		if anonymized, ok := a.emails[strings.ToLower(email)]; ok {
+			overrides[anonymized] = minutes
+		}
+	}
+	c.Overrides = overrides
+	return c
+}
+
+// anonymizeListedProjects replaces the names of the projects of the -list-projects listing,
+// ranked by their total minutes like the reported ones.
+func anonymizeListedProjects(listed []listedProject, salt string) []listedProject {
+	totals := make(map[string]int)
+	for _, p := range listed {
+		totals[p.Account+"/"+p.Name] += p.BillableMinutes + p.UnbillableMinutes
+	}
+	a := &anonymizer{projects: assignPseudonyms(totals, salt)}
+	anonymized := make([]listedProject, len(listed))
+	for i, p := range listed {
+		anonymized[i] = p
+		anonymized[i].Name = a.projectName(p.Account, p.Name)
+	}
+	return anonymized
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+func TestAssignPseudonyms(t *testing.T) {
+	totals := map[string]int{"bob@example.com": 60, "alice@example.com": 120, "carol@example.com": 60}
+	assert.Equal(t, map[string]pseudonym{
+		"alice@example.com": {ID: 1, Tag: "01"},
+		"bob@example.com":   {ID: 2, Tag: "02"},
+		"carol@example.com": {ID: 3, Tag: "03"},
+	}, assignPseudonyms(totals, ""))
+
+	// The salted pseudonyms don't depend on the other identities
+	salted := assignPseudonyms(totals, "pepper")
+	alone := assignPseudonyms(map[string]int{"bob@example.com": 0}, "pepper")
+	assert.Equal(t, salted["bob@example.com"], alone["bob@example.com"])
+	assert.Len(t, salted["bob@example.com"].Tag, 8)
+	assert.NotEqual(t, salted["bob@example.com"], assignPseudonyms(totals, "salt")["bob@example.com"])
+}
+
+func TestAnonymizeReports(t *testing.T) {
+	opts := monthlyOptions()
+	opts.TimeAgg = kpi.YearAgg{}
+	opts.MoreTimeAggs = []kpi.TimeAggregater{kpi.MonthAgg{}}
+	opts.ByClient = true
+	report, err := Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	reports := []AccountReport{{Report: report}}
+
+	anonymized := newAnonymizer(reports, "", false).reports(reports)
+	var buf bytes.Buffer
+	printReports(&buf, anonymized, kpi.DefaultFormatter)
+	printTable(&buf, anonymized[0].Report, false, 0.5, kpi.DefaultFormatter)
+	defer func(key string) { participantKeyFlag = key }(participantKeyFlag)
+	gauges := &libratoexport.RecordingSink{}
+	for _, key := range []libratoexport.ParticipantKey{libratoexport.ParticipantKeyName, libratoexport.ParticipantKeyEmail} {
+		participantKeyFlag = string(key)
+		registerMetrics(gauges, anonymized[0].Report)
+	}
+	for _, g := range gauges.Gauges {
+		buf.WriteString(g.Name + "\n")
+	}
+	out := buf.String()
+	for _, identity := range []string{"Alice", "alice", "Bob", "bob", "Carol", "carol", "example.com"} {
+		assert.NotContains(t, out, identity)
+	}
+	assert.Contains(t, out, "Person 01 Billable : 6.0h - Unbillable : 1.0h - Entries : 3 (140min avg)")
+	assert.Contains(t, out, "Acme Web")
+	assert.Equal(t, anonymized[0].Projects[0].Breakdowns[0].Periods, anonymized[0].Projects[0].Periods)
+
+	// The reports are copied, not anonymized in place
+	assert.Equal(t, "Alice Smith", report.Projects[0].Participants[0].DisplayName())
+	assert.Equal(t, "Alice Smith", report.Projects[0].Periods[0].Participants[0].DisplayName())
+
+	anonymized = newAnonymizer(reports, "", true).reports(reports)
+	buf.Reset()
+	printReports(&buf, anonymized, kpi.DefaultFormatter)
+	assert.NotContains(t, buf.String(), "Acme")
+	assert.Contains(t, buf.String(), "Project 01 total invoiced")
+	assert.Equal(t, "Project 01", anonymized[0].Projects[0].Periods[0].Name)
+	assert.Equal(t, "Client 01", anonymized[0].Clients[0].Name)
+}
+
+func TestAnonymizeCapacity(t *testing.T) {
+	report, err := Run(context.Background(), fixtureDataSource(t), monthlyOptions())
+	assert.NoError(t, err)
+	a := newAnonymizer([]AccountReport{{Report: report}}, "", false)
+	c := a.capacity(kpi.Capacity{Minutes: 600, Overrides: map[string]float64{"Alice@example.com": 300, "dave@example.com": 300}})
+	assert.Equal(t, kpi.Capacity{Minutes: 600, Overrides: map[string]float64{"person-01@anonymized.invalid": 300}}, c)
+}
+
+func TestAnonymizeListedProjects(t *testing.T) {
+	listed := []listedProject{
+		{Account: "acme", Name: "Acme Web", BillableMinutes: 60},
+		{Account: "acme", Name: "Acme Mobile", BillableMinutes: 120},
+	}
+	anonymized := anonymizeListedProjects(listed, "")
+	assert.Equal(t, "Project 02", anonymized[0].Name)
+	assert.Equal(t, "Project 01", anonymized[1].Name)
+	assert.Equal(t, "Acme Web", listed[0].Name)
+	assert.True(t, strings.HasPrefix(anonymizeListedProjects(listed, "pepper")[0].Name, "Project "))
+}
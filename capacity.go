@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// formatCapacity formats a capacity in minutes like the -capacity flag, e.g. 160h0m0s.
+func formatCapacity(minutes float64) string {
+	return time.Duration(minutes * float64(time.Minute)).String()
+}
+
+// capacityValue implements flag.Value for -capacity, the monthly capacity of the participants without override.
+type capacityValue struct {
+	capacity *kpi.Capacity
+}
+
+func (v capacityValue) String() string {
+	if v.capacity == nil || v.capacity.Minutes == 0 {
+		return ""
+	}
+	return formatCapacity(v.capacity.Minutes)
+}
+
+// Set implements flag.Value.
+func (v capacityValue) Set(value string) error {
+	minutes, err := kpi.ParseCapacity(value)
+	if err != nil {
+		return err
+	}
+	v.capacity.Minutes = minutes
+	return nil
+}
+
+// capacityForValue implements flag.Value for the repeated -capacity-for flags, email=capacity overrides of the -capacity.
+type capacityForValue struct {
+	capacity *kpi.Capacity
+}
+
+func (v capacityForValue) String() string {
+	if v.capacity == nil {
+		return ""
+	}
+	var overrides []string
+	for email, minutes := range v.capacity.Overrides {
+		overrides = append(overrides, email+"="+formatCapacity(minutes))
+	}
+	sort.Strings(overrides)
+	return strings.Join(overrides, ",")
+}
+
+// Set implements flag.Value.
+func (v capacityForValue) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	email := strings.ToLower(strings.TrimSpace(parts[0]))
+	if len(parts) != 2 || email == "" {
+		return fmt.Errorf("%q is not a valid capacity override, e.g. alice@example.com=80h", value)
+	}
+	minutes, err := kpi.ParseCapacity(parts[1])
+	if err != nil {
+		return err
+	}
+	if v.capacity.Overrides == nil {
+		v.capacity.Overrides = make(map[string]float64)
+	}
+	v.capacity.Overrides[email] = minutes
+	return nil
+}
+
+// participantUtilization returns the utilization of the participant over the period of tagg starting at period,
+// months are the months of the period with entries. ok is false without capacity.
+func participantUtilization(p kpi.ParticipantKpi, tagg kpi.TimeAggregater, period time.Time, months kpi.MonthSet) (kpi.Utilization, bool) {
+	if !capacityFlag.IsSet() {
+		return kpi.Utilization{}, false
+	}
+	return capacityFlag.GetUtilization(p, kpi.PeriodMonths(tagg, period, months, capacityPresentFlag))
+}
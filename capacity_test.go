@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+func TestCapacityFlags(t *testing.T) {
+	var c kpi.Capacity
+	assert.NoError(t, capacityValue{&c}.Set("160h"))
+	assert.NoError(t, capacityForValue{&c}.Set("Alice@example.com=80h"))
+	assert.Equal(t, kpi.Capacity{Minutes: 9600, Overrides: map[string]float64{"alice@example.com": 4800}}, c)
+	assert.Equal(t, "160h0m0s", capacityValue{&c}.String())
+	assert.Equal(t, "alice@example.com=80h0m0s", capacityForValue{&c}.String())
+
+	assert.Error(t, capacityValue{&c}.Set("160"))
+	assert.Error(t, capacityForValue{&c}.Set("alice@example.com"))
+	assert.Error(t, capacityForValue{&c}.Set("=80h"))
+}
+
+func TestRunUtilization(t *testing.T) {
+	defer func(c kpi.Capacity) { capacityFlag = c }(capacityFlag)
+	capacityFlag = kpi.Capacity{Minutes: 600, Overrides: map[string]float64{"alice@example.com": 300}}
+
+	report, err := Run(context.Background(), fixtureDataSource(t), monthlyOptions())
+	assert.NoError(t, err)
+	assert.Nil(t, report.Utilization)
+
+	opts := monthlyOptions()
+	opts.Utilization = true
+	report, err = Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	if assert.Len(t, report.Utilization, 3) {
+		// Alice worked in both projects in 2016-03
+		march := report.Utilization[2]
+		assert.Equal(t, "2016-03", march.Label())
+		assert.Equal(t, "Alice Smith", march.Participants[0].DisplayName())
+	}
+
+	var buf bytes.Buffer
+	printReport(&buf, report, kpi.DefaultFormatter)
+	// The time of a single project is not compared to the capacity
+	assert.Contains(t, buf.String(), "Alice Smith Billable : 4.0h - Unbillable : 0.0h - Entries : 1 (240min avg)\n")
+	assert.NotContains(t, buf.String(), "(240min avg) - Utilization")
+	assert.Contains(t, buf.String(), "\t 2016-02\n\t\t Carol White Utilization : 30% (billable 30%)\n\t\t Alice Smith Utilization : 30% (billable 0%)\n")
+
+	gauges := &libratoexport.RecordingSink{}
+	registerMetrics(gauges, report)
+	values := make(map[string]float64)
+	for _, g := range gauges.Gauges {
+		values[g.Name+"@"+g.Source] = g.Value
+	}
+	assert.Equal(t, 30.0, values["FreckleAPI.utilization.Utilization.carol@2016-02"])
+	assert.Equal(t, 0.0, values["FreckleAPI.utilization.BillableUtilization.alice@2016-02"])
+	assert.Equal(t, 80.0, values["FreckleAPI.utilization.Utilization.alice@2016-01"])
+}
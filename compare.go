@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// parseCompare returns the two periods of a -compare value like 2016-05,2016-06,
+// the labels are parsed according to the aggregater of the -period.
+func parseCompare(value string, tagg kpi.TimeAggregater) (a, b time.Time, err error) {
+	labels := strings.Split(value, ",")
+	if len(labels) != 2 {
+		return a, b, fmt.Errorf("%q is not a pair of periods, e.g. 2016-05,2016-06", value)
+	}
+	if a, err = tagg.Parse(strings.TrimSpace(labels[0])); err != nil {
+		return a, b, fmt.Errorf("%q is not a valid period : %v", labels[0], err)
+	}
+	if b, err = tagg.Parse(strings.TrimSpace(labels[1])); err != nil {
+		return a, b, fmt.Errorf("%q is not a valid period : %v", labels[1], err)
+	}
+	return a, b, nil
+}
+
+// printComparison prints the two periods of the comparison side by side with the change, with the display settings of f.
+func printComparison(w io.Writer, c kpi.PeriodComparison, f kpi.Formatter) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\t%s\t%s\tchange\n", c.Name, c.A, c.B)
+	for _, currency := range c.Currencies() {
+		v := c.Invoiced[currency]
+		amount := func(amount float64) string {
+			return f.FormatAmounts(kpi.Amounts{currency: amount})
+		}
+		fmt.Fprintf(tw, "invoiced %s\t%s\t%s\t%s\n", currency, amount(v.A), amount(v.B), v.DeltaString(amount))
+	}
+	fmt.Fprintf(tw, "billable\t%s\t%s\t%s\n", f.FormatDuration(c.Billable.A), f.FormatDuration(c.Billable.B), c.Billable.DeltaString(f.FormatDuration))
+	fmt.Fprintf(tw, "unbillable\t%s\t%s\t%s\n", f.FormatDuration(c.Unbillable.A), f.FormatDuration(c.Unbillable.B), c.Unbillable.DeltaString(f.FormatDuration))
+	for _, p := range c.Participants {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.DisplayName(), f.FormatDuration(p.Minutes.A), f.FormatDuration(p.Minutes.B), p.Minutes.DeltaString(f.FormatDuration))
+	}
+	fmt.Fprintln(tw)
+	return tw.Flush()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+func TestParseCompare(t *testing.T) {
+	a, b, err := parseCompare("2016-05, 2016-06", kpi.MonthAgg{})
+	assert.NoError(t, err)
+	assert.Equal(t, "2016-05", kpi.MonthAgg{}.GetString(a))
+	assert.Equal(t, "2016-06", kpi.MonthAgg{}.GetString(b))
+
+	_, _, err = parseCompare("2016-05,2016-06", kpi.YearAgg{})
+	assert.Error(t, err)
+	_, _, err = parseCompare("2016,2017", kpi.MonthAgg{})
+	assert.Error(t, err)
+	_, _, err = parseCompare("2016-05", kpi.MonthAgg{})
+	assert.Error(t, err)
+}
+
+func TestPrintComparison(t *testing.T) {
+	opts := monthlyOptions()
+	opts.ProjectNames = []string{"Acme Web"}
+	report, err := Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+
+	a, b, err := parseCompare("2016-01,2016-04", kpi.MonthAgg{})
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	acme := report.Projects[0]
+	assert.NoError(t, printComparison(&buf, kpi.ComparePeriods(acme.Name, kpi.MonthAgg{}, acme.Periods, a, b, ""), kpi.DefaultFormatter))
+	assert.Equal(t, ""+
+		"Acme Web      2016-01  2016-04    change\n"+
+		"invoiced USD  $0.00    $1,200.00  +$1,200.00\n"+
+		"billable      6.0h     0.0h       -100%\n"+
+		"unbillable    0.8h     0.0h       -100%\n"+
+		"Alice Smith   4.0h     0.0h       -100%\n"+
+		"Bob Jones     2.8h     0.0h       -100%\n"+
+		"\n", buf.String())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configFileName is the name of the configuration file looked up in the
+// current directory, then in ~/.config, when -config is not specified.
+const configFileName = "freckle-indicators.yaml"
+
+// Sinks that can be enabled by default from the configuration file.
+const (
+	sinkLibrato = "librato"
+	sinkDryRun  = "dry-run"
+)
+
+// redacted replaces the secrets when the configuration is printed.
+const redacted = "<redacted>"
+
+// Config holds the settings read from the configuration file.
+// Flags take precedence over the environment variables, which take precedence over the file.
+type Config struct {
+	FreckleToken   string   `yaml:"freckle_token"`
+	LibratoAccount string   `yaml:"librato_account"`
+	LibratoToken   string   `yaml:"librato_token"`
+	Period         string   `yaml:"period"`
+	Sinks          []string `yaml:"sinks"`
+	// Projects are names or IDs of the projects to process
+	Projects []string `yaml:"projects"`
+}
+
+// configKeys returns the keys known in the configuration file.
+func configKeys() map[string]bool {
+	return map[string]bool{
+		"freckle_token":   true,
+		"librato_account": true,
+		"librato_token":   true,
+		"period":          true,
+		"sinks":           true,
+		"projects":        true,
+	}
+}
+
+// defaultConfigPath returns the first configuration file found in the default locations, or an empty string.
+func defaultConfigPath() string {
+	paths := []string{configFileName}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".config", configFileName))
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// loadConfig reads the configuration file, the returned unknown keys are
+// reported as warnings so typos don't go unnoticed.
+func loadConfig(path string) (cfg Config, unknown []string, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	var keys map[string]interface{}
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return cfg, nil, fmt.Errorf("%s: %s", path, err)
+	}
+	known := configKeys()
+	for key := range keys {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, unknown, nil
+}
+
+// hasSink reports whether the sink is enabled by default in the configuration.
+func (cfg Config) hasSink(sink string) bool {
+	for _, s := range cfg.Sinks {
+		if s == sink {
+			return true
+		}
+	}
+	return false
+}
+
+// Redacted returns a copy of the configuration safe to print, the tokens are replaced.
+func (cfg Config) Redacted() Config {
+	if cfg.FreckleToken != "" {
+		cfg.FreckleToken = redacted
+	}
+	if cfg.LibratoToken != "" {
+		cfg.LibratoToken = redacted
+	}
+	return cfg
+}
+
+// String returns the YAML representation of the configuration.
+func (cfg Config) String() string {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// explicitFlags returns the names of the flags set on the command line.
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// firstNonEmpty returns the first non empty string.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freckle-indicators")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, configFileName)
+	err = ioutil.WriteFile(path, []byte(`
+freckle_token: secret-freckle
+librato_token: secret-librato
+period: month
+sinks: [librato]
+projects:
+  - Acme Web
+  - "102"
+perod: year
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, unknown, err := loadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"perod"}, unknown)
+	assert.Equal(t, "month", cfg.Period)
+	assert.True(t, cfg.hasSink(sinkLibrato))
+	assert.False(t, cfg.hasSink(sinkDryRun))
+	assert.Equal(t, []string{"Acme Web", "102"}, cfg.Projects)
+
+	printed := cfg.Redacted().String()
+	assert.False(t, strings.Contains(printed, "secret"))
+	assert.Equal(t, "secret-freckle", cfg.FreckleToken)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gertv/go-freckle"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// DataSource provides the projects, entries and invoices the report is built from.
+type DataSource interface {
+	Projects(ctx context.Context) ([]freckle.Project, error)
+	Entries(ctx context.Context, projectID int) ([]freckle.Entry, error)
+	Invoices(ctx context.Context, projectID int) ([]kpi.Invoice, error)
+}
+
+// EntryStreamer is implemented by the DataSources able to pass the entries of a project to fn
+// as they are fetched, instead of returning them all at once.
+type EntryStreamer interface {
+	EachEntry(ctx context.Context, projectID int, fn func(freckle.Entry) error) error
+}
+
+// eachEntry passes the entries of the project to fn, page by page when the DataSource is an EntryStreamer.
+func eachEntry(ctx context.Context, ds DataSource, projectID int, fn func(freckle.Entry) error) error {
+	if s, ok := ds.(EntryStreamer); ok {
+		return s.EachEntry(ctx, projectID, fn)
+	}
+	entries, err := ds.Entries(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withContext runs fn in a goroutine and returns as soon as fn returns or the context is done.
+// go-freckle doesn't accept a context, an abandoned call keeps running in the background
+// but its result is ignored.
+func withContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// statusRecorder is an http.RoundTripper recording the status of the last response with an error status,
+// go-freckle only returns the error message of the body.
+type statusRecorder struct {
+	next http.RoundTripper
+
+	mu     sync.Mutex
+	status string
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *statusRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	resp, err := next.RoundTrip(req)
+	if err == nil && resp.StatusCode >= 400 {
+		t.mu.Lock()
+		t.status = resp.Status
+		t.mu.Unlock()
+	}
+	return resp, err
+}
+
+// wrap prefixes err with the recorded HTTP status, if any, which is then cleared.
+func (t *statusRecorder) wrap(err error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil || t.status == "" {
+		return err
+	}
+	err = fmt.Errorf("HTTP %s : %v", t.status, err)
+	t.status = ""
+	return err
+}
+
+// freckleDataSource is a DataSource fetching the data from the Freckle API.
+type freckleDataSource struct {
+	f      freckle.Freckle
+	status *statusRecorder
+	logger *Logger
+	// invoices of the projects without invoices in the projects payload, they save a call per project
+	invoices map[int][]kpi.Invoice
+	// client and token send the expenses requests, which go-freckle doesn't implement,
+	// and the invoices ones, go-freckle doesn't decode the currency of the invoices
+	client *http.Client
+	token  string
+	// invoicesURLs of the projects with invoices, from the projects payload
+	invoicesURLs map[int]string
+	// expensesURLs of the projects with expenses, from the projects payload
+	expensesURLs map[int]string
+}
+
+// NewFreckleDataSource returns a DataSource backed by the Freckle API client, the pages fetched are logged.
+// client and token must be the ones of the Freckle API client, they are used to fetch the expenses.
+// The requests of the Freckle API client are sent with client, the errors mention the HTTP status.
+func NewFreckleDataSource(f freckle.Freckle, client *http.Client, token string, logger *Logger) DataSource {
+	status := &statusRecorder{next: client.Transport}
+	f.Client(&http.Client{Transport: status, Timeout: client.Timeout})
+	return &freckleDataSource{
+		f:            f,
+		status:       status,
+		logger:       logger,
+		invoices:     make(map[int][]kpi.Invoice),
+		client:       client,
+		token:        token,
+		invoicesURLs: make(map[int]string),
+		expensesURLs: make(map[int]string),
+	}
+}
+
+// Projects returns all the projects of the account, the pages are fetched until the context is done.
+func (ds *freckleDataSource) Projects(ctx context.Context) ([]freckle.Project, error) {
+	var page freckle.ProjectsPage
+	err := withContext(ctx, func() (err error) {
+		page, err = ds.f.ProjectsAPI().ListProjects(
+			func(p freckle.Parameters) {})
+		return err
+	})
+	if err != nil {
+		return nil, ds.status.wrap(err)
+	}
+
+	projects := page.Projects
+	pages := 1
+	for page.HasNext() {
+		err = withContext(ctx, func() (err error) {
+			page, err = page.Next()
+			return err
+		})
+		if err != nil {
+			return nil, ds.status.wrap(err)
+		}
+		projects = append(projects, page.Projects...)
+		pages++
+	}
+	ds.logger.Debugf("%d projects fetched in %d pages", len(projects), pages)
+
+	for _, project := range projects {
+		switch {
+		case len(project.Invoices) == 0:
+			ds.invoices[project.Id] = nil
+		case project.Url != "":
+			ds.invoicesURLs[project.Id] = project.Url + "/invoices"
+		default:
+			ds.invoices[project.Id] = kpi.FromFreckleInvoices(project.Invoices)
+		}
+		if project.Expenses > 0 {
+			ds.expensesURLs[project.Id] = project.ExpensesUrl
+		}
+	}
+	return projects, nil
+}
+
+// Entries returns all the entries of the project, the pages are fetched until the context is done.
+func (ds *freckleDataSource) Entries(ctx context.Context, projectID int) ([]freckle.Entry, error) {
+	var entries []freckle.Entry
+	err := ds.EachEntry(ctx, projectID, func(entry freckle.Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// EachEntry passes the entries of the project to fn as the pages are fetched, only a page is held in memory.
+// It stops at the first error returned by fn.
+func (ds *freckleDataSource) EachEntry(ctx context.Context, projectID int, fn func(freckle.Entry) error) error {
+	var page freckle.EntriesPage
+	err := withContext(ctx, func() (err error) {
+		page, err = ds.f.ProjectsAPI().GetEntries(projectID)
+		return err
+	})
+	if err != nil {
+		return ds.status.wrap(err)
+	}
+
+	count := 0
+	pages := 1
+	for {
+		for _, entry := range page.Entries {
+			if err = fn(entry); err != nil {
+				return err
+			}
+		}
+		count += len(page.Entries)
+		if !page.HasNext() {
+			break
+		}
+		err = withContext(ctx, func() (err error) {
+			page, err = page.Next()
+			return err
+		})
+		if err != nil {
+			return ds.status.wrap(err)
+		}
+		pages++
+	}
+	ds.logger.Debugf("project %d : %d entries fetched in %d pages", projectID, count, pages)
+	return nil
+}
+
+// Invoices returns the invoices of the project with their currency, fetched from the invoices URL of the projects payload.
+// The projects without invoices in the projects payload are not fetched. The invoices of the projects not listed yet
+// are fetched by go-freckle, without their currency.
+func (ds *freckleDataSource) Invoices(ctx context.Context, projectID int) ([]kpi.Invoice, error) {
+	if invoices, ok := ds.invoices[projectID]; ok {
+		return invoices, nil
+	}
+	if url, ok := ds.invoicesURLs[projectID]; ok {
+		return fetchInvoices(ctx, ds.client, freckleTokenHeader, ds.token, url)
+	}
+	var invoices []freckle.Invoice
+	err := withContext(ctx, func() (err error) {
+		invoices, err = ds.f.ProjectsAPI().GetInvoices(projectID)
+		return err
+	})
+	return kpi.FromFreckleInvoices(invoices), ds.status.wrap(err)
+}
+
+// Expenses returns the expenses of the project, the projects without expenses in the projects payload are not fetched.
+func (ds *freckleDataSource) Expenses(ctx context.Context, projectID int) ([]kpi.Expense, error) {
+	url, ok := ds.expensesURLs[projectID]
+	if !ok {
+		return nil, nil
+	}
+	return fetchExpenses(ctx, ds.client, freckleTokenHeader, ds.token, url)
+}
+
+// MemoryDataSource is a DataSource serving projects, entries, invoices and expenses held in memory.
+type MemoryDataSource struct {
+	ProjectList       []freckle.Project
+	EntriesByProject  map[int][]freckle.Entry
+	InvoicesByProject map[int][]kpi.Invoice
+	ExpensesByProject map[int][]kpi.Expense
+}
+
+// Projects returns the projects held in memory.
+func (ds *MemoryDataSource) Projects(ctx context.Context) ([]freckle.Project, error) {
+	return ds.ProjectList, ctx.Err()
+}
+
+// Entries returns the entries held in memory for the project.
+func (ds *MemoryDataSource) Entries(ctx context.Context, projectID int) ([]freckle.Entry, error) {
+	return ds.EntriesByProject[projectID], ctx.Err()
+}
+
+// Invoices returns the invoices held in memory for the project.
+func (ds *MemoryDataSource) Invoices(ctx context.Context, projectID int) ([]kpi.Invoice, error) {
+	return ds.InvoicesByProject[projectID], ctx.Err()
+}
+
+// Expenses returns the expenses held in memory for the project.
+func (ds *MemoryDataSource) Expenses(ctx context.Context, projectID int) ([]kpi.Expense, error) {
+	return ds.ExpensesByProject[projectID], ctx.Err()
+}
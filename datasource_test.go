@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gertv/go-freckle"
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// roundTripFunc is an http.RoundTripper answering the requests without network.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestFreckleDataSourceErrorStatus(t *testing.T) {
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusUnauthorized,
+			Status:     "401 Unauthorized",
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader(`{"message": "Bad credentials"}`)),
+			Request:    req,
+		}, nil
+	})}
+	ds := NewFreckleDataSource(freckle.LetsFreckle(freckleAppName, "revoked"), client, "revoked", discardLogger)
+	_, err := ds.Projects(context.Background())
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "HTTP 401 Unauthorized : "), err.Error())
+	}
+}
+
+func TestFreckleDataSourceInvoices(t *testing.T) {
+	var paths []string
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		assert.Equal(t, "token", req.Header.Get(freckleTokenHeader))
+		paths = append(paths, req.URL.Path)
+		body := `[]`
+		switch req.URL.Path {
+		case "/v2/projects":
+			body = `[{"id": 101, "name": "Acme Web", "url": "https://api.letsfreckle.com/v2/projects/101",
+				"invoices": [{"id": 7, "invoice_date": "2016-03-31", "state": "paid", "total_amount": 1200.5}]},
+				{"id": 102, "name": "Globex Mobile", "url": "https://api.letsfreckle.com/v2/projects/102"}]`
+		case "/v2/projects/101/invoices":
+			body = `[{"id": 7, "invoice_date": "2016-03-31", "state": "paid", "total_amount": 1200.5, "currency": "EUR"}]`
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})}
+	ds := NewFreckleDataSource(freckle.LetsFreckle(freckleAppName, "token"), client, "token", discardLogger)
+	_, err := ds.Projects(context.Background())
+	assert.NoError(t, err)
+
+	// go-freckle doesn't decode the currency, the invoices are fetched again with it
+	invoices, err := ds.Invoices(context.Background(), 101)
+	assert.NoError(t, err)
+	assert.Equal(t, []kpi.Invoice{{Id: 7, InvoiceDate: "2016-03-31", State: "paid", TotalAmount: 1200.5, Currency: "EUR"}}, invoices)
+	// The projects without invoices are not fetched
+	invoices, err = ds.Invoices(context.Background(), 102)
+	assert.NoError(t, err)
+	assert.Empty(t, invoices)
+	assert.Equal(t, []string{"/v2/projects", "/v2/projects/101/invoices"}, paths)
+}
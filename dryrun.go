@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/samuel/go-librato/librato"
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+// dryRunGauge is the part of a librato gauge or tagged measurement printed by the dry run, grouped by metric name.
+type dryRunGauge struct {
+	Source      string            `json:"source,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Value       float64           `json:"value"`
+	MeasureTime int64             `json:"measure_time,omitempty"`
+}
+
+// groupGauges groups the gauges of the metrics by name.
+func groupGauges(metrics *librato.Metrics) map[string][]dryRunGauge {
+	groups := make(map[string][]dryRunGauge)
+	for _, g := range metrics.Gauges {
+		gauge, ok := g.(librato.Gauge)
+		if !ok {
+			continue
+		}
+		groups[gauge.Name] = append(groups[gauge.Name], dryRunGauge{Source: gauge.Source, Value: gauge.Sum, MeasureTime: gauge.MeasureTime})
+	}
+	return groups
+}
+
+// groupMeasurements groups the tagged measurements by name.
+func groupMeasurements(measurements []libratoexport.Measurement) map[string][]dryRunGauge {
+	groups := make(map[string][]dryRunGauge)
+	for _, m := range measurements {
+		groups[m.Name] = append(groups[m.Name], dryRunGauge{Tags: m.Tags, Value: m.Value, MeasureTime: m.Time})
+	}
+	return groups
+}
+
+// readSnapshot returns the metric names saved by a previous dry run, ok is false when there is no snapshot yet,
+// or an empty file.
+func readSnapshot(path string) (names map[string]bool, ok bool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, false, nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, false, fmt.Errorf("%s is not a valid dry run snapshot: %s", path, err)
+	}
+	names = make(map[string]bool)
+	for _, name := range list {
+		names[name] = true
+	}
+	return names, true, nil
+}
+
+// writeSnapshot saves the metric names for the next dry run.
+func writeSnapshot(path string, names []string) error {
+	data, err := json.MarshalIndent(names, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// dryRun prints the metrics payload, the gauges or measurements grouped by metric name, instead of posting it to librato,
+// followed by the gauges registered twice with differing values. When snapshotPath is set, the metric names are compared to the ones of the previous dry run
+// to estimate how many new metrics would be created, then the snapshot is updated.
+func dryRun(w io.Writer, groups map[string][]dryRunGauge, conflicts []libratoexport.Conflict, snapshotPath string) error {
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "\nMetrics that would be posted to librato :")
+	fmt.Fprintln(w, string(data))
+
+	var names []string
+	var count int
+	for name, gauges := range groups {
+		names = append(names, name)
+		count += len(gauges)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "%d gauges, %d metric names\n", count, len(names))
+	if len(conflicts) > 0 {
+		fmt.Fprintf(w, "%d gauges were registered twice with differing values :\n", len(conflicts))
+		for _, c := range conflicts {
+			fmt.Fprintf(w, "  %s\n", c)
+		}
+	}
+
+	if snapshotPath == "" {
+		return nil
+	}
+	previous, ok, err := readSnapshot(snapshotPath)
+	if err != nil {
+		return err
+	}
+	if ok {
+		var created int
+		for _, name := range names {
+			if !previous[name] {
+				created++
+			}
+		}
+		fmt.Fprintf(w, "%d new metric names would be created (not in %s)\n", created, snapshotPath)
+	} else {
+		fmt.Fprintf(w, "%d new metric names would be created (no previous snapshot in %s)\n", len(names), snapshotPath)
+	}
+	return writeSnapshot(snapshotPath, names)
+}
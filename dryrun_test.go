@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samuel/go-librato/librato"
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+func TestGroupGauges(t *testing.T) {
+	metrics := &librato.Metrics{Gauges: []interface{}{
+		librato.Gauge{Name: "FreckleAPI.monthlyParticipants.BillableMinutes.Acme-Web", Source: "2016-01", Sum: 60, MeasureTime: 1451606400},
+		librato.Gauge{Name: "FreckleAPI.projects.BillableMinutes", Source: "Acme-Web", Sum: 120},
+		librato.Gauge{Name: "FreckleAPI.monthlyParticipants.BillableMinutes.Acme-Web", Source: "2016-02", Sum: 30, MeasureTime: 1454284800},
+		"not a gauge",
+	}}
+	assert.Equal(t, map[string][]dryRunGauge{
+		"FreckleAPI.monthlyParticipants.BillableMinutes.Acme-Web": {
+			{Source: "2016-01", Value: 60, MeasureTime: 1451606400},
+			{Source: "2016-02", Value: 30, MeasureTime: 1454284800},
+		},
+		"FreckleAPI.projects.BillableMinutes": {{Source: "Acme-Web", Value: 120}},
+	}, groupGauges(metrics))
+
+	measurements := []libratoexport.Measurement{
+		{Name: "freckle.billable_minutes", Value: 60, Tags: map[string]string{"project": "Acme-Web"}},
+		{Name: "freckle.billable_minutes", Value: 30, Tags: map[string]string{"project": "Globex-Mobile"}},
+		{Name: "freckle.invoiced_amount", Value: 50, Tags: map[string]string{"project": "Acme-Web"}, Time: 1451606400},
+	}
+	assert.Equal(t, map[string][]dryRunGauge{
+		"freckle.billable_minutes": {
+			{Tags: map[string]string{"project": "Acme-Web"}, Value: 60},
+			{Tags: map[string]string{"project": "Globex-Mobile"}, Value: 30},
+		},
+		"freckle.invoiced_amount": {{Tags: map[string]string{"project": "Acme-Web"}, Value: 50, MeasureTime: 1451606400}},
+	}, groupMeasurements(measurements))
+}
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freckle-dryrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "snapshot.json")
+
+	groups := map[string][]dryRunGauge{
+		"FreckleAPI.projects.BillableMinutes":   {{Source: "Acme-Web", Value: 60}, {Source: "Globex-Mobile", Value: 30}},
+		"FreckleAPI.projects.UnbillableMinutes": {{Source: "Acme-Web", Value: 10}},
+	}
+	conflicts := []libratoexport.Conflict{{Name: "FreckleAPI.projects.BillableMinutes", Source: "Acme-Web", Values: []float64{60, 90}, Kept: 60}}
+	var buf bytes.Buffer
+	assert.NoError(t, dryRun(&buf, groups, conflicts, ""))
+	out := buf.String()
+	assert.Contains(t, out, "3 gauges, 2 metric names\n")
+	assert.Contains(t, out, "1 gauges were registered twice with differing values :\n  "+conflicts[0].String()+"\n")
+	assert.NotContains(t, out, "new metric names")
+	_, err = os.Stat(snapshot)
+	assert.True(t, os.IsNotExist(err))
+
+	// Without previous snapshot, every name is new, then the snapshot is written
+	buf.Reset()
+	assert.NoError(t, dryRun(&buf, groups, nil, snapshot))
+	assert.Contains(t, buf.String(), "2 new metric names would be created (no previous snapshot in "+snapshot+")\n")
+	assert.NotContains(t, buf.String(), "registered twice")
+	var names []string
+	data, err := ioutil.ReadFile(snapshot)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &names))
+	assert.Equal(t, []string{"FreckleAPI.projects.BillableMinutes", "FreckleAPI.projects.UnbillableMinutes"}, names)
+
+	// Only the names missing from the snapshot are counted
+	groups["FreckleAPI.projects.InvoicedAmount"] = []dryRunGauge{{Source: "Acme-Web", Value: 50}}
+	buf.Reset()
+	assert.NoError(t, dryRun(&buf, groups, nil, snapshot))
+	assert.Contains(t, buf.String(), "4 gauges, 3 metric names\n")
+	assert.Contains(t, buf.String(), "1 new metric names would be created (not in "+snapshot+")\n")
+	buf.Reset()
+	assert.NoError(t, dryRun(&buf, groups, nil, snapshot))
+	assert.Contains(t, buf.String(), "0 new metric names would be created (not in "+snapshot+")\n")
+
+	// An empty snapshot is no previous snapshot
+	assert.NoError(t, ioutil.WriteFile(snapshot, nil, 0644))
+	buf.Reset()
+	assert.NoError(t, dryRun(&buf, groups, nil, snapshot))
+	assert.Contains(t, buf.String(), "3 new metric names would be created (no previous snapshot in "+snapshot+")\n")
+
+	assert.NoError(t, ioutil.WriteFile(snapshot, []byte("{"), 0644))
+	err = dryRun(&buf, groups, nil, snapshot)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), snapshot+" is not a valid dry run snapshot")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Environment variables holding the SMTP connection settings.
+const (
+	smtpHostVarName     = "SMTP_HOST"
+	smtpPortVarName     = "SMTP_PORT"
+	smtpUserVarName     = "SMTP_USER"
+	smtpPasswordVarName = "SMTP_PASSWORD"
+)
+
+// defaultSMTPPort is the submission port, the connection is upgraded with STARTTLS.
+const defaultSMTPPort = "587"
+
+// defaultEmailSubject is the template of the subject of the report email.
+const defaultEmailSubject = "Freckle KPIs for {{.Period}}"
+
+// emailSubjectData is interpolated in the subject template.
+type emailSubjectData struct {
+	// Period is the label of the latest period of the report, e.g. 2016-06
+	Period string
+	// Window is the range of the report set by -from or -since, empty otherwise
+	Window   string
+	Projects int
+}
+
+// smtpSettings holds the SMTP connection settings.
+type smtpSettings struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+}
+
+// splitAddresses returns the comma separated email addresses, without the blank ones.
+func splitAddresses(s string) []string {
+	var addresses []string
+	for _, address := range strings.Split(s, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// latestPeriodLabel returns the label of the latest dated period of the report, or an empty string.
+func latestPeriodLabel(report Report) string {
+	var label string
+	var latest time.Time
+	for _, project := range report.Projects {
+		for _, ppm := range project.Periods {
+			if !ppm.Uninvoiced && !ppm.Period.Before(latest) {
+				latest, label = ppm.Period, ppm.Label()
+			}
+		}
+	}
+	return label
+}
+
+// emailSubject interpolates the data in the subject template.
+func emailSubject(subject string, data emailSubjectData) (string, error) {
+	tmpl, err := template.New("subject").Parse(subject)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// composeEmail returns the MIME message of the plain text body.
+func composeEmail(from string, to []string, subject, body string, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(strings.Replace(body, "\n", "\r\n", -1))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sendEmail sends the message through the SMTP server, the connection is upgraded with STARTTLS
+// when the server supports it, which is required to authenticate.
+func sendEmail(settings smtpSettings, from string, to []string, msg []byte) error {
+	c, err := smtp.Dial(net.JoinHostPort(settings.Host, settings.Port))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: settings.Host}); err != nil {
+			return err
+		}
+	}
+	if settings.User != "" {
+		if err := c.Auth(smtp.PlainAuth("", settings.User, settings.Password, settings.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, address := range to {
+		if err := c.Rcpt(address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
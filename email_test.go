@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitAddresses(t *testing.T) {
+	assert.Equal(t, []string{"a@example.com", "b@example.com"}, splitAddresses(" a@example.com,, b@example.com "))
+	assert.Empty(t, splitAddresses(""))
+}
+
+func TestEmailSubject(t *testing.T) {
+	report, err := Run(context.Background(), fixtureDataSource(t), monthlyOptions())
+	assert.NoError(t, err)
+
+	subject, err := emailSubject(defaultEmailSubject, emailSubjectData{Period: latestPeriodLabel(report), Projects: len(report.Projects)})
+	assert.NoError(t, err)
+	assert.Equal(t, "Freckle KPIs for 2016-04", subject)
+
+	_, err = emailSubject("{{.Unknown}}", emailSubjectData{})
+	assert.Error(t, err)
+}
+
+func TestComposeEmail(t *testing.T) {
+	date := time.Date(2016, time.July, 1, 8, 0, 0, 0, time.UTC)
+	msg, err := composeEmail("kpi@example.com", []string{"a@example.com", "b@example.com"}, "Freckle KPIs for 2016-06", "Acme Web total invoiced : €4,800.00\n", date)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join([]string{
+		"From: kpi@example.com",
+		"To: a@example.com, b@example.com",
+		"Subject: Freckle KPIs for 2016-06",
+		"Date: Fri, 01 Jul 2016 08:00:00 +0000",
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"Acme Web total invoiced : =E2=82=AC4,800.00",
+		"",
+	}, "\r\n"), string(msg))
+}
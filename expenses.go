@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// ExpenseSource is implemented by the DataSources providing the project expenses,
+// the projects of the other DataSources have no expenses.
+type ExpenseSource interface {
+	Expenses(ctx context.Context, projectID int) ([]kpi.Expense, error)
+}
+
+// errExpensesNotFound is returned when the API doesn't expose the expenses of a project.
+var errExpensesNotFound = fmt.Errorf("expenses not found")
+
+// nextLinkRegexp extracts the URL of the next page from the Link header.
+var nextLinkRegexp = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// freckleExpense is an expense of the Freckle v2 API, the amount is sent as a number or a string.
+type freckleExpense struct {
+	Id          int         `json:"id"`
+	Date        string      `json:"date"`
+	Amount      json.Number `json:"amount"`
+	Description string      `json:"description"`
+}
+
+// fetchExpenses fetches all the pages of expenses starting at url, the token is sent in the tokenHeader.
+// go-freckle doesn't implement the expenses API, the requests are sent with the same client and token.
+func fetchExpenses(ctx context.Context, client *http.Client, tokenHeader, token, url string) ([]kpi.Expense, error) {
+	var expenses []kpi.Expense
+	_, err := fetchPages(ctx, client, tokenHeader, token, url, func(data []byte) error {
+		var page []freckleExpense
+		if err := json.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		for _, e := range page {
+			amount, err := e.Amount.Float64()
+			if err != nil {
+				return fmt.Errorf("expense %d has an invalid amount %q", e.Id, e.Amount)
+			}
+			expenses = append(expenses, kpi.Expense{Id: e.Id, Date: e.Date, Amount: amount, Description: e.Description})
+		}
+		return nil
+	})
+	if err == errPageNotFound {
+		return nil, errExpensesNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return expenses, nil
+}
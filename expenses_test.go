@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+func TestFetchExpenses(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("X-FreckleToken"))
+		switch r.URL.Path {
+		case "/projects/101/expenses":
+			if r.URL.Query().Get("page") == "" {
+				w.Header().Set("Link", fmt.Sprintf("<%s%s?page=2>; rel=\"next\"", server.URL, r.URL.Path))
+				fmt.Fprint(w, `[{"id": 1, "date": "2016-03-15", "amount": 250.0, "description": "Train tickets"}]`)
+				return
+			}
+			fmt.Fprint(w, `[{"id": 2, "date": "2016-04-02", "amount": "19.90", "description": "Domain name"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	expenses, err := fetchExpenses(context.Background(), server.Client(), freckleTokenHeader, "secret", server.URL+"/projects/101/expenses")
+	assert.NoError(t, err)
+	assert.Equal(t, []kpi.Expense{
+		{Id: 1, Date: "2016-03-15", Amount: 250, Description: "Train tickets"},
+		{Id: 2, Date: "2016-04-02", Amount: 19.9, Description: "Domain name"},
+	}, expenses)
+
+	_, err = fetchExpenses(context.Background(), server.Client(), freckleTokenHeader, "secret", server.URL+"/projects/102/expenses")
+	assert.Equal(t, errExpensesNotFound, err)
+}
+
+// failingExpensesDataSource fails to fetch the expenses.
+type failingExpensesDataSource struct {
+	*MemoryDataSource
+}
+
+func (ds failingExpensesDataSource) Expenses(ctx context.Context, projectID int) ([]kpi.Expense, error) {
+	return nil, errExpensesNotFound
+}
+
+func TestRunIgnoresExpensesErrors(t *testing.T) {
+	report, err := Run(context.Background(), failingExpensesDataSource{fixtureDataSource(t)}, monthlyOptions())
+	assert.NoError(t, err)
+	assert.Len(t, report.Projects, 2)
+	assert.Len(t, report.Projects[0].Expenses, 0)
+}
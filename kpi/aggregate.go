@@ -0,0 +1,211 @@
+package kpi
+
+import (
+	"time"
+
+	"github.com/gertv/go-freckle"
+)
+
+// BillableFilter selects the entries the KPIs are computed from by their billable status.
+type BillableFilter string
+
+const (
+	// BillableAll keeps all the entries.
+	BillableAll BillableFilter = "all"
+	// BillableOnly only keeps the billable entries.
+	BillableOnly BillableFilter = "only"
+	// BillableExclude only keeps the unbillable entries.
+	BillableExclude BillableFilter = "exclude"
+)
+
+// IsValidBillableFilter reports whether f is one of the BillableFilter.
+func IsValidBillableFilter(f BillableFilter) bool {
+	switch f {
+	case BillableAll, BillableOnly, BillableExclude:
+		return true
+	}
+	return false
+}
+
+// IsActive reports whether the filter drops some entries, the empty filter keeps all the entries.
+func (f BillableFilter) IsActive() bool {
+	return f == BillableOnly || f == BillableExclude
+}
+
+// Keep reports whether the entry is kept by the filter.
+func (f BillableFilter) Keep(entry freckle.Entry) bool {
+	switch f {
+	case BillableOnly:
+		return entry.Billable
+	case BillableExclude:
+		return !entry.Billable
+	}
+	return true
+}
+
+// Description describes the entries kept by the filter.
+func (f BillableFilter) Description() string {
+	switch f {
+	case BillableOnly:
+		return "billable entries only"
+	case BillableExclude:
+		return "unbillable entries only"
+	}
+	return "all entries"
+}
+
+// AggregateOptions selects the KPIs accumulated by an EntryAggregator.
+type AggregateOptions struct {
+	// TimeAgg is the period of the breakdown, the entries are not aggregated per period when nil
+	TimeAgg   TimeAggregater
+	DateBasis DateBasis
+	// MoreTimeAggs are the periods of the other breakdowns aggregated from the same entries, e.g. the years along the months
+	MoreTimeAggs []TimeAggregater
+	// From drops the entries worked before it, when not zero
+	From time.Time
+	// Billable drops the entries by their billable status, all the entries are kept when empty
+	Billable BillableFilter
+	// HistogramBounds are the upper bounds of the buckets of the entry durations, see DurationHistogram.
+	// The histogram is only accumulated when they are set
+	HistogramBounds []int
+	// WeekdayLocation is the time zone the weekday of the entries is taken in, see EntryWeekday.
+	// The minutes are only accumulated per weekday when it is set
+	WeekdayLocation *time.Location
+	// KeepEntries also keeps the entries, for the outputs needing the detailed entries
+	KeepEntries bool
+}
+
+// EntryAggregator accumulates the KPIs of the entries of a project in a single pass,
+// so the entries can be consumed as they are fetched instead of being held in memory.
+type EntryAggregator struct {
+	from         string
+	billable     BillableFilter
+	keepEntries  bool
+	participants *ParticipantKpisBuilder
+	periods      *ParticipantsPeriodBuilder
+	morePeriods  []*ParticipantsPeriodBuilder
+	histogram    *HistogramBuilder
+	weekdayLoc   *time.Location
+	weekdays     *WeekdayKpi
+	aggregates   EntryAggregates
+}
+
+// EntryAggregates holds the KPIs accumulated by an EntryAggregator.
+type EntryAggregates struct {
+	BillableMinutes   int
+	UnbillableMinutes int
+	InvoicedMinutes   int
+	// EntryCount counts the entries aggregated, the ones dropped by AggregateOptions.From or Billable are not counted
+	EntryCount   int
+	Participants ParticipantKpis
+	Periods      []ParticipantsPeriod
+	// MorePeriods holds the breakdowns per AggregateOptions.MoreTimeAggs, in the same order
+	MorePeriods [][]ParticipantsPeriod
+	// Histogram is nil without AggregateOptions.HistogramBounds
+	Histogram *Histogram
+	// Weekdays is nil without AggregateOptions.WeekdayLocation
+	Weekdays *WeekdayKpi
+	// Entries are only kept with AggregateOptions.KeepEntries
+	Entries []freckle.Entry
+	// Skipped holds the entries left out because one of their dates can't be parsed
+	Skipped []SkippedEntry
+}
+
+// NewEntryAggregator returns an empty EntryAggregator.
+func NewEntryAggregator(opts AggregateOptions) *EntryAggregator {
+	a := &EntryAggregator{
+		keepEntries:  opts.KeepEntries,
+		billable:     opts.Billable,
+		participants: NewParticipantKpisBuilder(),
+	}
+	if !opts.From.IsZero() {
+		a.from = formatDay(opts.From)
+	}
+	if opts.TimeAgg != nil {
+		a.periods = NewParticipantsPeriodBuilder(opts.TimeAgg, opts.DateBasis)
+	}
+	for _, tagg := range opts.MoreTimeAggs {
+		a.morePeriods = append(a.morePeriods, NewParticipantsPeriodBuilder(tagg, opts.DateBasis))
+	}
+	if len(opts.HistogramBounds) > 0 {
+		a.histogram = NewHistogramBuilder(opts.HistogramBounds)
+	}
+	if opts.WeekdayLocation != nil {
+		a.weekdayLoc = opts.WeekdayLocation
+		a.weekdays = &WeekdayKpi{}
+	}
+	return a
+}
+
+// Add accumulates the entry. The entries whose dates can't be parsed are skipped, see EntryAggregates.Skipped.
+func (a *EntryAggregator) Add(entry freckle.Entry) {
+	t, err := ParseDate(entry.Date)
+	if err != nil {
+		a.aggregates.Skipped = append(a.aggregates.Skipped, SkippedEntry{Entry: entry, Err: err})
+		return
+	}
+	if a.from != "" && formatDay(t) < a.from {
+		return
+	}
+	if !a.billable.Keep(entry) {
+		return
+	}
+	var day time.Weekday
+	if a.weekdays != nil {
+		if day, err = EntryWeekday(entry, a.weekdayLoc); err != nil {
+			a.aggregates.Skipped = append(a.aggregates.Skipped, SkippedEntry{Entry: entry, Err: err})
+			return
+		}
+	}
+	if a.periods != nil {
+		if err := a.periods.Add(entry); err != nil {
+			a.aggregates.Skipped = append(a.aggregates.Skipped, SkippedEntry{Entry: entry, Err: err})
+			return
+		}
+	}
+	// The breakdowns share the date of the entry, it can't be parsed by one and not by the other
+	for _, periods := range a.morePeriods {
+		periods.Add(entry)
+	}
+	a.participants.Add(entry)
+	if a.histogram != nil {
+		a.histogram.Add(entry)
+	}
+	if a.weekdays != nil {
+		a.weekdays.add(day, entry)
+	}
+	if a.keepEntries {
+		a.aggregates.Entries = append(a.aggregates.Entries, entry)
+	}
+
+	a.aggregates.EntryCount++
+	if !entry.Billable {
+		a.aggregates.UnbillableMinutes += entry.Minutes
+		return
+	}
+	a.aggregates.BillableMinutes += entry.Minutes
+	if entry.InvoicedAt != "" {
+		a.aggregates.InvoicedMinutes += entry.Minutes
+	}
+}
+
+// Aggregates returns the KPIs accumulated so far.
+func (a *EntryAggregator) Aggregates() EntryAggregates {
+	aggregates := a.aggregates
+	aggregates.Participants = a.participants.ParticipantKpis()
+	if a.periods != nil {
+		aggregates.Periods = a.periods.ParticipantsPeriods()
+	}
+	for _, periods := range a.morePeriods {
+		aggregates.MorePeriods = append(aggregates.MorePeriods, periods.ParticipantsPeriods())
+	}
+	if a.histogram != nil {
+		h := a.histogram.Histogram()
+		aggregates.Histogram = &h
+	}
+	if a.weekdays != nil {
+		w := *a.weekdays
+		aggregates.Weekdays = &w
+	}
+	return aggregates
+}
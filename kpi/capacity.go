@@ -0,0 +1,141 @@
+package kpi
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gertv/go-freckle"
+)
+
+// MonthSet is a set of the months of a year, e.g. the months with entries in a yearly period.
+type MonthSet uint16
+
+// Add returns the set with the month added.
+func (s MonthSet) Add(m time.Month) MonthSet {
+	return s | 1<<uint(m-1)
+}
+
+// Len returns the number of months in the set.
+func (s MonthSet) Len() int {
+	return bits.OnesCount16(uint16(s))
+}
+
+// Capacity is the time the participants can work per month, in minutes.
+type Capacity struct {
+	// Minutes is the monthly capacity of the participants without override
+	Minutes float64
+	// Overrides are the monthly capacities of some participants by lower case email, e.g. the part-timers
+	Overrides map[string]float64
+}
+
+// ParseCapacity parses a monthly capacity like 160h or 37h30m into minutes.
+func ParseCapacity(value string) (float64, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%q is not a positive duration, e.g. 160h", value)
+	}
+	return d.Minutes(), nil
+}
+
+// IsSet reports whether a capacity is configured, the utilization is only computed then.
+func (c Capacity) IsSet() bool {
+	return c.Minutes > 0 || len(c.Overrides) > 0
+}
+
+// MonthlyMinutes returns the monthly capacity of the participant, zero when it has none.
+func (c Capacity) MonthlyMinutes(p freckle.Participant) float64 {
+	if minutes, ok := c.Overrides[strings.ToLower(p.Email)]; ok {
+		return minutes
+	}
+	return c.Minutes
+}
+
+// Utilization is the time of a participant relative to its capacity over a period, in percent.
+type Utilization struct {
+	// Total is the billable and unbillable time relative to the capacity
+	Total float64
+	// Billable is the billable time relative to the capacity
+	Billable float64
+}
+
+func (u Utilization) String() string {
+	return fmt.Sprintf("Utilization : %.0f%% (billable %.0f%%)", u.Total, u.Billable)
+}
+
+// GetUtilization returns the Utilization of the participant over a period of the given number of months.
+// ok is false when the participant has no capacity.
+func (c Capacity) GetUtilization(p ParticipantKpi, months int) (u Utilization, ok bool) {
+	capacity := c.MonthlyMinutes(p.Participant) * float64(months)
+	if capacity <= 0 {
+		return u, false
+	}
+	return Utilization{
+		Total:    float64(p.BillableMinutes+p.UnbillableMinutes) / capacity * 100,
+		Billable: float64(p.BillableMinutes) / capacity * 100,
+	}, true
+}
+
+// PeriodMonths returns the number of months the monthly capacity is scaled by over the period: the months
+// of the period, e.g. 12 for a year, or with presentOnly the months of the period with entries, e.g. for
+// the current year.
+func PeriodMonths(tagg TimeAggregater, period time.Time, present MonthSet, presentOnly bool) int {
+	if presentOnly && present.Len() > 0 {
+		return present.Len()
+	}
+	start, next := tagg.GetPeriod(period), tagg.Next(period)
+	return (next.Year()-start.Year())*12 + int(next.Month()) - int(start.Month())
+}
+
+// UtilizationPeriod holds the time of the participants in all the projects during a period.
+type UtilizationPeriod struct {
+	TimeAgg TimeAggregater
+	Period  time.Time
+	// Months are the months of the period with entries in any of the projects
+	Months       MonthSet
+	Participants ParticipantKpis
+}
+
+// Label returns the period printed in the output.
+func (up UtilizationPeriod) Label() string {
+	return up.TimeAgg.GetString(up.Period)
+}
+
+// GetUtilizationPeriods merges the participants of the dated periods of the projects per period, sorted by period.
+// The uninvoiced periods of the DateBasisInvoiced basis are left out.
+func GetUtilizationPeriods(projects [][]ProjectPeriodKpi) ([]UtilizationPeriod, error) {
+	periods := make(map[int]*UtilizationPeriod)
+	builders := make(map[int]*ParticipantKpisBuilder)
+	var keys []int
+	for _, ppks := range projects {
+		for _, ppk := range ppks {
+			if ppk.Uninvoiced || len(ppk.Participants) == 0 {
+				continue
+			}
+			key, err := ppk.TimeAgg.GetInt(ppk.Period)
+			if err != nil {
+				return nil, err
+			}
+			up, ok := periods[key]
+			if !ok {
+				up = &UtilizationPeriod{TimeAgg: ppk.TimeAgg, Period: ppk.TimeAgg.GetPeriod(ppk.Period)}
+				periods[key] = up
+				builders[key] = NewParticipantKpisBuilder()
+				keys = append(keys, key)
+			}
+			up.Months |= ppk.Months
+			builders[key].Merge(ppk.Participants)
+		}
+	}
+
+	sort.Ints(keys)
+	ups := make([]UtilizationPeriod, 0, len(keys))
+	for _, key := range keys {
+		up := periods[key]
+		up.Participants = builders[key].ParticipantKpis()
+		ups = append(ups, *up)
+	}
+	return ups, nil
+}
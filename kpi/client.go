@@ -0,0 +1,104 @@
+package kpi
+
+import (
+	"fmt"
+	"sort"
+)
+
+// UnassignedClient is the client of the projects without group nor mapping, so the client totals reconcile with the projects.
+const UnassignedClient = "unassigned"
+
+// ClientKpi represents the KPIs of all the projects of a client.
+type ClientKpi struct {
+	Name     string
+	Projects []ProjectKpi
+
+	BillableMinutes   int
+	UnbillableMinutes int
+	InvoicedMinutes   int
+	Invoiced          Amounts
+	// Participants merges the participants of all the projects of the client
+	Participants ParticipantKpis
+	// DefaultCurrency is the currency of the invoices of the projects without currency, DefaultCurrency when empty
+	DefaultCurrency string
+}
+
+func (c ClientKpi) String() string {
+	return c.Format(DefaultFormatter)
+}
+
+// Format is String with the display settings of f.
+func (c ClientKpi) Format(f Formatter) string {
+	return fmt.Sprintf(
+		"%s (%d projects) total invoiced : %s, %s - Billable : %s - Unbillable : %s",
+		c.Name, len(c.Projects),
+		f.FormatAmounts(c.Invoiced), f.FormatDuration(float64(c.InvoicedMinutes)),
+		f.FormatDuration(float64(c.BillableMinutes)),
+		f.FormatDuration(float64(c.UnbillableMinutes)))
+}
+
+// ClientName returns the client of the project: the name of its freckle group, then the client
+// mapped to the project name in clientMap, UnassignedClient otherwise.
+func ClientName(p ProjectKpi, clientMap map[string]string) string {
+	if p.Group.Name != "" {
+		return p.Group.Name
+	}
+	if client, ok := clientMap[p.Name]; ok && client != "" {
+		return client
+	}
+	return UnassignedClient
+}
+
+// clientKpis implements the sort interface for a slice of ClientKpi ordered by name, with UnassignedClient last.
+type clientKpis []ClientKpi
+
+func (slice clientKpis) Len() int {
+	return len(slice)
+}
+
+func (slice clientKpis) Less(i, j int) bool {
+	if (slice[i].Name == UnassignedClient) != (slice[j].Name == UnassignedClient) {
+		return slice[j].Name == UnassignedClient
+	}
+	return slice[i].Name < slice[j].Name
+}
+
+func (slice clientKpis) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+// GetClientKpis groups the projects by client, see ClientName, and sums their KPIs.
+// participants holds the ParticipantKpis of the projects by project ID.
+func GetClientKpis(projects []ProjectKpi, participants map[int]ParticipantKpis, clientMap map[string]string) []ClientKpi {
+	clients := make(map[string]*ClientKpi)
+	var names []string
+	for _, p := range projects {
+		name := ClientName(p, clientMap)
+		c, ok := clients[name]
+		if !ok {
+			c = &ClientKpi{Name: name, Invoiced: make(Amounts), DefaultCurrency: p.InvoiceOptions.Currency}
+			clients[name] = c
+			names = append(names, name)
+		}
+		c.Projects = append(c.Projects, p)
+		c.BillableMinutes += p.BillableMinutes
+		c.UnbillableMinutes += p.UnbillableMinutes
+		c.InvoicedMinutes += p.InvoicedMinutes
+		for currency, amount := range p.GetInvoicedTotalPerCurrency() {
+			c.Invoiced[currency] += amount
+		}
+	}
+
+	var cks []ClientKpi
+	for _, name := range names {
+		c := clients[name]
+		b := NewParticipantKpisBuilder()
+		for _, p := range c.Projects {
+			b.Merge(participants[p.Id])
+		}
+		c.Participants = b.ParticipantKpis()
+		cks = append(cks, *c)
+	}
+	sort.Sort(clientKpis(cks))
+	return cks
+}
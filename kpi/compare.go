@@ -0,0 +1,134 @@
+package kpi
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gertv/go-freckle"
+)
+
+// ValueComparison represents a value in two periods and its change.
+type ValueComparison struct {
+	A, B  float64
+	Delta Delta
+}
+
+func newValueComparison(a, b float64) ValueComparison {
+	return ValueComparison{A: a, B: b, Delta: newDelta(a, b)}
+}
+
+// DeltaString formats the change as a percentage, or as an absolute value formatted
+// by format when the first value is zero.
+func (c ValueComparison) DeltaString(format func(float64) string) string {
+	if c.Delta.HasPercent {
+		return fmt.Sprintf("%+.0f%%", c.Delta.Percent)
+	}
+	if c.Delta.Absolute < 0 {
+		return format(c.Delta.Absolute)
+	}
+	return "+" + format(c.Delta.Absolute)
+}
+
+// ParticipantComparison represents the minutes of a participant in two periods.
+type ParticipantComparison struct {
+	ParticipantKpi
+	Minutes ValueComparison
+}
+
+// participantComparisons implements the sort interface for a slice of ParticipantComparison ordered by display name.
+type participantComparisons []ParticipantComparison
+
+func (slice participantComparisons) Len() int {
+	return len(slice)
+}
+
+func (slice participantComparisons) Less(i, j int) bool {
+	if slice[i].DisplayName() != slice[j].DisplayName() {
+		return slice[i].DisplayName() < slice[j].DisplayName()
+	}
+	return slice[i].Id < slice[j].Id
+}
+
+func (slice participantComparisons) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+// PeriodComparison represents the project information of two periods side by side.
+type PeriodComparison struct {
+	Name string
+	A, B string
+	// Invoiced holds the amount invoiced for each currency
+	Invoiced   map[string]ValueComparison
+	Billable   ValueComparison
+	Unbillable ValueComparison
+	// Participants of either period, a participant missing from one of them has zero minutes in it
+	Participants []ParticipantComparison
+}
+
+// Currencies returns the sorted currencies invoiced in either period.
+func (c PeriodComparison) Currencies() []string {
+	var currencies []string
+	for currency := range c.Invoiced {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+// findPeriod returns the dated ProjectPeriodKpi of the period, a zero valued one when there is none.
+func findPeriod(ppks []ProjectPeriodKpi, tagg TimeAggregater, period time.Time) ProjectPeriodKpi {
+	for _, ppk := range ppks {
+		if !ppk.Uninvoiced && ppk.Period.Equal(period) {
+			return ppk
+		}
+	}
+	return ProjectPeriodKpi{TimeAgg: tagg, Period: period}
+}
+
+// ComparePeriods compares the periods a and b of the slice of ProjectPeriodKpi of a project.
+// Two periods without invoices compare a zero amount in the currency, DefaultCurrency when empty.
+func ComparePeriods(name string, tagg TimeAggregater, ppks []ProjectPeriodKpi, a, b time.Time, currency string) PeriodComparison {
+	ppa, ppb := findPeriod(ppks, tagg, tagg.GetPeriod(a)), findPeriod(ppks, tagg, tagg.GetPeriod(b))
+	c := PeriodComparison{
+		Name:     name,
+		A:        ppa.Label(),
+		B:        ppb.Label(),
+		Invoiced: make(map[string]ValueComparison),
+	}
+
+	amountsA, amountsB := ppa.GetInvoicedAmounts(), ppb.GetInvoicedAmounts()
+	for currency := range amountsA {
+		c.Invoiced[currency] = newValueComparison(amountsA[currency], amountsB[currency])
+	}
+	for currency := range amountsB {
+		c.Invoiced[currency] = newValueComparison(amountsA[currency], amountsB[currency])
+	}
+	if len(c.Invoiced) == 0 {
+		c.Invoiced[CurrencyOrDefault(currency)] = ValueComparison{}
+	}
+
+	billableA, unbillableA := ppa.GetMinutes()
+	billableB, unbillableB := ppb.GetMinutes()
+	c.Billable = newValueComparison(float64(billableA), float64(billableB))
+	c.Unbillable = newValueComparison(float64(unbillableA), float64(unbillableB))
+
+	minutesA, minutesB := make(map[int]int), make(map[int]int)
+	participants := make(map[int]freckle.Participant)
+	for _, p := range ppa.Participants {
+		minutesA[p.Id] = p.BillableMinutes + p.UnbillableMinutes
+		participants[p.Id] = p.Participant
+	}
+	for _, p := range ppb.Participants {
+		minutesB[p.Id] = p.BillableMinutes + p.UnbillableMinutes
+		participants[p.Id] = p.Participant
+	}
+	for id, p := range participants {
+		c.Participants = append(c.Participants, ParticipantComparison{
+			ParticipantKpi: ParticipantKpi{Participant: p},
+			Minutes:        newValueComparison(float64(minutesA[id]), float64(minutesB[id])),
+		})
+	}
+	sort.Sort(participantComparisons(c.Participants))
+	return c
+}
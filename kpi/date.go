@@ -0,0 +1,50 @@
+package kpi
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gertv/go-freckle"
+)
+
+// dateLayouts are the layouts of the entry and invoice dates, tried in order: the API sends bare dates
+// but some payloads carry a timestamp instead.
+var dateLayouts = []string{"2006-01-02", time.RFC3339, "2006-01-02T15:04:05"}
+
+// ParseDate parses an entry or invoice date with the first of the dateLayouts matching it.
+func ParseDate(value string) (time.Time, error) {
+	return ParseDateIn(value, time.UTC)
+}
+
+// ParseDateIn is ParseDate for the dates without time zone worked in loc, the timestamps keep their time zone.
+func ParseDateIn(value string, loc *time.Location) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date", value)
+}
+
+// formatDay formats the day of t like the bare dates, so the dates can be compared as strings.
+func formatDay(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// SkippedEntry is an entry left out of the KPIs because one of its dates can't be parsed.
+type SkippedEntry struct {
+	Entry freckle.Entry
+	Err   error
+}
+
+// SplitDatedInvoices splits the invoices whose date can be parsed from the other ones, e.g. the drafts without date.
+func SplitDatedInvoices(invoices []Invoice) (dated, undated []Invoice) {
+	for _, invoice := range invoices {
+		if _, err := ParseDate(invoice.InvoiceDate); err != nil {
+			undated = append(undated, invoice)
+			continue
+		}
+		dated = append(dated, invoice)
+	}
+	return dated, undated
+}
@@ -0,0 +1,67 @@
+package kpi
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// DurationFormat selects how the durations are printed.
+type DurationFormat string
+
+const (
+	// DurationHours prints the durations as decimal hours, e.g. 37.5h.
+	DurationHours DurationFormat = "hours"
+	// DurationHHMM prints the durations as hours and minutes, e.g. 37:30.
+	DurationHHMM DurationFormat = "hhmm"
+	// DurationMinutes prints the durations as raw minutes, e.g. 2250min.
+	DurationMinutes DurationFormat = "minutes"
+)
+
+// Formatter holds the display settings of the printed KPIs, the metrics are always registered in raw minutes and amounts.
+type Formatter struct {
+	// Durations is the format of the printed durations
+	Durations DurationFormat
+	// HoursPrecision is the number of decimals of the durations printed as hours
+	HoursPrecision int
+	// AmountPrecision is the number of decimals of the printed amounts of money
+	AmountPrecision int
+	// Currency is the one of the empty amounts, printed as zero, DefaultCurrency when empty
+	Currency string
+}
+
+// DefaultFormatter prints the durations as hours with 1 decimal and the amounts with 2, the String methods use it.
+var DefaultFormatter = Formatter{Durations: DurationHours, HoursPrecision: 1, AmountPrecision: 2}
+
+// IsValidDurationFormat reports whether f is one of the DurationFormat.
+func IsValidDurationFormat(f DurationFormat) bool {
+	switch f {
+	case DurationHours, DurationHHMM, DurationMinutes:
+		return true
+	}
+	return false
+}
+
+// FormatDuration formats minutes according to the Durations format.
+func (f Formatter) FormatDuration(minutes float64) string {
+	switch f.Durations {
+	case DurationHHMM:
+		sign := ""
+		if minutes < 0 {
+			sign = "-"
+		}
+		rounded := int(math.Round(math.Abs(minutes)))
+		return fmt.Sprintf("%s%d:%02d", sign, rounded/60, rounded%60)
+	case DurationMinutes:
+		return strconv.FormatFloat(minutes, 'f', 0, 64) + "min"
+	}
+	return strconv.FormatFloat(minutes/60, 'f', f.HoursPrecision, 64) + "h"
+}
+
+// formatDurationChange formats a change of minutes with an explicit sign.
+func (f Formatter) formatDurationChange(minutes float64) string {
+	if minutes < 0 {
+		return f.FormatDuration(minutes)
+	}
+	return "+" + f.FormatDuration(minutes)
+}
@@ -0,0 +1,54 @@
+package kpi
+
+import (
+	"time"
+)
+
+// Expense is a project expense recorded in freckle, e.g. travel or licenses.
+// The go-freckle client doesn't implement the expenses API yet.
+type Expense struct {
+	Id          int
+	Date        string
+	Amount      float64
+	Description string
+}
+
+// GetExpensesTotalPerCurrency returns the total of the expenses of the project for each currency.
+func (pi *ProjectKpi) GetExpensesTotalPerCurrency() Amounts {
+	expenses := make(Amounts)
+	for _, expense := range pi.Expenses {
+		expenses[CurrencyOrDefault(pi.InvoiceOptions.Currency)] += expense.Amount
+	}
+	return expenses
+}
+
+// GetNetInvoicedPerCurrency returns the amount invoiced minus the expenses for each currency.
+func (pi *ProjectKpi) GetNetInvoicedPerCurrency() Amounts {
+	net := pi.GetInvoicedTotalPerCurrency()
+	for currency, amount := range pi.GetExpensesTotalPerCurrency() {
+		net[currency] -= amount
+	}
+	return net
+}
+
+// getExpensesPerPeriod sums the expenses per period in the currency, keyed by the TimeAggregater int of the period.
+func getExpensesPerPeriod(tagg TimeAggregater, expenses []Expense, currency string) (map[int]Amounts, map[int]time.Time, error) {
+	amounts := make(map[int]Amounts)
+	periods := make(map[int]time.Time)
+	for _, expense := range expenses {
+		t, err := ParseDate(expense.Date)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := tagg.GetInt(t)
+		if err != nil {
+			return nil, nil, err
+		}
+		if amounts[key] == nil {
+			amounts[key] = make(Amounts)
+		}
+		amounts[key][CurrencyOrDefault(currency)] += expense.Amount
+		periods[key] = tagg.GetPeriod(t)
+	}
+	return amounts, periods, nil
+}
@@ -0,0 +1,110 @@
+package kpi
+
+import (
+	"fmt"
+
+	"github.com/gertv/go-freckle"
+)
+
+// DefaultHistogramBounds are the upper bounds, in minutes, of the buckets of the DurationHistogram.
+var DefaultHistogramBounds = []int{15, 30, 60, 120, 240}
+
+// InvalidBucket is the label of the bucket counting the entries with zero or negative minutes.
+const InvalidBucket = "invalid"
+
+// HistogramBucket counts the entries whose duration falls in the bucket.
+type HistogramBucket struct {
+	// Label names the bucket in the output and in the metric names, e.g. le15m, 30m-1h or gt4h
+	Label      string
+	Billable   int
+	Unbillable int
+}
+
+// Count returns the number of entries in the bucket.
+func (b HistogramBucket) Count() int {
+	return b.Billable + b.Unbillable
+}
+
+func (b HistogramBucket) String() string {
+	return fmt.Sprintf("%s : %d (Billable : %d - Unbillable : %d)", b.Label, b.Count(), b.Billable, b.Unbillable)
+}
+
+// add counts the entry in the bucket.
+func (b *HistogramBucket) add(entry freckle.Entry) {
+	if entry.Billable {
+		b.Billable++
+	} else {
+		b.Unbillable++
+	}
+}
+
+// Histogram represents the distribution of the durations of the entries.
+type Histogram struct {
+	// Buckets are ordered by duration, a bucket includes its upper bound
+	Buckets []HistogramBucket
+	// Invalid counts the entries with zero or negative minutes, they are in none of the Buckets
+	Invalid HistogramBucket
+}
+
+// minutesLabel formats a bound in hours when it is a whole number of hours.
+func minutesLabel(minutes int) string {
+	if minutes >= 60 && minutes%60 == 0 {
+		return fmt.Sprintf("%dh", minutes/60)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
+
+// DurationHistogram counts the entries in the buckets delimited by bounds, the sorted upper bounds of the buckets
+// in minutes. The last bucket counts the entries longer than the last bound.
+func DurationHistogram(fes []freckle.Entry, bounds []int) Histogram {
+	b := NewHistogramBuilder(bounds)
+	for _, entry := range fes {
+		b.Add(entry)
+	}
+	return b.Histogram()
+}
+
+// HistogramBuilder accumulates the Histogram of entries added one at a time,
+// so the entries don't need to be held in memory.
+type HistogramBuilder struct {
+	bounds []int
+	h      Histogram
+}
+
+// NewHistogramBuilder returns an empty HistogramBuilder, see DurationHistogram for the bounds.
+func NewHistogramBuilder(bounds []int) *HistogramBuilder {
+	h := Histogram{Invalid: HistogramBucket{Label: InvalidBucket}}
+	for i, bound := range bounds {
+		label := "le" + minutesLabel(bound)
+		if i > 0 {
+			label = minutesLabel(bounds[i-1]) + "-" + minutesLabel(bound)
+		}
+		h.Buckets = append(h.Buckets, HistogramBucket{Label: label})
+	}
+	last := "gt0m"
+	if len(bounds) > 0 {
+		last = "gt" + minutesLabel(bounds[len(bounds)-1])
+	}
+	h.Buckets = append(h.Buckets, HistogramBucket{Label: last})
+	return &HistogramBuilder{bounds: bounds, h: h}
+}
+
+// Add counts the entry in the bucket of its duration.
+func (b *HistogramBuilder) Add(entry freckle.Entry) {
+	if entry.Minutes <= 0 {
+		b.h.Invalid.add(entry)
+		return
+	}
+	i := 0
+	for i < len(b.bounds) && entry.Minutes > b.bounds[i] {
+		i++
+	}
+	b.h.Buckets[i].add(entry)
+}
+
+// Histogram returns the Histogram accumulated.
+func (b *HistogramBuilder) Histogram() Histogram {
+	h := b.h
+	h.Buckets = append([]HistogramBucket(nil), b.h.Buckets...)
+	return h
+}
@@ -0,0 +1,320 @@
+package kpi
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gertv/go-freckle"
+)
+
+// DefaultCurrency is the ISO 4217 code used for the invoices that don't specify their currency,
+// when the InvoiceOptions don't set another one.
+const DefaultCurrency = "USD"
+
+// CurrencyOrDefault returns the currency, DefaultCurrency when it is empty.
+func CurrencyOrDefault(currency string) string {
+	if currency == "" {
+		return DefaultCurrency
+	}
+	return currency
+}
+
+// currencySymbols maps the ISO 4217 codes to the symbol printed in the console output.
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+}
+
+// currencySymbol returns the symbol of the currency, or its code when we don't know the symbol.
+func currencySymbol(currency string) string {
+	if symbol, ok := currencySymbols[currency]; ok {
+		return symbol
+	}
+	return currency + " "
+}
+
+// Invoice is a freckle invoice with its currency, which go-freckle doesn't decode.
+type Invoice struct {
+	Id          int     `json:"id,omitempty"`
+	Reference   string  `json:"reference,omitempty"`
+	InvoiceDate string  `json:"invoice_date,omitempty"`
+	State       string  `json:"state,omitempty"`
+	TotalAmount float64 `json:"total_amount,omitempty"`
+	// Currency is the ISO 4217 code of the amount, empty when the payload doesn't specify it
+	Currency string `json:"currency,omitempty"`
+	Url      string `json:"url,omitempty"`
+}
+
+// FromFreckleInvoices converts the invoices decoded by go-freckle, they have no currency.
+func FromFreckleInvoices(fis []freckle.Invoice) []Invoice {
+	if fis == nil {
+		return nil
+	}
+	invoices := make([]Invoice, len(fis))
+	for i, fi := range fis {
+		invoices[i] = Invoice{Id: fi.Id, Reference: fi.Reference, InvoiceDate: fi.InvoiceDate, State: fi.State, TotalAmount: fi.TotalAmount, Url: fi.Url}
+	}
+	return invoices
+}
+
+// excludedInvoiceStates are the states of the invoices which are not counted, cancelled by us or rejected by the client.
+var excludedInvoiceStates = map[string]bool{
+	"cancelled": true,
+	"canceled":  true,
+	"rejected":  true,
+}
+
+// invoiceStates are the states of the freckle invoices, the cancelled ones are spelled both ways.
+var invoiceStates = []string{"draft", "unpaid", "awaiting_payment", "paid", "rejected", "cancelled", "canceled"}
+
+// InvoiceOptions selects the invoices counted in the invoiced amounts and sets the currency of the ones without currency.
+type InvoiceOptions struct {
+	// CountedStates are the lower case states of the invoices counted in the invoiced amounts, e.g. paid only.
+	// All the invoices but the excludedInvoiceStates ones are counted when it is empty.
+	CountedStates map[string]bool
+	// Currency is the ISO 4217 code of the invoices and the expenses which don't specify one, DefaultCurrency when empty
+	Currency string
+}
+
+// currency returns the upper case currency of the invoice, the one of the options when it doesn't specify one.
+func (o InvoiceOptions) currency(invoice Invoice) string {
+	if currency := strings.ToUpper(strings.TrimSpace(invoice.Currency)); currency != "" {
+		return currency
+	}
+	return CurrencyOrDefault(o.Currency)
+}
+
+// ParseInvoiceStates parses a comma separated list of invoice states, e.g. unpaid,paid, into InvoiceOptions.CountedStates.
+func ParseInvoiceStates(value string) (map[string]bool, error) {
+	states := make(map[string]bool)
+	for _, state := range strings.Split(value, ",") {
+		state = strings.ToLower(strings.TrimSpace(state))
+		if state == "" {
+			return nil, fmt.Errorf("%q is not a valid list of invoice states, e.g. unpaid,paid", value)
+		}
+		if !isInvoiceState(state) {
+			return nil, fmt.Errorf("%q is not an invoice state, the states are : %s", state, strings.Join(invoiceStates, ", "))
+		}
+		states[state] = true
+	}
+	return states, nil
+}
+
+// isInvoiceState reports whether the lower case state is one of the invoiceStates.
+func isInvoiceState(state string) bool {
+	for _, s := range invoiceStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcluded reports whether the invoice is left out of the invoiced amounts, see CountedStates.
+func (o InvoiceOptions) isExcluded(invoice Invoice) bool {
+	state := strings.ToLower(invoice.State)
+	if len(o.CountedStates) > 0 {
+		return !o.CountedStates[state]
+	}
+	return excludedInvoiceStates[state]
+}
+
+// isInvoicePaid reports whether the invoice is paid, the other counted invoices are outstanding.
+func isInvoicePaid(invoice Invoice) bool {
+	return strings.ToLower(invoice.State) == "paid"
+}
+
+// splitString formats the paid and outstanding parts of an invoiced amount.
+func (f Formatter) splitString(paid, outstanding Amounts) string {
+	return fmt.Sprintf("(%s paid, %s outstanding)", f.FormatAmounts(paid), f.FormatAmounts(outstanding))
+}
+
+// FormatAmount formats an amount with its currency symbol, AmountPrecision decimals and thousands separators.
+func (f Formatter) FormatAmount(currency string, amount float64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	s := strconv.FormatFloat(amount, 'f', f.AmountPrecision, 64)
+	integer, decimals := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		integer, decimals = s[:i], s[i:]
+	}
+	for i := len(integer) - 3; i > 0; i -= 3 {
+		integer = integer[:i] + "," + integer[i:]
+	}
+	return sign + currencySymbol(currency) + integer + decimals
+}
+
+// Amounts holds amounts of money keyed by their currency.
+type Amounts map[string]float64
+
+// Currencies returns the sorted list of currencies.
+func (a Amounts) Currencies() []string {
+	var currencies []string
+	for currency := range a {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+// FormatAmounts returns the amounts joined by a `+`, an empty Amounts is printed as zero in the Currency.
+func (f Formatter) FormatAmounts(a Amounts) string {
+	if len(a) == 0 {
+		return f.FormatAmount(CurrencyOrDefault(f.Currency), 0)
+	}
+	var s []string
+	for _, currency := range a.Currencies() {
+		s = append(s, f.FormatAmount(currency, a[currency]))
+	}
+	return strings.Join(s, " + ")
+}
+
+// FormatRates returns the amounts per hour with AmountPrecision decimals joined by a `+`, an empty Amounts
+// is a zero rate in the Currency.
+// There is no rate without hours, it is printed as n/a like the periods without billable hours.
+func (f Formatter) FormatRates(a Amounts, hours float64) string {
+	if hours == 0 {
+		return "n/a"
+	}
+	if len(a) == 0 {
+		return f.formatRate(CurrencyOrDefault(f.Currency), 0)
+	}
+	var s []string
+	for _, currency := range a.Currencies() {
+		s = append(s, f.formatRate(currency, a[currency]/hours))
+	}
+	return strings.Join(s, " + ")
+}
+
+// formatRate formats an amount per hour followed by its currency symbol, e.g. 480.00$/h.
+func (f Formatter) formatRate(currency string, rate float64) string {
+	return strconv.FormatFloat(rate, 'f', f.AmountPrecision, 64) + currencySymbol(currency) + "/h"
+}
+
+// InvoicePeriodKpi is used to aggregate invoice information on a period for a currency.
+// Amount is the sum of the Paid and the Outstanding amounts, the invoices excluded by their state are left out.
+type InvoicePeriodKpi struct {
+	TimeAgg     TimeAggregater
+	Period      time.Time
+	Currency    string
+	Amount      float64
+	Paid        float64
+	Outstanding float64
+}
+
+func (ik InvoicePeriodKpi) String() string {
+	return ik.Format(DefaultFormatter)
+}
+
+// Format is String with the display settings of f.
+func (ik InvoicePeriodKpi) Format(f Formatter) string {
+	s := fmt.Sprintf("%s %s invoiced", ik.TimeAgg.GetString(ik.Period), f.FormatAmount(ik.Currency, ik.Amount))
+	if ik.Amount != 0 {
+		s += " " + f.splitString(Amounts{ik.Currency: ik.Paid}, Amounts{ik.Currency: ik.Outstanding})
+	}
+	return s
+}
+
+// invoicePeriodKey is the aggregation key of the InvoicePeriodKpi
+type invoicePeriodKey struct {
+	period   int
+	currency string
+}
+
+// invoicePeriodKeys implements the sort interface to order the keys by period then currency.
+type invoicePeriodKeys []invoicePeriodKey
+
+func (slice invoicePeriodKeys) Len() int {
+	return len(slice)
+}
+
+func (slice invoicePeriodKeys) Less(i, j int) bool {
+	if slice[i].period != slice[j].period {
+		return slice[i].period < slice[j].period
+	}
+	return slice[i].currency < slice[j].currency
+}
+
+func (slice invoicePeriodKeys) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+// GetInvoiceKpiPerPeriod calculates a slice of InvoicePeriodKpi per period and currency based on a slice of freckle invoice.
+// The invoices excluded by their state are skipped, see InvoiceOptions.
+func GetInvoiceKpiPerPeriod(tagg TimeAggregater, fis []Invoice, opts InvoiceOptions) ([]InvoicePeriodKpi, error) {
+	agrregateInvoices := make(map[invoicePeriodKey]InvoicePeriodKpi)
+	var keys invoicePeriodKeys
+	for _, invoice := range fis {
+		if opts.isExcluded(invoice) {
+			continue
+		}
+		t, err := ParseDate(invoice.InvoiceDate)
+		if err != nil {
+			return nil, err
+		}
+		period, err := tagg.GetInt(t)
+		if err != nil {
+			return nil, err
+		}
+		key := invoicePeriodKey{period, opts.currency(invoice)}
+
+		ik, ok := agrregateInvoices[key]
+		if !ok {
+			keys = append(keys, key)
+		}
+		ik.Period = tagg.GetPeriod(t)
+		ik.Currency = key.currency
+		ik.Amount += invoice.TotalAmount
+		if isInvoicePaid(invoice) {
+			ik.Paid += invoice.TotalAmount
+		} else {
+			ik.Outstanding += invoice.TotalAmount
+		}
+		ik.TimeAgg = tagg
+
+		agrregateInvoices[key] = ik
+	}
+	sort.Sort(keys)
+
+	var sik []InvoicePeriodKpi
+	for _, v := range keys {
+		sik = append(sik, agrregateInvoices[v])
+	}
+	return sik, nil
+}
+
+// FillInvoiceKpiGaps inserts a zero valued InvoicePeriodKpi in the currency, DefaultCurrency when empty, for each
+// period missing between the earliest and the latest period of the sorted slice of InvoicePeriodKpi.
+func FillInvoiceKpiGaps(tagg TimeAggregater, iks []InvoicePeriodKpi, currency string) []InvoicePeriodKpi {
+	if len(iks) == 0 {
+		return iks
+	}
+	var filled []InvoicePeriodKpi
+	expected := iks[0].Period
+	for _, ik := range iks {
+		for ; expected.Before(ik.Period); expected = tagg.Next(expected) {
+			filled = append(filled, InvoicePeriodKpi{TimeAgg: tagg, Period: expected, Currency: CurrencyOrDefault(currency)})
+		}
+		filled = append(filled, ik)
+		expected = tagg.Next(ik.Period)
+	}
+	return filled
+}
+
+// GetInvoiceKpiPerMonth calculates a slice of InvoicePeriodKpi based on a slice of freckle invoice.
+func GetInvoiceKpiPerMonth(fis []Invoice, opts InvoiceOptions) ([]InvoicePeriodKpi, error) {
+	return GetInvoiceKpiPerPeriod(MonthAgg{}, fis, opts)
+}
+
+// GetInvoiceKpiPerYear calculates a slice of InvoicePeriodKpi based on a slice of freckle invoice.
+func GetInvoiceKpiPerYear(fis []Invoice, opts InvoiceOptions) ([]InvoicePeriodKpi, error) {
+	return GetInvoiceKpiPerPeriod(YearAgg{}, fis, opts)
+}
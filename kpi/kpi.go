@@ -0,0 +1,134 @@
+// Package kpi computes key performance indicators, such as the billable and
+// unbillable time of the participants or the amount invoiced per period, out of
+// the projects, entries and invoices returned by the Freckle API.
+package kpi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SanitizeMetricName replaces or removes the characters that are not allowed in a metric name.
+func SanitizeMetricName(s string) string {
+	s = strings.Replace(s, " ", "-", -1)
+	s = strings.Replace(s, "/", "-", -1)
+	s = strings.Replace(s, "\\", "-", -1)
+	s = strings.Replace(s, "#", "", -1)
+	s = strings.Replace(s, "(", "", -1)
+	s = strings.Replace(s, ")", "", -1)
+	return s
+}
+
+// TimeAggregater represents the set of method we need to extract information from time.Time
+type TimeAggregater interface {
+	GetInt(time.Time) (int, error)
+	GetPeriod(time.Time) time.Time
+	GetString(time.Time) string
+	Next(time.Time) time.Time
+	Parse(string) (time.Time, error)
+}
+
+// MonthAgg reprents a monthly TimeAggregater
+type MonthAgg struct{}
+
+// GetInt returns the int composed by the Year and a double digit Month
+func (m MonthAgg) GetInt(t time.Time) (int, error) {
+	return strconv.Atoi(fmt.Sprintf("%d%02d", t.Year(), t.Month()))
+}
+
+// GetString returns the string composed by the Year and a double digit Month separated by a `-`
+func (m MonthAgg) GetString(t time.Time) string {
+	return fmt.Sprintf("%d-%02d", t.Year(), t.Month())
+}
+
+// GetPeriod returns the time.Time truncated after the Year and Month
+func (m MonthAgg) GetPeriod(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Next returns the first day of the month following the one of the time.Time
+func (m MonthAgg) Next(t time.Time) time.Time {
+	return m.GetPeriod(t).AddDate(0, 1, 0)
+}
+
+// Parse returns the period of a label formatted by GetString
+func (m MonthAgg) Parse(label string) (time.Time, error) {
+	return time.Parse("2006-01", label)
+}
+
+// YearAgg reprents a monthly TimeAggregater
+type YearAgg struct{}
+
+// GetInt returns the int composed by the Year
+func (y YearAgg) GetInt(t time.Time) (int, error) {
+	return strconv.Atoi(fmt.Sprintf("%d", t.Year()))
+}
+
+// GetString returns the string composed by the Year
+func (y YearAgg) GetString(t time.Time) string {
+	return fmt.Sprintf("%d", t.Year())
+}
+
+// GetPeriod returns the time.Time truncated after the Year
+func (y YearAgg) GetPeriod(t time.Time) time.Time {
+	return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Next returns the first day of the year following the one of the time.Time
+func (y YearAgg) Next(t time.Time) time.Time {
+	return y.GetPeriod(t).AddDate(1, 0, 0)
+}
+
+// Parse returns the period of a label formatted by GetString
+func (y YearAgg) Parse(label string) (time.Time, error) {
+	return time.Parse("2006", label)
+}
+
+// FormattedAgg is a TimeAggregater whose labels are formatted with a Go time layout, e.g. `Jan 2006`.
+// The periods and their keys are the ones of the wrapped TimeAggregater, so they are sorted the same way.
+type FormattedAgg struct {
+	TimeAggregater
+	Layout string
+}
+
+// NewFormattedAgg returns the FormattedAgg of tagg, the layout must identify the periods of tagg:
+// the label of a known period must parse back to this period.
+func NewFormattedAgg(tagg TimeAggregater, layout string) (FormattedAgg, error) {
+	f := FormattedAgg{TimeAggregater: tagg, Layout: layout}
+	known := tagg.GetPeriod(time.Date(2016, time.November, 1, 0, 0, 0, 0, time.UTC))
+	label := f.GetString(known)
+	period, err := f.Parse(label)
+	if err != nil {
+		return f, fmt.Errorf("%q can't be parsed back with the layout %q : %v", label, layout, err)
+	}
+	if !period.Equal(known) {
+		return f, fmt.Errorf("the layout %q doesn't identify the periods, %s is labeled %q", layout, tagg.GetString(known), label)
+	}
+	return f, nil
+}
+
+// GetString returns the period of the time.Time formatted with the layout
+func (f FormattedAgg) GetString(t time.Time) string {
+	return f.GetPeriod(t).Format(f.Layout)
+}
+
+// Parse returns the period of a label formatted by GetString
+func (f FormattedAgg) Parse(label string) (time.Time, error) {
+	t, err := time.Parse(f.Layout, label)
+	if err != nil {
+		return t, err
+	}
+	return f.GetPeriod(t), nil
+}
+
+// DateBasis selects which date of an entry is used to attribute it to a period.
+type DateBasis string
+
+const (
+	// DateBasisWorked attributes the entries to the period in which they were worked.
+	DateBasisWorked DateBasis = "worked"
+	// DateBasisInvoiced attributes the entries to the period in which they were invoiced.
+	DateBasisInvoiced DateBasis = "invoiced"
+)
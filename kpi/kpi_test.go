@@ -0,0 +1,752 @@
+package kpi
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gertv/go-freckle"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	alice = freckle.Participant{Id: 1, Email: "alice@example.com", FirstName: "Alice", LastName: "Smith"}
+	bob   = freckle.Participant{Id: 2, Email: "bob@example.com", FirstName: "Bob", LastName: "Jones"}
+)
+
+// shuffledEntries spans several months in a non chronological order.
+var shuffledEntries = []freckle.Entry{
+	{Date: "2016-07-12", User: alice, Billable: true, Minutes: 60},
+	{Date: "2016-02-03", User: bob, Billable: false, Minutes: 30},
+	{Date: "2016-11-28", User: alice, Billable: true, Minutes: 90},
+	{Date: "2016-05-09", User: bob, Billable: true, Minutes: 120},
+	{Date: "2016-07-01", User: bob, Billable: true, Minutes: 45},
+	{Date: "2016-01-15", User: alice, Billable: false, Minutes: 15},
+	{Date: "2016-09-30", User: alice, Billable: true, Minutes: 240},
+}
+
+func periodLabels(pps []ParticipantsPeriod) []string {
+	var labels []string
+	for _, pp := range pps {
+		labels = append(labels, pp.TimeAgg.GetString(pp.Period))
+	}
+	return labels
+}
+
+func TestGetParticipantsPeriodPerMonthIsSorted(t *testing.T) {
+	expected := []string{"2016-01", "2016-02", "2016-05", "2016-07", "2016-09", "2016-11"}
+	// The map iteration order is random, repeat to make an unsorted result likely to show up
+	for i := 0; i < 20; i++ {
+		pps, err := GetParticipantsPeriodPerMonth(shuffledEntries)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, periodLabels(pps))
+	}
+}
+
+func TestGetProjectKpiPerMonthIsSorted(t *testing.T) {
+	project := ProjectKpi{
+		Project: freckle.Project{
+			Name: "foo project",
+		},
+		Invoices: []Invoice{
+			{InvoiceDate: "2016-12-01", TotalAmount: 100},
+			{InvoiceDate: "2016-03-01", TotalAmount: 200},
+			{InvoiceDate: "2016-07-31", TotalAmount: 300},
+		},
+		DetailedEntries: shuffledEntries,
+	}
+	expected := []string{"2016-01", "2016-02", "2016-03", "2016-05", "2016-07", "2016-09", "2016-11", "2016-12"}
+	for i := 0; i < 20; i++ {
+		ppks, err := GetProjectKpiPerMonth(project)
+		assert.NoError(t, err)
+		var labels []string
+		for _, ppk := range ppks {
+			labels = append(labels, ppk.Label())
+		}
+		assert.Equal(t, expected, labels)
+	}
+}
+
+func TestGetProjectKpiPerMonthUniquePeriods(t *testing.T) {
+	project := ProjectKpi{
+		Project: freckle.Project{
+			Name: "foo project",
+		},
+		Invoices: []Invoice{
+			// invoice only
+			{InvoiceDate: "2016-01-15", TotalAmount: 100},
+			// both sources, with two invoices
+			{InvoiceDate: "2016-03-01", TotalAmount: 200},
+			{InvoiceDate: "2016-03-31", TotalAmount: 300},
+		},
+		DetailedEntries: []freckle.Entry{
+			// entry only
+			{Date: "2016-02-10", User: alice, Billable: true, Minutes: 60},
+			// both sources
+			{Date: "2016-03-10", User: bob, Billable: true, Minutes: 30},
+			{Date: "2016-03-20", User: alice, Billable: true, Minutes: 90},
+		},
+		Expenses: []Expense{{Date: "2016-03-05", Amount: 50}},
+	}
+
+	ppks, err := GetProjectKpiPerMonth(project)
+	assert.NoError(t, err)
+	var labels []string
+	for _, ppk := range ppks {
+		labels = append(labels, ppk.Label())
+	}
+	// Each period appears exactly once and in order
+	assert.Equal(t, []string{"2016-01", "2016-02", "2016-03"}, labels)
+
+	assert.Len(t, ppks[0].Invoices, 1)
+	assert.Empty(t, ppks[0].Participants)
+	assert.Empty(t, ppks[1].Invoices)
+	assert.Len(t, ppks[1].Participants, 1)
+	// The sources of a period don't overwrite each other
+	assert.Len(t, ppks[2].Invoices, 1)
+	assert.Len(t, ppks[2].Participants, 2)
+	assert.Len(t, ppks[2].Expenses, 1)
+	assert.Equal(t, "2016-03 $500.00 invoiced ($0.00 paid, $500.00 outstanding), $50.00 spent, rate: 250.00$/h (+$500.00 vs 2016-02, hours +100%)", ppks[2].String())
+}
+
+func TestFormattedAgg(t *testing.T) {
+	d := time.Date(2016, time.June, 12, 0, 0, 0, 0, time.UTC)
+	for layout, label := range map[string]string{"Jan 2006": "Jun 2016", "January 2006": "June 2016", "012006": "062016", "2006-01-02": "2016-06-01"} {
+		m, err := NewFormattedAgg(MonthAgg{}, layout)
+		assert.NoError(t, err, layout)
+		assert.Equal(t, label, m.GetString(d))
+		p, err := m.Parse(label)
+		assert.NoError(t, err)
+		assert.Equal(t, m.GetPeriod(d), p)
+		// The keys are the ones of the wrapped TimeAggregater
+		key, _ := m.GetInt(d)
+		assert.Equal(t, 201606, key)
+	}
+
+	y, err := NewFormattedAgg(YearAgg{}, "FY2006")
+	assert.NoError(t, err)
+	assert.Equal(t, "FY2016", y.GetString(d))
+
+	// The layouts which don't identify the periods fail fast
+	for _, layout := range []string{"Jan", "2006", "Jna 2006", "foo"} {
+		_, err = NewFormattedAgg(MonthAgg{}, layout)
+		assert.Error(t, err, layout)
+	}
+}
+
+func TestSanitizeMetricName(t *testing.T) {
+	assert.Equal(t, "foo-bar-baz-qux", SanitizeMetricName("foo bar/baz\\qux"))
+	assert.Equal(t, "Project-42-beta", SanitizeMetricName("Project #42 (beta)"))
+}
+
+func TestTimeAggregaters(t *testing.T) {
+	d := time.Date(2016, 11, 28, 15, 4, 5, 0, time.UTC)
+
+	m := MonthAgg{}
+	i, err := m.GetInt(d)
+	assert.NoError(t, err)
+	assert.Equal(t, 201611, i)
+	assert.Equal(t, "2016-11", m.GetString(d))
+	assert.Equal(t, time.Date(2016, 11, 1, 0, 0, 0, 0, time.UTC), m.GetPeriod(d))
+	assert.Equal(t, time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC), m.Next(d))
+	assert.Equal(t, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), m.Next(m.Next(d)))
+	p, err := m.Parse("2016-11")
+	assert.NoError(t, err)
+	assert.Equal(t, m.GetPeriod(d), p)
+	_, err = m.Parse("2016")
+	assert.Error(t, err)
+
+	y := YearAgg{}
+	i, err = y.GetInt(d)
+	assert.NoError(t, err)
+	assert.Equal(t, 2016, i)
+	assert.Equal(t, "2016", y.GetString(d))
+	assert.Equal(t, time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), y.GetPeriod(d))
+	assert.Equal(t, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), y.Next(d))
+	p, err = y.Parse("2016")
+	assert.NoError(t, err)
+	assert.Equal(t, y.GetPeriod(d), p)
+	_, err = y.Parse("2016-11")
+	assert.Error(t, err)
+}
+
+func TestGetParticipantKpis(t *testing.T) {
+	pks := GetParticipantKpis(shuffledEntries)
+	assert.Len(t, pks, 2)
+	// Sorted by descending total time
+	assert.Equal(t, alice.Id, pks[0].Id)
+	assert.Equal(t, 390, pks[0].BillableMinutes)
+	assert.Equal(t, 15, pks[0].UnbillableMinutes)
+	assert.Equal(t, 4, pks[0].EntryCount)
+	assert.Equal(t, 101.25, pks[0].AverageEntryMinutes())
+	assert.Equal(t, bob.Id, pks[1].Id)
+	assert.Equal(t, 165, pks[1].BillableMinutes)
+	assert.Equal(t, 30, pks[1].UnbillableMinutes)
+	assert.Equal(t, 3, pks[1].EntryCount)
+	assert.Equal(t, 65.0, pks[1].AverageEntryMinutes())
+
+	// The participants with the same total time are ordered by email, then ID
+	carol := freckle.Participant{Id: 3, Email: "carol@example.com"}
+	pks = GetParticipantKpis([]freckle.Entry{
+		{User: bob, Minutes: 30}, {User: carol, Minutes: 30}, {User: alice, Minutes: 30},
+	})
+	assert.Equal(t, []int{alice.Id, bob.Id, carol.Id}, []int{pks[0].Id, pks[1].Id, pks[2].Id})
+
+	// ParticipantKpis keeps sorting by ascending time, so the callers reversing it still get the descending order
+	pks = ParticipantKpis{{Participant: alice, BillableMinutes: 10}, {Participant: bob, BillableMinutes: 30}, {Participant: carol, BillableMinutes: 20}}
+	sort.Sort(sort.Reverse(pks))
+	assert.Equal(t, []int{bob.Id, carol.Id, alice.Id}, []int{pks[0].Id, pks[1].Id, pks[2].Id})
+
+	// A participant without entries, e.g. after a filter, has no average
+	assert.Equal(t, 0.0, ParticipantKpi{Participant: alice}.AverageEntryMinutes())
+}
+
+func TestGetParticipantsPeriodPerMonthEntryCount(t *testing.T) {
+	pps, err := GetParticipantsPeriodPerMonth(append(shuffledEntries, freckle.Entry{Date: "2016-07-20", User: alice, Billable: true, Minutes: 30}))
+	assert.NoError(t, err)
+	july := pps[3]
+	assert.Equal(t, "2016-07", july.TimeAgg.GetString(july.Period))
+	assert.Equal(t, "Alice Smith Billable : 1.5h - Unbillable : 0.0h - Entries : 2 (45min avg)", july.Participants[0].String())
+	assert.Equal(t, "Bob Jones Billable : 0.8h - Unbillable : 0.0h - Entries : 1 (45min avg)", july.Participants[1].String())
+}
+
+func TestDurationHistogram(t *testing.T) {
+	h := DurationHistogram(append(shuffledEntries,
+		freckle.Entry{Date: "2016-07-20", User: alice, Billable: false, Minutes: 5},
+		freckle.Entry{Date: "2016-07-21", User: bob, Billable: true, Minutes: 0},
+		freckle.Entry{Date: "2016-07-22", User: bob, Billable: false, Minutes: 300},
+	), DefaultHistogramBounds)
+
+	var buckets []string
+	for _, b := range h.Buckets {
+		buckets = append(buckets, b.String())
+	}
+	assert.Equal(t, []string{
+		"le15m : 2 (Billable : 0 - Unbillable : 2)",
+		"15m-30m : 1 (Billable : 0 - Unbillable : 1)",
+		"30m-1h : 2 (Billable : 2 - Unbillable : 0)",
+		"1h-2h : 2 (Billable : 2 - Unbillable : 0)",
+		"2h-4h : 1 (Billable : 1 - Unbillable : 0)",
+		"gt4h : 1 (Billable : 0 - Unbillable : 1)",
+	}, buckets)
+	assert.Equal(t, HistogramBucket{Label: InvalidBucket, Billable: 1}, h.Invalid)
+
+	h = DurationHistogram(shuffledEntries, []int{45})
+	assert.Equal(t, "le45m", h.Buckets[0].Label)
+	assert.Equal(t, 3, h.Buckets[0].Count())
+	assert.Equal(t, "gt45m", h.Buckets[1].Label)
+	assert.Equal(t, 4, h.Buckets[1].Count())
+}
+
+func TestWeekdayKpi(t *testing.T) {
+	paris := time.FixedZone("CET", 3600)
+	w, err := GetWeekdayKpi([]freckle.Entry{
+		{Date: "2016-03-04", Billable: true, Minutes: 60},
+		{Date: "2016-03-05", Billable: false, Minutes: 30},
+		// Sunday late evening in UTC is Monday in Paris
+		{Date: "2016-03-06T23:30:00Z", Billable: true, Minutes: 45},
+	}, paris)
+	assert.NoError(t, err)
+	assert.Equal(t, 60, w.BillableMinutes[time.Friday])
+	assert.Equal(t, 30, w.UnbillableMinutes[time.Saturday], "the weekend is kept apart")
+	assert.Equal(t, 45, w.BillableMinutes[time.Monday])
+	assert.Equal(t, 0, w.BillableMinutes[time.Sunday])
+	assert.Equal(t, "Saturday  Billable : 0.0h - Unbillable : 0.5h", w.DayString(time.Saturday, DefaultFormatter))
+
+	w, err = GetWeekdayKpi([]freckle.Entry{{Date: "2016-03-06T23:30:00Z", Minutes: 45}}, time.UTC)
+	assert.NoError(t, err)
+	assert.Equal(t, 45, w.UnbillableMinutes[time.Sunday])
+
+	_, err = GetWeekdayKpi([]freckle.Entry{{Date: "06/03/2016"}}, time.UTC)
+	assert.Error(t, err)
+}
+
+func TestCapacity(t *testing.T) {
+	minutes, err := ParseCapacity("37h30m")
+	assert.NoError(t, err)
+	assert.Equal(t, 2250.0, minutes)
+	_, err = ParseCapacity("-1h")
+	assert.Error(t, err)
+
+	c := Capacity{Minutes: 600, Overrides: map[string]float64{"alice@example.com": 300}}
+	u, ok := c.GetUtilization(ParticipantKpi{Participant: alice, BillableMinutes: 240, UnbillableMinutes: 90}, 1)
+	assert.True(t, ok)
+	assert.InDelta(t, 110, u.Total, 1e-9)
+	assert.InDelta(t, 80, u.Billable, 1e-9)
+	assert.Equal(t, "Utilization : 110% (billable 80%)", u.String())
+	u, _ = c.GetUtilization(ParticipantKpi{Participant: bob, BillableMinutes: 600}, 2)
+	assert.Equal(t, Utilization{Total: 50, Billable: 50}, u)
+	_, ok = Capacity{}.GetUtilization(ParticipantKpi{Participant: bob, BillableMinutes: 600}, 1)
+	assert.False(t, ok)
+
+	year := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	present := MonthSet(0).Add(time.January).Add(time.March).Add(time.March)
+	assert.Equal(t, 2, present.Len())
+	assert.Equal(t, 12, PeriodMonths(YearAgg{}, year, present, false))
+	assert.Equal(t, 2, PeriodMonths(YearAgg{}, year, present, true))
+	assert.Equal(t, 12, PeriodMonths(YearAgg{}, year, 0, true))
+	assert.Equal(t, 1, PeriodMonths(MonthAgg{}, year, present, false))
+}
+
+func TestSortProjectKpisKeys(t *testing.T) {
+	project := func(id int, name string, billable, unbillable int, invoiced float64) ProjectKpi {
+		var invoices []Invoice
+		if invoiced > 0 {
+			invoices = []Invoice{{TotalAmount: invoiced}}
+		}
+		return ProjectKpi{Project: freckle.Project{Id: id, Name: name, BillableMinutes: billable, UnbillableMinutes: unbillable}, Invoices: invoices}
+	}
+	cases := []struct {
+		key  string
+		desc bool
+		want string
+	}{
+		{"name", false, "abcde"},
+		{"name", true, "edcba"},
+		{"invoiced", false, "debac"},
+		{"invoiced", true, "acbde"},
+		{"billable", false, "becda"},
+		{"billable", true, "acdbe"},
+		{"unbillable", false, "eadbc"},
+		{"unbillable", true, "bcade"},
+		// b and e have no billable hours, they come last in both orders
+		{"rate", false, "dacbe"},
+		{"rate", true, "cadbe"},
+	}
+	for _, c := range cases {
+		projects := []ProjectKpi{
+			project(5, "e", 0, 0, 0),
+			project(3, "c", 60, 30, 100),
+			project(1, "a", 120, 10, 100),
+			project(4, "d", 60, 10, 0),
+			project(2, "b", 0, 30, 10),
+		}
+		SortProjectKpis(projects, c.key, c.desc)
+		var names string
+		for _, p := range projects {
+			names += p.Name
+		}
+		assert.Equal(t, c.want, names, "%+v", c)
+	}
+
+	// The projects with the same name are ordered by ID whatever their initial order
+	for _, desc := range []bool{false, true} {
+		projects := []ProjectKpi{project(2, "a", 60, 0, 0), project(1, "a", 60, 0, 0)}
+		SortProjectKpis(projects, "billable", desc)
+		assert.Equal(t, []int{1, 2}, []int{projects[0].Id, projects[1].Id})
+	}
+}
+
+func TestParticipantKpisSplit(t *testing.T) {
+	pks := GetParticipantKpis(shuffledEntries)
+
+	top, others := pks.Split(0)
+	assert.Len(t, top, 2)
+	assert.Len(t, others, 0)
+
+	top, others = pks.Split(1)
+	assert.Len(t, top, 1)
+	assert.Len(t, others, 1)
+	assert.Equal(t, "…and 1 others: 2.8h billable / 0.5h unbillable", others.OthersString(DefaultFormatter))
+
+	// N covering all the participants leaves no others
+	for _, n := range []int{2, 5} {
+		top, others = pks.Split(n)
+		assert.Equal(t, pks, top)
+		assert.Len(t, others, 0)
+	}
+}
+
+func TestParticipantKpiDisplayName(t *testing.T) {
+	assert.Equal(t, "Alice Smith", ParticipantKpi{Participant: alice}.DisplayName())
+	assert.Equal(t, "Dave", ParticipantKpi{Participant: freckle.Participant{Id: 4, FirstName: "  Dave ", LastName: " "}}.DisplayName())
+	assert.Equal(t, "contractor", ParticipantKpi{Participant: freckle.Participant{Id: 5, Email: "contractor@example.com"}}.DisplayName())
+	assert.Equal(t, "contractor", ParticipantKpi{Participant: freckle.Participant{Id: 5, FirstName: " ", LastName: "\t", Email: "contractor@example.com"}}.DisplayName())
+	assert.Equal(t, "6", ParticipantKpi{Participant: freckle.Participant{Id: 6}}.DisplayName())
+
+	p := ParticipantKpi{Participant: freckle.Participant{Id: 5, Email: "contractor@example.com"}, BillableMinutes: 90}
+	assert.Equal(t, "contractor Billable : 1.5h - Unbillable : 0.0h - Entries : 0 (0min avg)", p.String())
+}
+
+func TestGetInvoiceKpiPerMonth(t *testing.T) {
+	iks, err := GetInvoiceKpiPerMonth([]Invoice{
+		{InvoiceDate: "2016-03-21", TotalAmount: 1500, State: "paid"},
+		{InvoiceDate: "2016-01-10", TotalAmount: 100},
+		{InvoiceDate: "2016-03-01", TotalAmount: 2700.5, State: "unpaid"},
+		{InvoiceDate: "2016-03-08", TotalAmount: 800, State: "cancelled"},
+		{InvoiceDate: "2016-05-02", TotalAmount: 300, State: "rejected"},
+	}, InvoiceOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, iks, 2)
+	assert.Equal(t, "2016-01 $100.00 invoiced ($0.00 paid, $100.00 outstanding)", iks[0].String())
+	assert.Equal(t, "2016-03 $4,200.50 invoiced ($1,500.00 paid, $2,700.50 outstanding)", iks[1].String())
+
+	_, err = GetInvoiceKpiPerMonth([]Invoice{{InvoiceDate: "03/21/2016"}}, InvoiceOptions{})
+	assert.Error(t, err)
+}
+
+func TestProjectKpiInvoiceStates(t *testing.T) {
+	project := ProjectKpi{
+		Project: freckle.Project{
+			Name: "foo project",
+		},
+		Invoices: []Invoice{
+			{InvoiceDate: "2016-01-15", TotalAmount: 100, State: "Paid"},
+			{InvoiceDate: "2016-02-15", TotalAmount: 40, State: "awaiting_payment"},
+			{InvoiceDate: "2016-03-15", TotalAmount: 500, State: "cancelled"},
+			{InvoiceDate: "2016-04-15", TotalAmount: 60, State: "rejected"},
+		},
+	}
+	assert.Equal(t, 140.0, project.GetInvoicedTotal())
+	assert.Equal(t, Amounts{"USD": 140}, project.GetInvoicedTotalPerCurrency())
+	assert.Equal(t, Amounts{"USD": 100}, project.GetPaidTotalPerCurrency())
+	assert.Equal(t, Amounts{"USD": 40}, project.GetOutstandingTotalPerCurrency())
+	assert.Equal(t, 2, project.ExcludedInvoices())
+
+	states, err := ParseInvoiceStates("PAID, rejected")
+	assert.NoError(t, err)
+	project.InvoiceOptions.CountedStates = states
+	assert.Equal(t, 160.0, project.GetInvoicedTotal())
+	assert.Equal(t, Amounts{"USD": 60}, project.GetOutstandingTotalPerCurrency())
+	assert.Equal(t, 2, project.ExcludedInvoices())
+	iks, err := GetInvoiceKpiPerMonth(project.Invoices, project.InvoiceOptions)
+	assert.NoError(t, err)
+	assert.Len(t, iks, 2)
+
+	// The paid invoices are left out of the paid amounts too when only the unpaid ones are counted
+	project.InvoiceOptions.CountedStates, err = ParseInvoiceStates("unpaid,awaiting_payment")
+	assert.NoError(t, err)
+	assert.Equal(t, Amounts{"USD": 40}, project.GetInvoicedTotalPerCurrency())
+	assert.Equal(t, Amounts{}, project.GetPaidTotalPerCurrency())
+	assert.Equal(t, Amounts{"USD": 40}, project.GetOutstandingTotalPerCurrency())
+
+	// The invoices without currency are in the currency of the options
+	project.InvoiceOptions.Currency = "EUR"
+	assert.Equal(t, Amounts{"EUR": 40}, project.GetInvoicedTotalPerCurrency())
+
+	_, err = ParseInvoiceStates("paid,")
+	assert.Error(t, err)
+	_, err = ParseInvoiceStates("paid,paied")
+	assert.EqualError(t, err, `"paied" is not an invoice state, the states are : draft, unpaid, awaiting_payment, paid, rejected, cancelled, canceled`)
+}
+
+func TestFillInvoiceKpiGaps(t *testing.T) {
+	iks, err := GetInvoiceKpiPerMonth([]Invoice{
+		{InvoiceDate: "2016-11-21", TotalAmount: 10},
+		{InvoiceDate: "2017-02-10", TotalAmount: 20},
+	}, InvoiceOptions{})
+	assert.NoError(t, err)
+	filled := FillInvoiceKpiGaps(MonthAgg{}, iks, "")
+	var labels []string
+	for _, ik := range filled {
+		labels = append(labels, ik.String())
+	}
+	assert.Equal(t, []string{
+		"2016-11 $10.00 invoiced ($0.00 paid, $10.00 outstanding)",
+		"2016-12 $0.00 invoiced",
+		"2017-01 $0.00 invoiced",
+		"2017-02 $20.00 invoiced ($0.00 paid, $20.00 outstanding)",
+	}, labels)
+
+	// The gaps are in the currency of the invoices without currency
+	filled = FillInvoiceKpiGaps(MonthAgg{}, iks, "EUR")
+	assert.Equal(t, "EUR", filled[1].Currency)
+}
+
+func TestAmounts(t *testing.T) {
+	assert.Equal(t, "$0.00", DefaultFormatter.FormatAmounts(Amounts{}))
+	assert.Equal(t, "€4,200.00 + $1,500.00", DefaultFormatter.FormatAmounts(Amounts{"USD": 1500, "EUR": 4200}))
+	assert.Equal(t, "CHF 1,234,567.89", DefaultFormatter.FormatAmounts(Amounts{"CHF": 1234567.891}))
+	assert.Equal(t, "50.00$/h", DefaultFormatter.FormatRates(Amounts{"USD": 100}, 2))
+	assert.Equal(t, "0.00€/h", Formatter{Currency: "EUR", AmountPrecision: 2}.FormatRates(Amounts{}, 2))
+	assert.Equal(t, "n/a", DefaultFormatter.FormatRates(Amounts{"USD": 100}, 0))
+	assert.Equal(t, "n/a", DefaultFormatter.FormatRates(Amounts{}, 0))
+}
+
+func TestGetProjectKpiPerPeriodDateBases(t *testing.T) {
+	project := ProjectKpi{
+		Project: freckle.Project{Name: "foo project"},
+		DetailedEntries: []freckle.Entry{
+			{Date: "2016-01-04", User: alice, Billable: true, Minutes: 60, InvoicedAt: "2016-03-01T10:00:00Z"},
+			{Date: "2016-01-20", User: bob, Billable: true, Minutes: 30, InvoicedAt: "2016-01-31"},
+			{Date: "2016-02-04", User: alice, Billable: true, Minutes: 90},
+		},
+	}
+	periods := func(basis DateBasis) []string {
+		ppks, err := GetProjectKpiPerPeriod(MonthAgg{}, PeriodOptions{DateBasis: basis}, project)
+		assert.NoError(t, err)
+		var periods []string
+		for _, ppm := range ppks {
+			billable, _ := ppm.GetMinutes()
+			periods = append(periods, fmt.Sprintf("%s:%d", ppm.Label(), billable))
+		}
+		return periods
+	}
+
+	// The uninvoiced entry is in the period it was worked in
+	assert.Equal(t, []string{"2016-01:90", "2016-02:90"}, periods(DateBasisWorked))
+	// The invoiced entries move to the period they were invoiced in, the others to the uninvoiced period printed last
+	assert.Equal(t, []string{"2016-01:30", "2016-03:60", "uninvoiced:90"}, periods(DateBasisInvoiced))
+}
+
+func TestPeriodTrendZeroPreviousAndGaps(t *testing.T) {
+	project := ProjectKpi{
+		Project: freckle.Project{
+			Name: "foo project",
+		},
+		Invoices: []Invoice{
+			{InvoiceDate: "2016-01-15", TotalAmount: 100, State: "paid"},
+			{InvoiceDate: "2016-03-15", TotalAmount: 50, State: "paid"},
+		},
+		DetailedEntries: []freckle.Entry{
+			{Date: "2016-02-04", User: alice, Billable: true, Minutes: 60},
+			{Date: "2016-03-04", User: alice, Billable: true, Minutes: 60},
+			{Date: "2016-05-04", User: alice, Billable: true, Minutes: 30},
+		},
+	}
+	ppks, err := GetProjectKpiPerPeriod(MonthAgg{}, PeriodOptions{DateBasis: DateBasisWorked}, project)
+	assert.NoError(t, err)
+	if !assert.Len(t, ppks, 4) {
+		return
+	}
+
+	// The first period has nothing to be compared to
+	assert.Nil(t, ppks[0].Trend)
+	// January has no hours, the change of the hours has no percentage
+	assert.Equal(t, &PeriodTrend{
+		Previous: "2016-01",
+		Invoiced: map[string]Delta{"USD": {Absolute: -100, Percent: -100, HasPercent: true}},
+		Minutes:  Delta{Absolute: 60},
+	}, ppks[1].Trend)
+	// February has no invoices, the change of the invoiced amount has no percentage
+	assert.Equal(t, &PeriodTrend{
+		Previous: "2016-02",
+		Invoiced: map[string]Delta{"USD": {Absolute: 50}},
+		Minutes:  Delta{Absolute: 0, Percent: 0, HasPercent: true},
+	}, ppks[2].Trend)
+	assert.Equal(t, "+$50.00 vs 2016-02, hours +0%", ppks[2].Trend.String())
+	// May follows the April gap
+	assert.Equal(t, "2016-05", ppks[3].Label())
+	assert.Nil(t, ppks[3].Trend)
+}
+
+func TestGetProjectKpiPerPeriodTrendAndGaps(t *testing.T) {
+	project := ProjectKpi{
+		Project: freckle.Project{
+			Name: "foo project",
+		},
+		Invoices: []Invoice{
+			{InvoiceDate: "2016-01-15", TotalAmount: 100, State: "paid"},
+			{InvoiceDate: "2016-02-15", TotalAmount: 112, State: "paid"},
+			{InvoiceDate: "2016-04-15", TotalAmount: 50},
+		},
+		DetailedEntries: []freckle.Entry{
+			{Date: "2016-01-04", User: alice, Billable: true, Minutes: 60},
+			{Date: "2016-02-04", User: alice, Billable: true, Minutes: 90},
+		},
+	}
+
+	ppks, err := GetProjectKpiPerPeriod(MonthAgg{}, PeriodOptions{DateBasis: DateBasisWorked}, project)
+	assert.NoError(t, err)
+	assert.Len(t, ppks, 3)
+	assert.Equal(t, "2016-01 $100.00 invoiced ($100.00 paid, $0.00 outstanding), rate: 100.00$/h", ppks[0].String())
+	assert.Equal(t, "2016-02 $112.00 invoiced ($112.00 paid, $0.00 outstanding), rate: 74.67$/h (+12% vs 2016-01, hours +50%)", ppks[1].String())
+	// April follows a gap, it isn't compared to February
+	assert.Equal(t, "2016-04 $50.00 invoiced ($0.00 paid, $50.00 outstanding), rate: n/a", ppks[2].String())
+
+	ppks, err = GetProjectKpiPerPeriod(MonthAgg{}, PeriodOptions{DateBasis: DateBasisWorked, FillGaps: true}, project)
+	assert.NoError(t, err)
+	assert.Len(t, ppks, 4)
+	assert.Equal(t, "2016-03 $0.00 invoiced, rate: n/a (-100% vs 2016-02, hours -100%)", ppks[2].String())
+	assert.Equal(t, "2016-04 $50.00 invoiced ($0.00 paid, $50.00 outstanding), rate: n/a (+$50.00 vs 2016-03, hours +0.0h)", ppks[3].String())
+}
+
+func TestGetProjectKpiPerPeriodInvoicedBasis(t *testing.T) {
+	project := ProjectKpi{
+		Project: freckle.Project{Name: "foo project"},
+		DetailedEntries: []freckle.Entry{
+			{Date: "2016-01-04", User: alice, Minutes: 60, InvoicedAt: "2016-03-01T10:00:00Z"},
+			{Date: "2016-02-04", User: alice, Minutes: 90},
+		},
+	}
+	ppks, err := GetProjectKpiPerPeriod(MonthAgg{}, PeriodOptions{DateBasis: DateBasisInvoiced}, project)
+	assert.NoError(t, err)
+	assert.Len(t, ppks, 2)
+	assert.Equal(t, "2016-03", ppks[0].Label())
+	assert.Equal(t, 60, ppks[0].Participants[0].UnbillableMinutes)
+	assert.Equal(t, "uninvoiced", ppks[1].Label())
+	assert.Equal(t, 90, ppks[1].Participants[0].UnbillableMinutes)
+}
+
+func TestSortProjectKpis(t *testing.T) {
+	projects := []ProjectKpi{
+		{Project: freckle.Project{Name: "b", BillableMinutes: 0}, Invoices: []Invoice{{TotalAmount: 10}}},
+		{Project: freckle.Project{Name: "c", BillableMinutes: 60}, Invoices: []Invoice{{TotalAmount: 100}}},
+		{Project: freckle.Project{Name: "a", BillableMinutes: 120}, Invoices: []Invoice{{TotalAmount: 100}}},
+	}
+	names := func() string {
+		var s string
+		for _, p := range projects {
+			s += p.Name
+		}
+		return s
+	}
+
+	assert.True(t, IsValidSortKey("rate"))
+	assert.False(t, IsValidSortKey("foo"))
+
+	SortProjectKpis(projects, "name", false)
+	assert.Equal(t, "abc", names())
+	// Ties are broken by name
+	SortProjectKpis(projects, "invoiced", true)
+	assert.Equal(t, "acb", names())
+	// Projects without billable hours come last
+	SortProjectKpis(projects, "rate", true)
+	assert.Equal(t, "cab", names())
+	SortProjectKpis(projects, "rate", false)
+	assert.Equal(t, "acb", names())
+}
+
+func TestSortProjectKpisCurrency(t *testing.T) {
+	options := InvoiceOptions{Currency: "EUR"}
+	projects := []ProjectKpi{
+		{Project: freckle.Project{Name: "a", BillableMinutes: 60}, InvoiceOptions: options, Invoices: []Invoice{{TotalAmount: 1000, Currency: "JPY"}, {TotalAmount: 10}}},
+		{Project: freckle.Project{Name: "b", BillableMinutes: 60}, InvoiceOptions: options, Invoices: []Invoice{{TotalAmount: 100, Currency: "eur"}}},
+	}
+	assert.Equal(t, 10.0, projects[0].GetInvoicedTotalInCurrency())
+
+	// The amounts in the other currencies are not added to the EUR ones
+	for _, key := range []string{"invoiced", "rate"} {
+		SortProjectKpis(projects, key, true)
+		assert.Equal(t, "b", projects[0].Name, key)
+	}
+}
+
+func TestGetClientKpis(t *testing.T) {
+	projects := []ProjectKpi{
+		{
+			Project: freckle.Project{
+				Name: "Acme Web", Group: freckle.ProjectGroup{Name: "Acme"},
+				BillableMinutes: 120, InvoicedMinutes: 60,
+			},
+			Invoices:        []Invoice{{TotalAmount: 100}},
+			DetailedEntries: []freckle.Entry{{User: alice, Billable: true, Minutes: 120}},
+		},
+		{
+			Project: freckle.Project{Name: "Acme Mobile", BillableMinutes: 30, UnbillableMinutes: 15},
+			DetailedEntries: []freckle.Entry{
+				{User: alice, Billable: true, Minutes: 30},
+				{User: bob, Minutes: 15},
+			},
+		},
+		{Project: freckle.Project{Name: "Side project", UnbillableMinutes: 45}},
+	}
+
+	participants := make(map[int]ParticipantKpis)
+	for i := range projects {
+		projects[i].Id = i + 1
+		participants[projects[i].Id] = GetParticipantKpis(projects[i].DetailedEntries)
+	}
+
+	clients := GetClientKpis(projects, participants, map[string]string{"Acme Mobile": "Acme"})
+	assert.Len(t, clients, 2)
+	assert.Equal(t, "Acme (2 projects) total invoiced : $100.00, 1.0h - Billable : 2.5h - Unbillable : 0.2h", clients[0].String())
+	assert.Len(t, clients[0].Participants, 2)
+	assert.Equal(t, alice.Id, clients[0].Participants[0].Id)
+	assert.Equal(t, 150, clients[0].Participants[0].BillableMinutes)
+	// The projects without client are kept so the totals reconcile
+	assert.Equal(t, UnassignedClient, clients[1].Name)
+	assert.Equal(t, 45, clients[1].UnbillableMinutes)
+}
+
+func TestEntryAggregator(t *testing.T) {
+	from := time.Date(2016, 7, 1, 0, 0, 0, 0, time.UTC)
+	agg := NewEntryAggregator(AggregateOptions{TimeAgg: MonthAgg{}, From: from, HistogramBounds: DefaultHistogramBounds})
+	for _, entry := range shuffledEntries {
+		agg.Add(entry)
+	}
+	a := agg.Aggregates()
+
+	// A single pass matches the aggregation of the filtered entries
+	filtered, err := FilterProjectKpiFrom(ProjectKpi{DetailedEntries: shuffledEntries}, from)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, a.EntryCount)
+	assert.Equal(t, filtered.BillableMinutes, a.BillableMinutes)
+	assert.Equal(t, filtered.UnbillableMinutes, a.UnbillableMinutes)
+	assert.Equal(t, filtered.InvoicedMinutes, a.InvoicedMinutes)
+	assert.Equal(t, GetParticipantKpis(filtered.DetailedEntries), a.Participants)
+	pps, err := GetParticipantsPeriodPerMonth(filtered.DetailedEntries)
+	assert.NoError(t, err)
+	assert.Equal(t, pps, a.Periods)
+	assert.Equal(t, DurationHistogram(filtered.DetailedEntries, DefaultHistogramBounds), *a.Histogram)
+	// The entries are dropped unless they are kept on demand
+	assert.Nil(t, a.Entries)
+
+	agg = NewEntryAggregator(AggregateOptions{KeepEntries: true})
+	agg.Add(shuffledEntries[0])
+	a = agg.Aggregates()
+	assert.Equal(t, shuffledEntries[:1], a.Entries)
+	assert.Nil(t, a.Periods)
+	assert.Nil(t, a.Histogram)
+
+	// The entries with an unparsable date are skipped, the timestamps are parsed
+	agg = NewEntryAggregator(AggregateOptions{TimeAgg: MonthAgg{}, DateBasis: DateBasisInvoiced, From: from})
+	invalid := freckle.Entry{Date: "07/12/2016", User: alice, Minutes: 60}
+	invalidInvoicedAt := freckle.Entry{Date: "2016-07-12", InvoicedAt: "12/08/2016", User: alice, Minutes: 60}
+	agg.Add(invalid)
+	agg.Add(invalidInvoicedAt)
+	agg.Add(freckle.Entry{Date: "2016-07-12T09:30:00Z", InvoicedAt: "2016-08-01T10:00:00", User: alice, Minutes: 30})
+	a = agg.Aggregates()
+	assert.Equal(t, 1, a.EntryCount)
+	assert.Equal(t, 30, a.UnbillableMinutes)
+	if assert.Len(t, a.Skipped, 2) {
+		assert.Equal(t, invalid, a.Skipped[0].Entry)
+		assert.EqualError(t, a.Skipped[0].Err, `"07/12/2016" is not a date`)
+		assert.Equal(t, invalidInvoicedAt, a.Skipped[1].Entry)
+	}
+	if assert.Len(t, a.Periods, 1) {
+		assert.Equal(t, time.Date(2016, 8, 1, 0, 0, 0, 0, time.UTC), a.Periods[0].Period)
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	for _, value := range []string{"2016-07-12", "2016-07-12T09:30:00Z", "2016-07-12T09:30:00+02:00", "2016-07-12T09:30:00"} {
+		d, err := ParseDate(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, "2016-07-12", formatDay(d), value)
+	}
+	_, err := ParseDate("")
+	assert.Error(t, err)
+
+	dated, undated := SplitDatedInvoices([]Invoice{{Id: 1, InvoiceDate: "2016-07-12"}, {Id: 2}, {Id: 3, InvoiceDate: "2016-07-12T09:30:00Z"}})
+	assert.Equal(t, []Invoice{{Id: 1, InvoiceDate: "2016-07-12"}, {Id: 3, InvoiceDate: "2016-07-12T09:30:00Z"}}, dated)
+	assert.Equal(t, []Invoice{{Id: 2}}, undated)
+}
+
+func TestParticipantKpisBuilderMerge(t *testing.T) {
+	b := NewParticipantKpisBuilder()
+	b.Merge(GetParticipantKpis(shuffledEntries[:3]))
+	b.Merge(GetParticipantKpis(shuffledEntries[3:]))
+	assert.Equal(t, GetParticipantKpis(shuffledEntries), b.ParticipantKpis())
+}
+
+func TestFormatDuration(t *testing.T) {
+	assert.Equal(t, "37.5h", DefaultFormatter.FormatDuration(2250))
+	hhmm := Formatter{Durations: DurationHHMM}
+	assert.Equal(t, "37:30", hhmm.FormatDuration(2250))
+	assert.Equal(t, "-0:45", hhmm.FormatDuration(-45))
+	assert.Equal(t, "+1:05", hhmm.formatDurationChange(65))
+	minutes := Formatter{Durations: DurationMinutes}
+	assert.Equal(t, "2250min", minutes.FormatDuration(2250))
+
+	// The whole report switches consistently, String keeps the DefaultFormatter
+	p := ParticipantKpi{Participant: alice, BillableMinutes: 90, UnbillableMinutes: 30, EntryCount: 2}
+	assert.Equal(t, "Alice Smith Billable : 90min - Unbillable : 30min - Entries : 2 (60min avg)", p.Format(minutes))
+	precise := Formatter{Durations: DurationHours, HoursPrecision: 2, AmountPrecision: 0}
+	assert.Equal(t, "Alice Smith Billable : 1.50h - Unbillable : 0.50h - Entries : 2 (60min avg)", p.Format(precise))
+	assert.Equal(t, "€5 + $1,234", precise.FormatAmounts(Amounts{"USD": 1234.4, "EUR": 5}))
+	assert.Equal(t, "Alice Smith Billable : 1.5h - Unbillable : 0.5h - Entries : 2 (60min avg)", p.String())
+	assert.Equal(t, "€5.00 + $1,234.40", DefaultFormatter.FormatAmounts(Amounts{"USD": 1234.4, "EUR": 5}))
+	assert.Equal(t, "50$/h", precise.FormatRates(Amounts{"USD": 100}, 2))
+}
@@ -0,0 +1,104 @@
+package libratoexport
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DuplicatePolicy selects the value kept when gauges share their name and source with differing values.
+type DuplicatePolicy string
+
+const (
+	// DuplicateMax keeps the largest value.
+	DuplicateMax DuplicatePolicy = "max"
+	// DuplicateSum keeps the sum of the differing values.
+	DuplicateSum DuplicatePolicy = "sum"
+)
+
+// IsValidDuplicatePolicy reports whether policy is a known DuplicatePolicy.
+func IsValidDuplicatePolicy(policy DuplicatePolicy) bool {
+	switch policy {
+	case DuplicateMax, DuplicateSum:
+		return true
+	}
+	return false
+}
+
+// Conflict represents gauges sharing their name and source with differing values,
+// librato would only keep the last one posted. The source is the one posted, qualified by the account
+// and sanitized, see Gauge.AccountSource and SanitizeSource.
+type Conflict struct {
+	Name   string
+	Source string
+	// Values are the differing values, in the order they were registered
+	Values []float64
+	Kept   float64
+}
+
+func (c Conflict) String() string {
+	values := make([]string, len(c.Values))
+	for i, v := range c.Values {
+		values[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%s (source %s) registered with the values %s, %s kept",
+		c.Name, c.Source, strings.Join(values, ", "), strconv.FormatFloat(c.Kept, 'f', -1, 64))
+}
+
+// gaugeKey identifies a gauge in librato, by its name and the source posted by MetricsSink.
+type gaugeKey struct {
+	name, source string
+}
+
+func newGaugeKey(g Gauge) gaugeKey {
+	return gaugeKey{g.Name, SanitizeSource(g.AccountSource())}
+}
+
+// Deduplicate collapses the gauges sharing their name and posted source, e.g. two projects whose names
+// are sanitized to the same metric name or two sources which only differ by the characters SanitizeSource replaces. Identical values collapse silently, differing values are
+// resolved by the policy and reported as a Conflict. The gauges keep the order they were registered in.
+func Deduplicate(gauges []Gauge, policy DuplicatePolicy) ([]Gauge, []Conflict) {
+	var deduplicated []Gauge
+	var conflicts []Conflict
+	index := make(map[gaugeKey]int)
+	values := make(map[gaugeKey][]float64)
+	for _, g := range gauges {
+		key := newGaugeKey(g)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(deduplicated)
+			values[key] = []float64{g.Value}
+			deduplicated = append(deduplicated, g)
+			continue
+		}
+		if containsValue(values[key], g.Value) {
+			continue
+		}
+		values[key] = append(values[key], g.Value)
+		switch policy {
+		case DuplicateSum:
+			deduplicated[i].Value += g.Value
+		default:
+			if g.Value > deduplicated[i].Value {
+				deduplicated[i].Value = g.Value
+			}
+		}
+	}
+
+	for _, g := range deduplicated {
+		key := newGaugeKey(g)
+		if len(values[key]) > 1 {
+			conflicts = append(conflicts, Conflict{Name: g.Name, Source: key.source, Values: values[key], Kept: g.Value})
+		}
+	}
+	return deduplicated, conflicts
+}
+
+func containsValue(values []float64, value float64) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package libratoexport
+
+import (
+	"testing"
+
+	"github.com/gertv/go-freckle"
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+func TestDeduplicateProjectRegisteredTwice(t *testing.T) {
+	project := kpi.ProjectKpi{Project: freckle.Project{Name: "foo project", BillableMinutes: 120, UnbillableMinutes: 30}}
+	m := &RecordingSink{}
+	RegisterProjectKpi(m, project)
+	RegisterProjectKpi(m, project)
+
+	gauges, conflicts := Deduplicate(m.Gauges, DuplicateMax)
+	assert.Len(t, gauges, len(m.Gauges)/2)
+	assert.Empty(t, conflicts)
+	assert.Equal(t, "FreckleAPI.projects.UnbillableMinutes", gauges[0].Name)
+	assert.Equal(t, 30.0, gauges[0].Value)
+}
+
+func TestDeduplicateSanitizationCollision(t *testing.T) {
+	m := &RecordingSink{}
+	RegisterProjectKpi(m, kpi.ProjectKpi{Project: freckle.Project{Name: "foo/bar", BillableMinutes: 120, UnbillableMinutes: 30}})
+	RegisterProjectKpi(m, kpi.ProjectKpi{Project: freckle.Project{Name: "foo bar", BillableMinutes: 60, UnbillableMinutes: 30}})
+
+	gauges, conflicts := Deduplicate(m.Gauges, DuplicateMax)
+	assert.Len(t, gauges, len(m.Gauges)/2)
+	assert.Equal(t, []Conflict{{Name: "FreckleAPI.projects.BillableMinutes", Source: "foo-bar", Values: []float64{120, 60}, Kept: 120}}, conflicts)
+	assert.Equal(t, "FreckleAPI.projects.BillableMinutes (source foo-bar) registered with the values 120, 60, 120 kept", conflicts[0].String())
+
+	gauges, conflicts = Deduplicate(m.Gauges, DuplicateSum)
+	assert.Len(t, conflicts, 1)
+	assert.Equal(t, 180.0, conflicts[0].Kept)
+	for _, g := range gauges {
+		if g.Name == "FreckleAPI.projects.BillableMinutes" {
+			assert.Equal(t, 180.0, g.Value)
+		}
+	}
+}
+
+func TestDeduplicateSourceSanitizationCollision(t *testing.T) {
+	// The sources only collide once sanitized by the MetricsSink, the other accounts keep their series
+	gauges := []Gauge{
+		{Name: "FreckleAPI.monthlyParticipants.BillableMinutes.foo", Source: "Jun 2016", Value: 60},
+		{Name: "FreckleAPI.monthlyParticipants.BillableMinutes.foo", Source: "Jun-2016", Value: 90},
+		{Name: "FreckleAPI.monthlyParticipants.BillableMinutes.foo", Source: "Jun 2016", Account: "acme", Value: 30},
+	}
+	deduplicated, conflicts := Deduplicate(gauges, DuplicateMax)
+	assert.Len(t, deduplicated, 2)
+	assert.Equal(t, []Conflict{{Name: "FreckleAPI.monthlyParticipants.BillableMinutes.foo", Source: "Jun-2016", Values: []float64{60, 90}, Kept: 90}}, conflicts)
+	assert.Equal(t, 30.0, deduplicated[1].Value)
+}
@@ -0,0 +1,97 @@
+package libratoexport
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Labels of a Description.
+const (
+	LabelProject     = "project"
+	LabelClient      = "client"
+	LabelParticipant = "participant"
+	LabelPeriod      = "period"
+	LabelCurrency    = "currency"
+	LabelBucket      = "bucket"
+	LabelWeekday     = "weekday"
+	LabelAccount     = "account"
+)
+
+// Description identifies a gauge registered by the Register functions by its category, its metric
+// and the labels the name and the source are made of, e.g. for the sinks without sources.
+// The labels are the raw values, e.g. the project name and the participant email rather than their sanitized form.
+type Description struct {
+	Category string
+	Metric   string
+	Labels   map[string]string
+}
+
+// SnakeMetric returns the metric in snake case, e.g. billable_minutes for BillableMinutes.
+func (d Description) SnakeMetric() string {
+	var b strings.Builder
+	for i, r := range d.Metric {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// categoryLabels are the labels of the gauges of each category.
+var categoryLabels = map[string][]string{
+	CatProjects:            {LabelProject},
+	CatClients:             {LabelClient},
+	CatParticipants:        {LabelProject, LabelParticipant},
+	CatYearlyParticipants:  {LabelProject, LabelPeriod},
+	CatMonthlyParticipants: {LabelProject, LabelPeriod},
+	CatTrend:               {LabelProject, LabelPeriod},
+	CatUtilization:         {LabelParticipant, LabelPeriod},
+	CatRun:                 nil,
+}
+
+// currencyMetrics are the metrics labeled with the currency.
+var currencyMetrics = map[string]bool{
+	"InvoicedAmount":              true,
+	"PaidAmount":                  true,
+	"OutstandingAmount":           true,
+	"ExpensesAmount":              true,
+	"RealizedHourlyRate":          true,
+	"InvoicedAmountChange":        true,
+	"InvoicedAmountChangePercent": true,
+}
+
+// Describe returns the category and the metric parsed from the name of a gauge registered by the Register functions,
+// and its Labels. The labels are never parsed back from the name and the source, which are sanitized.
+func Describe(g Gauge) (Description, error) {
+	parts := strings.SplitN(g.Name, ".", 4)
+	if len(parts) < 3 || parts[0] != BaseName {
+		return Description{}, fmt.Errorf("%s is not a %s gauge", g.Name, BaseName)
+	}
+	d := Description{Category: parts[1], Metric: parts[2], Labels: make(map[string]string)}
+	required, ok := categoryLabels[d.Category]
+	if !ok {
+		return Description{}, fmt.Errorf("%s has an unknown category", g.Name)
+	}
+	if currencyMetrics[d.Metric] {
+		required = append(required[:len(required):len(required)], LabelCurrency)
+	}
+
+	for label, value := range g.Labels {
+		d.Labels[label] = value
+	}
+	if g.Account != "" {
+		d.Labels[LabelAccount] = g.Account
+	}
+
+	for _, label := range required {
+		if d.Labels[label] == "" {
+			return Description{}, fmt.Errorf("%s has no %s", g.Name, label)
+		}
+	}
+	return d, nil
+}
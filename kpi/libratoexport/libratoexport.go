@@ -0,0 +1,385 @@
+// Package libratoexport registers the KPIs computed by the kpi package as gauges in a Sink, e.g. the librato metrics.
+package libratoexport
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gertv/go-freckle"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// Metric name components, the gauges are named <BaseName>.<category>.<metric>
+const (
+	BaseName               = "FreckleAPI"
+	CatProjects            = "projects"
+	CatClients             = "clients"
+	CatParticipants        = "participants"
+	CatYearlyParticipants  = "yearlyParticipants"
+	CatMonthlyParticipants = "monthlyParticipants"
+	CatTrend               = "trend"
+	CatRun                 = "run"
+	CatUtilization         = "utilization"
+)
+
+// currencyName returns the name of the gauge of an amount in the currency. The currency is appended to the name
+// so the amounts in different currencies are never mixed, but for the default currency of the invoices without
+// currency so the series registered before the amounts were split per currency keep their name.
+func currencyName(name, currency, defaultCurrency string) string {
+	if currency == kpi.CurrencyOrDefault(defaultCurrency) {
+		return name
+	}
+	return name + "." + currency
+}
+
+// withLabel returns a copy of the labels with the label set to value, e.g. the currency of an amount.
+func withLabel(labels map[string]string, label, value string) map[string]string {
+	copied := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		copied[k] = v
+	}
+	copied[label] = value
+	return copied
+}
+
+// RegisterParticipantKpi registers participant metrics and update their value, the participant is identified by its name in names
+func RegisterParticipantKpi(s Sink, names ParticipantNames, p kpi.ParticipantKpi, prefix, source string) {
+	labels := map[string]string{LabelProject: source, LabelParticipant: names.Label(p.Participant)}
+	source = kpi.SanitizeMetricName(source)
+	name := names.Name(p.Participant)
+
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.UnbillableMinutes.%s", prefix, name),
+		Source: source,
+		Value:  float64(p.UnbillableMinutes),
+		Labels: labels,
+	})
+
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.BillableMinutes.%s", prefix, name),
+		Source: source,
+		Value:  float64(p.BillableMinutes),
+		Labels: labels,
+	})
+
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.EntryCount.%s", prefix, name),
+		Source: source,
+		Value:  float64(p.EntryCount),
+		Labels: labels,
+	})
+}
+
+// RegisterProjectKpi registers project metrics and set their value
+func RegisterProjectKpi(s Sink, pi kpi.ProjectKpi) {
+	prjName := kpi.SanitizeMetricName(pi.Name)
+	labels := map[string]string{LabelProject: pi.Name}
+
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.%s.UnbillableMinutes", BaseName, CatProjects),
+		Source: prjName,
+		Value:  float64(pi.UnbillableMinutes),
+		Labels: labels,
+	})
+
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.%s.BillableMinutes", BaseName, CatProjects),
+		Source: prjName,
+		Value:  float64(pi.BillableMinutes),
+		Labels: labels,
+	})
+
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.%s.InvoicedMinutes", BaseName, CatProjects),
+		Source: prjName,
+		Value:  float64(pi.InvoicedMinutes),
+		Labels: labels,
+	})
+
+	invoiced := pi.GetInvoicedTotalPerCurrency()
+	if len(invoiced) == 0 {
+		invoiced[kpi.CurrencyOrDefault(pi.InvoiceOptions.Currency)] = 0
+	}
+	for _, currency := range invoiced.Currencies() {
+		s.AddGauge(Gauge{
+			Name:   currencyName(fmt.Sprintf("%s.%s.InvoicedAmount", BaseName, CatProjects), currency, pi.InvoiceOptions.Currency),
+			Source: prjName,
+			Value:  invoiced[currency],
+			Labels: withLabel(labels, LabelCurrency, currency),
+		})
+	}
+
+	// The paid and outstanding amounts are registered for each invoiced currency, the outstanding ones chart the accounts receivable
+	paid, outstanding := pi.GetPaidTotalPerCurrency(), pi.GetOutstandingTotalPerCurrency()
+	for _, currency := range invoiced.Currencies() {
+		s.AddGauge(Gauge{
+			Name:   currencyName(fmt.Sprintf("%s.%s.PaidAmount", BaseName, CatProjects), currency, pi.InvoiceOptions.Currency),
+			Source: prjName,
+			Value:  paid[currency],
+			Labels: withLabel(labels, LabelCurrency, currency),
+		})
+		s.AddGauge(Gauge{
+			Name:   currencyName(fmt.Sprintf("%s.%s.OutstandingAmount", BaseName, CatProjects), currency, pi.InvoiceOptions.Currency),
+			Source: prjName,
+			Value:  outstanding[currency],
+			Labels: withLabel(labels, LabelCurrency, currency),
+		})
+	}
+
+	expenses := pi.GetExpensesTotalPerCurrency()
+	if len(expenses) == 0 {
+		expenses[kpi.CurrencyOrDefault(pi.InvoiceOptions.Currency)] = 0
+	}
+	for _, currency := range expenses.Currencies() {
+		s.AddGauge(Gauge{
+			Name:   currencyName(fmt.Sprintf("%s.%s.ExpensesAmount", BaseName, CatProjects), currency, pi.InvoiceOptions.Currency),
+			Source: prjName,
+			Value:  expenses[currency],
+			Labels: withLabel(labels, LabelCurrency, currency),
+		})
+	}
+}
+
+// RegisterHistogram registers the number of entries of each bucket of the histogram of the project, including the invalid one
+func RegisterHistogram(s Sink, project string, h kpi.Histogram) {
+	prjName := kpi.SanitizeMetricName(project)
+	labels := map[string]string{LabelProject: project}
+	for _, b := range append(h.Buckets, h.Invalid) {
+		s.AddGauge(Gauge{
+			Name:   fmt.Sprintf("%s.%s.EntryDuration.%s", BaseName, CatProjects, b.Label),
+			Source: prjName,
+			Value:  float64(b.Count()),
+			Labels: withLabel(labels, LabelBucket, b.Label),
+		})
+	}
+}
+
+// RegisterWeekdays registers the billable and unbillable minutes of the project per day of the week, named after the day
+func RegisterWeekdays(s Sink, project string, w kpi.WeekdayKpi) {
+	prjName := kpi.SanitizeMetricName(project)
+	for _, day := range kpi.Weekdays {
+		labels := map[string]string{LabelProject: project, LabelWeekday: day.String()}
+		s.AddGauge(Gauge{
+			Name:   fmt.Sprintf("%s.%s.WeekdayBillableMinutes.%s", BaseName, CatProjects, day),
+			Source: prjName,
+			Value:  float64(w.BillableMinutes[day]),
+			Labels: labels,
+		})
+		s.AddGauge(Gauge{
+			Name:   fmt.Sprintf("%s.%s.WeekdayUnbillableMinutes.%s", BaseName, CatProjects, day),
+			Source: prjName,
+			Value:  float64(w.UnbillableMinutes[day]),
+			Labels: labels,
+		})
+	}
+}
+
+// RegisterUtilization registers the utilization of the participant during the period, in percent of its capacity
+func RegisterUtilization(s Sink, names ParticipantNames, p freckle.Participant, up kpi.UtilizationPeriod, u kpi.Utilization) {
+	name := names.Name(p)
+	labels := map[string]string{LabelParticipant: names.Label(p), LabelPeriod: up.Label()}
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.%s.Utilization.%s", BaseName, CatUtilization, name),
+		Source: up.Label(),
+		Period: up.TimeAgg.GetPeriod(up.Period),
+		Value:  u.Total,
+		Labels: labels,
+	})
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.%s.BillableUtilization.%s", BaseName, CatUtilization, name),
+		Source: up.Label(),
+		Period: up.TimeAgg.GetPeriod(up.Period),
+		Value:  u.Billable,
+		Labels: labels,
+	})
+}
+
+// periodStart returns the start of the period of the ProjectPeriodKpi, zero for the uninvoiced entries.
+func periodStart(pp kpi.ProjectPeriodKpi) time.Time {
+	if pp.Uninvoiced {
+		return time.Time{}
+	}
+	return pp.TimeAgg.GetPeriod(pp.Period)
+}
+
+// periodLabels returns the labels of the gauges of the period of the project.
+func periodLabels(pp kpi.ProjectPeriodKpi) map[string]string {
+	return map[string]string{LabelProject: pp.Name, LabelPeriod: pp.Label()}
+}
+
+// RegisterProjectPeriodKpi registers project period metrics and update their value
+func RegisterProjectPeriodKpi(s Sink, pp kpi.ProjectPeriodKpi, prefix string) {
+	prjName := kpi.SanitizeMetricName(pp.Name)
+	source := pp.Label()
+	period := periodStart(pp)
+	labels := periodLabels(pp)
+
+	invoiced := pp.GetInvoicedAmounts()
+	if len(invoiced) == 0 {
+		invoiced[kpi.CurrencyOrDefault(pp.DefaultCurrency)] = 0
+	}
+	for _, currency := range invoiced.Currencies() {
+		s.AddGauge(Gauge{
+			Name:   currencyName(fmt.Sprintf("%s.InvoicedAmount.%s", prefix, prjName), currency, pp.DefaultCurrency),
+			Source: source,
+			Period: period,
+			Value:  invoiced[currency],
+			Labels: withLabel(labels, LabelCurrency, currency),
+		})
+	}
+
+	paid, outstanding := pp.GetPaidAmounts(), pp.GetOutstandingAmounts()
+	for _, currency := range invoiced.Currencies() {
+		s.AddGauge(Gauge{
+			Name:   currencyName(fmt.Sprintf("%s.PaidAmount.%s", prefix, prjName), currency, pp.DefaultCurrency),
+			Source: source,
+			Period: period,
+			Value:  paid[currency],
+			Labels: withLabel(labels, LabelCurrency, currency),
+		})
+		s.AddGauge(Gauge{
+			Name:   currencyName(fmt.Sprintf("%s.OutstandingAmount.%s", prefix, prjName), currency, pp.DefaultCurrency),
+			Source: source,
+			Period: period,
+			Value:  outstanding[currency],
+			Labels: withLabel(labels, LabelCurrency, currency),
+		})
+	}
+
+	billableMin, unbillableMin := pp.GetMinutes()
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.UnbillableMinutes.%s", prefix, prjName),
+		Source: source,
+		Period: period,
+		Value:  float64(unbillableMin),
+		Labels: labels,
+	})
+
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.BillableMinutes.%s", prefix, prjName),
+		Source: source,
+		Period: period,
+		Value:  float64(billableMin),
+		Labels: labels,
+	})
+
+	RegisterProjectPeriodRate(s, pp, prefix)
+}
+
+// RegisterProjectPeriodRate registers the realized hourly rate of the period,
+// nothing is registered for the periods without billable hours
+func RegisterProjectPeriodRate(s Sink, pp kpi.ProjectPeriodKpi, prefix string) {
+	rates, ok := pp.GetRealizedHourlyRate()
+	if !ok {
+		return
+	}
+	if len(rates) == 0 {
+		rates[kpi.CurrencyOrDefault(pp.DefaultCurrency)] = 0
+	}
+	prjName := kpi.SanitizeMetricName(pp.Name)
+	for _, currency := range rates.Currencies() {
+		s.AddGauge(Gauge{
+			Name:   currencyName(fmt.Sprintf("%s.RealizedHourlyRate.%s", prefix, prjName), currency, pp.DefaultCurrency),
+			Source: pp.Label(),
+			Period: periodStart(pp),
+			Value:  rates[currency],
+			Labels: withLabel(periodLabels(pp), LabelCurrency, currency),
+		})
+	}
+}
+
+// RegisterProjectPeriodTrend registers the change versus the previous period, nothing is registered without a Trend
+func RegisterProjectPeriodTrend(s Sink, pp kpi.ProjectPeriodKpi, prefix string) {
+	if pp.Trend == nil {
+		return
+	}
+	prjName := kpi.SanitizeMetricName(pp.Name)
+	source := pp.Label()
+	period := periodStart(pp)
+	labels := periodLabels(pp)
+
+	for _, currency := range pp.Trend.Currencies() {
+		d := pp.Trend.Invoiced[currency]
+		s.AddGauge(Gauge{
+			Name:   currencyName(fmt.Sprintf("%s.InvoicedAmountChange.%s", prefix, prjName), currency, pp.DefaultCurrency),
+			Source: source,
+			Period: period,
+			Value:  d.Absolute,
+			Labels: withLabel(labels, LabelCurrency, currency),
+		})
+		if d.HasPercent {
+			s.AddGauge(Gauge{
+				Name:   currencyName(fmt.Sprintf("%s.InvoicedAmountChangePercent.%s", prefix, prjName), currency, pp.DefaultCurrency),
+				Source: source,
+				Period: period,
+				Value:  d.Percent,
+				Labels: withLabel(labels, LabelCurrency, currency),
+			})
+		}
+	}
+
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.MinutesChange.%s", prefix, prjName),
+		Source: source,
+		Period: period,
+		Value:  pp.Trend.Minutes.Absolute,
+		Labels: labels,
+	})
+	if pp.Trend.Minutes.HasPercent {
+		s.AddGauge(Gauge{
+			Name:   fmt.Sprintf("%s.MinutesChangePercent.%s", prefix, prjName),
+			Source: source,
+			Period: period,
+			Value:  pp.Trend.Minutes.Percent,
+			Labels: labels,
+		})
+	}
+}
+
+// RegisterFailedProjects registers the number of projects which couldn't be fetched, the gauge has no source
+func RegisterFailedProjects(s Sink, failed int) {
+	s.AddGauge(Gauge{
+		Name:  fmt.Sprintf("%s.%s.FailedProjects", BaseName, CatRun),
+		Value: float64(failed),
+	})
+}
+
+// RegisterClientKpi registers the client metrics, the sanitized client name is the source
+func RegisterClientKpi(s Sink, c kpi.ClientKpi) {
+	clientName := kpi.SanitizeMetricName(c.Name)
+	labels := map[string]string{LabelClient: c.Name}
+
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.%s.UnbillableMinutes", BaseName, CatClients),
+		Source: clientName,
+		Value:  float64(c.UnbillableMinutes),
+		Labels: labels,
+	})
+
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.%s.BillableMinutes", BaseName, CatClients),
+		Source: clientName,
+		Value:  float64(c.BillableMinutes),
+		Labels: labels,
+	})
+
+	s.AddGauge(Gauge{
+		Name:   fmt.Sprintf("%s.%s.InvoicedMinutes", BaseName, CatClients),
+		Source: clientName,
+		Value:  float64(c.InvoicedMinutes),
+		Labels: labels,
+	})
+
+	invoiced := c.Invoiced
+	if len(invoiced) == 0 {
+		invoiced = kpi.Amounts{kpi.CurrencyOrDefault(c.DefaultCurrency): 0}
+	}
+	for _, currency := range invoiced.Currencies() {
+		s.AddGauge(Gauge{
+			Name:   currencyName(fmt.Sprintf("%s.%s.InvoicedAmount", BaseName, CatClients), currency, c.DefaultCurrency),
+			Source: clientName,
+			Value:  invoiced[currency],
+			Labels: withLabel(labels, LabelCurrency, currency),
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package libratoexport
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gertv/go-freckle"
+	"github.com/samuel/go-librato/librato"
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+func gaugeNames(s *RecordingSink) map[string]Gauge {
+	gauges := make(map[string]Gauge)
+	for _, gauge := range s.Gauges {
+		gauges[gauge.Name] = gauge
+	}
+	return gauges
+}
+
+func TestRegisterProjectKpi(t *testing.T) {
+	m := &RecordingSink{}
+	RegisterProjectKpi(m, kpi.ProjectKpi{
+		Project: freckle.Project{
+			Name:              "foo project (beta)",
+			BillableMinutes:   120,
+			UnbillableMinutes: 30,
+		},
+		Invoices: []kpi.Invoice{
+			{TotalAmount: 100, State: "paid"},
+			{TotalAmount: 50, State: "unpaid"},
+			{TotalAmount: 70, State: "cancelled"},
+		},
+		Expenses: []kpi.Expense{{Amount: 20}, {Amount: 5.5}},
+	})
+
+	gauges := gaugeNames(m)
+	assert.Len(t, gauges, 7)
+	assert.Equal(t, "foo-project-beta", gauges["FreckleAPI.projects.BillableMinutes"].Source)
+	assert.Equal(t, 120.0, gauges["FreckleAPI.projects.BillableMinutes"].Value)
+	assert.Equal(t, 30.0, gauges["FreckleAPI.projects.UnbillableMinutes"].Value)
+	assert.Equal(t, 150.0, gauges["FreckleAPI.projects.InvoicedAmount"].Value)
+	assert.Equal(t, 100.0, gauges["FreckleAPI.projects.PaidAmount"].Value)
+	assert.Equal(t, 50.0, gauges["FreckleAPI.projects.OutstandingAmount"].Value)
+	assert.Equal(t, 25.5, gauges["FreckleAPI.projects.ExpensesAmount"].Value)
+}
+
+func TestRegisterProjectPeriodKpi(t *testing.T) {
+	m := &RecordingSink{}
+	RegisterProjectPeriodKpi(m, kpi.ProjectPeriodKpi{
+		Name:    "foo project",
+		TimeAgg: kpi.YearAgg{},
+		Period:  time.Date(2016, time.July, 1, 0, 0, 0, 0, time.UTC),
+		Participants: []kpi.ParticipantKpi{
+			{BillableMinutes: 60, UnbillableMinutes: 15},
+			{BillableMinutes: 30},
+		},
+	}, "FreckleAPI.yearlyParticipants")
+
+	gauges := gaugeNames(m)
+	assert.Len(t, gauges, 6)
+	assert.Equal(t, 0.0, gauges["FreckleAPI.yearlyParticipants.RealizedHourlyRate.foo-project"].Value)
+	assert.Equal(t, 90.0, gauges["FreckleAPI.yearlyParticipants.BillableMinutes.foo-project"].Value)
+	assert.Equal(t, 15.0, gauges["FreckleAPI.yearlyParticipants.UnbillableMinutes.foo-project"].Value)
+	assert.Equal(t, 0.0, gauges["FreckleAPI.yearlyParticipants.InvoicedAmount.foo-project"].Value)
+	assert.Equal(t, 0.0, gauges["FreckleAPI.yearlyParticipants.OutstandingAmount.foo-project"].Value)
+	assert.Equal(t, "2016", gauges["FreckleAPI.yearlyParticipants.BillableMinutes.foo-project"].Source)
+	assert.Equal(t, time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC), gauges["FreckleAPI.yearlyParticipants.BillableMinutes.foo-project"].Period)
+}
+
+func TestRegisterProjectPeriodRate(t *testing.T) {
+	pp := kpi.ProjectPeriodKpi{
+		Name:         "foo project",
+		TimeAgg:      kpi.MonthAgg{},
+		Period:       time.Date(2016, time.July, 1, 0, 0, 0, 0, time.UTC),
+		Invoices:     []kpi.InvoicePeriodKpi{{Currency: "USD", Amount: 300}},
+		Participants: []kpi.ParticipantKpi{{BillableMinutes: 90, UnbillableMinutes: 60}, {BillableMinutes: 30}},
+	}
+	m := &RecordingSink{}
+	RegisterProjectPeriodRate(m, pp, "FreckleAPI.monthlyParticipants")
+	assert.Equal(t, []Gauge{{
+		Name:   "FreckleAPI.monthlyParticipants.RealizedHourlyRate.foo-project",
+		Source: "2016-07",
+		Value:  150,
+		Period: time.Date(2016, time.July, 1, 0, 0, 0, 0, time.UTC),
+		Labels: map[string]string{"project": "foo project", "period": "2016-07", "currency": "USD"},
+	}}, m.Gauges)
+
+	// A retainer invoiced in a month without billable hours has no rate
+	pp.Participants = []kpi.ParticipantKpi{{UnbillableMinutes: 60}}
+	m = &RecordingSink{}
+	RegisterProjectPeriodRate(m, pp, "FreckleAPI.monthlyParticipants")
+	assert.Empty(t, m.Gauges)
+	assert.Equal(t, "2016-07 $300.00 invoiced, rate: n/a", pp.String())
+}
+
+func TestRegisterHistogram(t *testing.T) {
+	h := kpi.DurationHistogram([]freckle.Entry{{Minutes: 10}, {Minutes: 90, Billable: true}, {Minutes: 0}}, []int{60})
+	m := &RecordingSink{}
+	RegisterHistogram(m, "foo project", h)
+	gauges := gaugeNames(m)
+	assert.Len(t, gauges, 3)
+	assert.Equal(t, 1.0, gauges["FreckleAPI.projects.EntryDuration.le1h"].Value)
+	assert.Equal(t, 1.0, gauges["FreckleAPI.projects.EntryDuration.gt1h"].Value)
+	assert.Equal(t, 1.0, gauges["FreckleAPI.projects.EntryDuration.invalid"].Value)
+	assert.Equal(t, "foo-project", gauges["FreckleAPI.projects.EntryDuration.invalid"].Source)
+}
+
+func TestRegisterWeekdays(t *testing.T) {
+	w := kpi.WeekdayKpi{}
+	w.BillableMinutes[time.Monday] = 120
+	w.UnbillableMinutes[time.Sunday] = 30
+	m := &RecordingSink{}
+	RegisterWeekdays(m, "foo project", w)
+	gauges := gaugeNames(m)
+	assert.Len(t, gauges, 14)
+	assert.Equal(t, 120.0, gauges["FreckleAPI.projects.WeekdayBillableMinutes.Monday"].Value)
+	assert.Equal(t, 30.0, gauges["FreckleAPI.projects.WeekdayUnbillableMinutes.Sunday"].Value)
+	assert.Equal(t, "foo-project", gauges["FreckleAPI.projects.WeekdayBillableMinutes.Saturday"].Source)
+}
+
+func TestMetricsSink(t *testing.T) {
+	m := &librato.Metrics{}
+	s := &MetricsSink{Metrics: m, Oldest: time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)}
+	s.AddGauge(Gauge{Name: "FreckleAPI.projects.BillableMinutes", Source: "foo", Value: 120})
+	s.AddGauge(Gauge{Name: "FreckleAPI.yearlyParticipants.BillableMinutes.foo", Source: "2016", Value: 60,
+		Period: time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)})
+	s.AddGauge(Gauge{Name: "FreckleAPI.yearlyParticipants.BillableMinutes.foo", Source: "2015", Value: 30,
+		Period: time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)})
+	assert.Equal(t, []interface{}{
+		librato.Gauge{Name: "FreckleAPI.projects.BillableMinutes", Source: "foo", Count: 1, Sum: 120},
+		librato.Gauge{Name: "FreckleAPI.yearlyParticipants.BillableMinutes.foo", Source: "2016", MeasureTime: 1451606400, Count: 1, Sum: 60},
+	}, m.Gauges)
+	assert.Len(t, s.Skipped, 1)
+	assert.Equal(t, "2015", s.Skipped[0].Source)
+
+	// The sources are sanitized for librato, e.g. a period labeled with -period-format
+	m.Gauges = nil
+	s.AddGauge(Gauge{Name: "FreckleAPI.projects.BillableMinutes", Source: "June 2016 (Q2)", Value: 120})
+	assert.Equal(t, "June-2016-Q2-", m.Gauges[0].(librato.Gauge).Source)
+}
+
+func TestNewParticipantNames(t *testing.T) {
+	participants := []freckle.Participant{
+		{Id: 1, FirstName: "Alice", LastName: "Smith", Email: "alice@example.com"},
+		{Id: 2, FirstName: "Bob", LastName: "Jones", Email: "bob+work@example.com"},
+		{Id: 3, FirstName: "Bob", LastName: "Jones", Email: "bob@other.com"},
+		{Id: 4, FirstName: "Carol", LastName: "White"},
+	}
+
+	names := NewParticipantNames(ParticipantKeyEmail, participants)
+	assert.Equal(t, "alice", names[1])
+	assert.Equal(t, "bob-work", names[2])
+	assert.Equal(t, "bob", names[3])
+	assert.Equal(t, "4", names[4])
+
+	names = NewParticipantNames(ParticipantKeyName, participants)
+	assert.Equal(t, "Alice-Smith", names[1])
+	assert.Equal(t, "Bob-Jones-2", names[2])
+	assert.Equal(t, "Bob-Jones-3", names[3])
+
+	m := &RecordingSink{}
+	RegisterParticipantKpi(m, names, kpi.ParticipantKpi{Participant: participants[2], BillableMinutes: 60, EntryCount: 2}, "FreckleAPI.participants", "foo")
+	assert.Equal(t, 60.0, gaugeNames(m)["FreckleAPI.participants.BillableMinutes.Bob-Jones-3"].Value)
+	assert.Equal(t, map[string]string{"project": "foo", "participant": "bob@other.com"}, gaugeNames(m)["FreckleAPI.participants.BillableMinutes.Bob-Jones-3"].Labels)
+	assert.Equal(t, 2.0, gaugeNames(m)["FreckleAPI.participants.EntryCount.Bob-Jones-3"].Value)
+}
+
+func TestNewParticipantNamesWithoutNames(t *testing.T) {
+	participants := []freckle.Participant{
+		{Id: 5, Email: "contractor@example.com"},
+		{Id: 6, FirstName: " ", LastName: " ", Email: "contractor@other.com"},
+		{Id: 7},
+	}
+
+	names := NewParticipantNames(ParticipantKeyName, participants)
+	assert.Equal(t, "contractor-5", names[5])
+	assert.Equal(t, "contractor-6", names[6])
+	assert.Equal(t, "7", names[7])
+}
+
+func TestDescribe(t *testing.T) {
+	for _, tc := range []struct {
+		gauge    Gauge
+		category string
+		metric   string
+		labels   map[string]string
+	}{
+		{Gauge{Name: "FreckleAPI.projects.BillableMinutes", Source: "foo", Labels: map[string]string{"project": "foo"}},
+			CatProjects, "BillableMinutes", map[string]string{"project": "foo"}},
+		{Gauge{Name: "FreckleAPI.utilization.Utilization.alice", Source: "2016-03",
+			Labels: map[string]string{"period": "2016-03", "participant": "alice@example.com"}},
+			CatUtilization, "Utilization", map[string]string{"period": "2016-03", "participant": "alice@example.com"}},
+		// The labels are the raw values, not parsed from the sanitized name and source
+		{Gauge{Name: "FreckleAPI.yearlyParticipants.InvoicedAmount.foo-v2.0.USD", Source: "2016",
+			Labels: map[string]string{"project": "foo v2.0", "period": "2016", "currency": "USD"}},
+			CatYearlyParticipants, "InvoicedAmount", map[string]string{"project": "foo v2.0", "period": "2016", "currency": "USD"}},
+		{Gauge{Name: "FreckleAPI.run.FailedProjects"},
+			CatRun, "FailedProjects", map[string]string{}},
+		{Gauge{Name: "FreckleAPI.run.FailedProjects", Account: "acme"},
+			CatRun, "FailedProjects", map[string]string{"account": "acme"}},
+	} {
+		d, err := Describe(tc.gauge)
+		assert.NoError(t, err, tc.gauge.Name)
+		assert.Equal(t, Description{Category: tc.category, Metric: tc.metric, Labels: tc.labels}, d)
+	}
+
+	for _, g := range []Gauge{
+		{Name: "Other.projects.BillableMinutes", Labels: map[string]string{"project": "foo"}},
+		{Name: "FreckleAPI.unknown.BillableMinutes", Labels: map[string]string{"project": "foo"}},
+		{Name: "FreckleAPI.participants.EntryCount", Labels: map[string]string{"project": "foo"}},
+		{Name: "FreckleAPI.monthlyParticipants.RealizedHourlyRate.foo.USD", Source: "2016-03", Labels: map[string]string{"project": "foo", "period": "2016-03"}},
+	} {
+		_, err := Describe(g)
+		assert.Error(t, err, g.Name)
+	}
+}
+
+func TestDescribeRegistered(t *testing.T) {
+	names := ParticipantNames{1: "alice"}
+	alice := freckle.Participant{Id: 1, Email: "alice@example.com"}
+	pp := kpi.ProjectPeriodKpi{
+		Name:         "Acme Web v2.0",
+		TimeAgg:      kpi.MonthAgg{},
+		Period:       time.Date(2016, time.June, 1, 0, 0, 0, 0, time.UTC),
+		Invoices:     []kpi.InvoicePeriodKpi{{Currency: "EUR", Amount: 300}},
+		Participants: []kpi.ParticipantKpi{{Participant: alice, BillableMinutes: 120}},
+	}
+	h := kpi.DurationHistogram([]freckle.Entry{{Minutes: 10}}, []int{60})
+	var w kpi.WeekdayKpi
+
+	m := &RecordingSink{}
+	RegisterProjectKpi(m, kpi.ProjectKpi{Project: freckle.Project{Name: "Acme Web v2.0"}})
+	RegisterHistogram(m, "Acme Web v2.0", h)
+	RegisterWeekdays(m, "Acme Web v2.0", w)
+	RegisterParticipantKpi(m, names, pp.Participants[0], "FreckleAPI.participants", "Acme Web v2.0")
+	RegisterProjectPeriodKpi(m, pp, "FreckleAPI.monthlyParticipants")
+	RegisterUtilization(m, names, alice, kpi.UtilizationPeriod{TimeAgg: kpi.MonthAgg{}, Period: pp.Period}, kpi.Utilization{})
+	RegisterClientKpi(m, kpi.ClientKpi{Name: "Acme Corp."})
+	RegisterFailedProjects(m, 0)
+
+	// Every registered gauge is described from its labels
+	described := make(map[string]map[string]string)
+	for _, g := range m.Gauges {
+		d, err := Describe(g)
+		if assert.NoError(t, err, g.Name) {
+			described[g.Name] = d.Labels
+		}
+	}
+	assert.Equal(t, map[string]string{"project": "Acme Web v2.0", "currency": "USD"}, described["FreckleAPI.projects.InvoicedAmount"])
+	assert.Equal(t, map[string]string{"project": "Acme Web v2.0", "bucket": "le1h"}, described["FreckleAPI.projects.EntryDuration.le1h"])
+	assert.Equal(t, map[string]string{"project": "Acme Web v2.0", "weekday": "Monday"}, described["FreckleAPI.projects.WeekdayBillableMinutes.Monday"])
+	assert.Equal(t, map[string]string{"project": "Acme Web v2.0", "participant": "alice@example.com"}, described["FreckleAPI.participants.BillableMinutes.alice"])
+	assert.Equal(t, map[string]string{"project": "Acme Web v2.0", "period": "2016-06", "currency": "EUR"},
+		described["FreckleAPI.monthlyParticipants.RealizedHourlyRate.Acme-Web-v2.0.EUR"])
+	assert.Equal(t, map[string]string{"participant": "alice@example.com", "period": "2016-06"}, described["FreckleAPI.utilization.Utilization.alice"])
+	assert.Equal(t, map[string]string{"client": "Acme Corp."}, described["FreckleAPI.clients.BillableMinutes"])
+}
+
+func TestMeasurementsSink(t *testing.T) {
+	s := &MeasurementsSink{Oldest: time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)}
+	s.AddGauge(Gauge{Name: "FreckleAPI.participants.BillableMinutes.alice", Source: "Acme-Web", Value: 120,
+		Labels: map[string]string{"project": "Acme Web", "participant": "alice+work@example.com"}})
+	s.AddGauge(Gauge{Name: "FreckleAPI.monthlyParticipants.RealizedHourlyRate.Acme-Web.USD", Source: "Jun 2016", Value: 150,
+		Period: time.Date(2016, time.June, 1, 0, 0, 0, 0, time.UTC),
+		Labels: map[string]string{"project": "Acme Web", "period": "Jun 2016", "currency": "USD"}})
+	s.AddGauge(Gauge{Name: "FreckleAPI.yearlyParticipants.BillableMinutes.Acme-Web", Source: "2015", Value: 30,
+		Period: time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC),
+		Labels: map[string]string{"project": "Acme Web", "period": "2015"}})
+	s.AddGauge(Gauge{Name: "Other.BillableMinutes", Source: "foo"})
+	// The tag values are the raw labels sanitized with SanitizeTagValue
+	assert.Equal(t, []Measurement{
+		{Name: "freckle.billable_minutes", Value: 120, Tags: map[string]string{"scope": "participants", "project": "Acme Web", "participant": "alice_work_example.com"}},
+		{Name: "freckle.realized_hourly_rate", Value: 150, Time: 1464739200,
+			Tags: map[string]string{"scope": "monthlyParticipants", "project": "Acme Web", "period": "Jun 2016", "currency": "USD"}},
+	}, s.Measurements)
+	assert.Len(t, s.Skipped, 1)
+	assert.Len(t, s.Undescribed, 1)
+}
+
+func TestSanitizeTagValue(t *testing.T) {
+	// The spaces and slashes are valid in a tag value, unlike in a source
+	assert.Equal(t, "Acme Web/Mobile", SanitizeTagValue("Acme Web/Mobile"))
+	assert.Equal(t, "alice_example.com", SanitizeTagValue("alice+@example.com"))
+	assert.Equal(t, "_", SanitizeTagValue("#"))
+	assert.Len(t, SanitizeTagValue(strings.Repeat("a", 300)), 255)
+}
@@ -0,0 +1,78 @@
+package libratoexport
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MeasurementPrefix is the prefix of the metric names of the tagged measurements.
+const MeasurementPrefix = "freckle"
+
+// TagScope is the tag of the category of the gauge, so the totals and the breakdowns of a metric are never mixed.
+const TagScope = "scope"
+
+// invalidTagValueChars matches the characters librato doesn't accept in a tag value.
+var invalidTagValueChars = regexp.MustCompile(`[^-.:_?\\/\w ]+`)
+
+// maxTagValueLength is the maximum length of a librato tag value.
+const maxTagValueLength = 255
+
+// SanitizeTagValue replaces the characters librato doesn't accept in a tag value by a `_` and truncates
+// the value to the maximum length. Unlike the metric names and the sources, the spaces and slashes are kept.
+func SanitizeTagValue(value string) string {
+	value = strings.TrimSpace(invalidTagValueChars.ReplaceAllString(value, "_"))
+	if len(value) > maxTagValueLength {
+		value = value[:maxTagValueLength]
+	}
+	if value == "" {
+		return "_"
+	}
+	return value
+}
+
+// Measurement is a measurement of the librato tagged measurements API.
+type Measurement struct {
+	Name  string            `json:"name"`
+	Value float64           `json:"value"`
+	Tags  map[string]string `json:"tags"`
+	// Time is the Unix time of the start of the period, omitted for the all-time totals which are measured when posted
+	Time int64 `json:"time,omitempty"`
+}
+
+// MeasurementsSink converts the gauges into tagged measurements: the gauges of a metric share a name like
+// freckle.billable_minutes, their project, participant, period… being tags, see Describe.
+type MeasurementsSink struct {
+	Measurements []Measurement
+	// Oldest is the oldest measure time accepted, the gauges of the older periods are skipped. Zero accepts them all.
+	Oldest time.Time
+	// Skipped holds the gauges skipped because of their measure time
+	Skipped []Gauge
+	// Undescribed holds the gauges whose name can't be described, they are not converted
+	Undescribed []Gauge
+}
+
+// AddGauge implements Sink.
+func (s *MeasurementsSink) AddGauge(g Gauge) {
+	d, err := Describe(g)
+	if err != nil {
+		s.Undescribed = append(s.Undescribed, g)
+		return
+	}
+	m := Measurement{
+		Name:  MeasurementPrefix + "." + d.SnakeMetric(),
+		Value: g.Value,
+		Tags:  map[string]string{TagScope: d.Category},
+	}
+	for label, value := range d.Labels {
+		m.Tags[label] = SanitizeTagValue(value)
+	}
+	if !g.Period.IsZero() {
+		if g.Period.Before(s.Oldest) {
+			s.Skipped = append(s.Skipped, g)
+			return
+		}
+		m.Time = g.Period.Unix()
+	}
+	s.Measurements = append(s.Measurements, m)
+}
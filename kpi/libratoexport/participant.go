@@ -0,0 +1,100 @@
+package libratoexport
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gertv/go-freckle"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// ParticipantKey selects how the participants are identified in the metric names.
+type ParticipantKey string
+
+const (
+	// ParticipantKeyName identifies the participants by their display name, it changes when they are renamed.
+	ParticipantKeyName ParticipantKey = "name"
+	// ParticipantKeyEmail identifies the participants by the local part of their email.
+	ParticipantKeyEmail ParticipantKey = "email"
+	// ParticipantKeyID identifies the participants by their freckle ID.
+	ParticipantKeyID ParticipantKey = "id"
+)
+
+// IsValidParticipantKey reports whether key is a known ParticipantKey.
+func IsValidParticipantKey(key ParticipantKey) bool {
+	switch key {
+	case ParticipantKeyName, ParticipantKeyEmail, ParticipantKeyID:
+		return true
+	}
+	return false
+}
+
+// participantIdentity returns the identity of the participant in the metric names before disambiguation.
+func participantIdentity(key ParticipantKey, p freckle.Participant) string {
+	switch key {
+	case ParticipantKeyName:
+		return kpi.SanitizeMetricName(kpi.ParticipantKpi{Participant: p}.DisplayName())
+	case ParticipantKeyEmail:
+		local := strings.SplitN(p.Email, "@", 2)[0]
+		if local != "" {
+			return strings.Replace(kpi.SanitizeMetricName(local), "+", "-", -1)
+		}
+	}
+	return strconv.Itoa(p.Id)
+}
+
+// ParticipantNames maps the participant IDs to their identity in the metric names.
+type ParticipantNames map[int]string
+
+// NewParticipantNames computes the identity of each participant according to the key.
+// Participants sharing the same identity are disambiguated with their ID so they never merge into one series.
+func NewParticipantNames(key ParticipantKey, participants []freckle.Participant) ParticipantNames {
+	ids := make(map[string]map[int]bool)
+	for _, p := range participants {
+		identity := participantIdentity(key, p)
+		if ids[identity] == nil {
+			ids[identity] = make(map[int]bool)
+		}
+		ids[identity][p.Id] = true
+	}
+
+	names := make(ParticipantNames)
+	for _, p := range participants {
+		identity := participantIdentity(key, p)
+		if len(ids[identity]) > 1 {
+			identity = fmt.Sprintf("%s-%d", identity, p.Id)
+		}
+		names[p.Id] = identity
+	}
+	return names
+}
+
+// Name returns the identity of the participant in the metric names.
+func (names ParticipantNames) Name(p freckle.Participant) string {
+	if name, ok := names[p.Id]; ok {
+		return name
+	}
+	return strconv.Itoa(p.Id)
+}
+
+// Label returns the label of the participant in the gauge Labels, its email, or its identity in the metric names without email.
+func (names ParticipantNames) Label(p freckle.Participant) string {
+	if p.Email != "" {
+		return p.Email
+	}
+	return names.Name(p)
+}
+
+// Changes returns the "old → new" lines for the participants whose identity differs from the one in previous.
+func (names ParticipantNames) Changes(previous ParticipantNames) []string {
+	var changes []string
+	for id, name := range names {
+		if old, ok := previous[id]; ok && old != name {
+			changes = append(changes, fmt.Sprintf("%s → %s", old, name))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
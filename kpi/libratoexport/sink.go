@@ -0,0 +1,116 @@
+package libratoexport
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/samuel/go-librato/librato"
+)
+
+// Gauge is a measurement registered by the Register functions.
+type Gauge struct {
+	Name   string
+	Source string
+	Value  float64
+	// Period is the start of the period the value is measured over, zero for the all-time totals
+	Period time.Time
+	// Account is the account of the measured projects when several accounts are processed, empty otherwise
+	Account string
+	// Labels are the raw values the name and the source are made of, keyed by the Label constants, e.g. the project
+	// name before it is sanitized into the source. They may be shared by the gauges of a project and must not be modified.
+	Labels map[string]string
+}
+
+// AccountSource returns the source qualified by the account, e.g. acme:Foo, so the gauges
+// of the accounts are separate series. It is the source itself without account, the account without source.
+func (g Gauge) AccountSource() string {
+	if g.Account == "" || g.Source == "" {
+		return g.Account + g.Source
+	}
+	return g.Account + ":" + g.Source
+}
+
+// Sink receives the gauges registered by the Register functions.
+type Sink interface {
+	AddGauge(g Gauge)
+}
+
+// AccountSink sets the Account of the gauges before passing them to the Sink.
+type AccountSink struct {
+	Sink
+	Account string
+}
+
+// AddGauge implements Sink.
+func (s AccountSink) AddGauge(g Gauge) {
+	g.Account = s.Account
+	s.Sink.AddGauge(g)
+}
+
+// invalidSourceChars matches the characters librato doesn't accept in a source.
+var invalidSourceChars = regexp.MustCompile(`[^-.:\w]+`)
+
+// maxSourceLength is the maximum length of a librato source.
+const maxSourceLength = 255
+
+// SanitizeSource replaces the characters librato doesn't accept in a source by a `-`, e.g. the space of a
+// period labeled `Jun 2016`, and truncates the source to the maximum length.
+func SanitizeSource(source string) string {
+	source = invalidSourceChars.ReplaceAllString(source, "-")
+	if len(source) > maxSourceLength {
+		source = source[:maxSourceLength]
+	}
+	return source
+}
+
+// validMetricName matches the metric names librato accepts.
+var validMetricName = regexp.MustCompile(`^[-.:\w]{1,255}$`)
+
+// IsValidMetricName reports whether librato accepts the metric name, e.g. a participant key with a space is refused.
+func IsValidMetricName(name string) bool {
+	return validMetricName.MatchString(name)
+}
+
+// MaxMeasureAge is the age of the oldest measure time accepted by librato, the older batches are rejected.
+const MaxMeasureAge = 365 * 24 * time.Hour
+
+// MetricsSink appends the gauges to the librato Metrics posted by the librato client.
+// The gauges of a period are measured at the start of the period so the historical periods are charted at their time,
+// the all-time totals are measured when they are posted.
+type MetricsSink struct {
+	Metrics *librato.Metrics
+	// Oldest is the oldest measure time accepted, the gauges of the older periods are skipped. Zero accepts them all.
+	Oldest time.Time
+	// Skipped holds the gauges skipped because of their measure time
+	Skipped []Gauge
+}
+
+// AddGauge implements Sink, the source is qualified by the account and sanitized with SanitizeSource.
+func (s *MetricsSink) AddGauge(g Gauge) {
+	var measureTime int64
+	if !g.Period.IsZero() {
+		if g.Period.Before(s.Oldest) {
+			s.Skipped = append(s.Skipped, g)
+			return
+		}
+		measureTime = g.Period.Unix()
+	}
+	s.Metrics.Gauges = append(s.Metrics.Gauges,
+		librato.Gauge{
+			Name:        g.Name,
+			Source:      SanitizeSource(g.AccountSource()),
+			MeasureTime: measureTime,
+			Count:       1,
+			Sum:         g.Value,
+		})
+}
+
+// RecordingSink records the gauges in memory, e.g. to stream them or to check the registered metrics.
+type RecordingSink struct {
+	Gauges []Gauge
+}
+
+// AddGauge implements Sink.
+func (s *RecordingSink) AddGauge(g Gauge) {
+	s.Gauges = append(s.Gauges, g)
+}
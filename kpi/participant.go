@@ -0,0 +1,339 @@
+package kpi
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gertv/go-freckle"
+)
+
+// ParticipantKpi represents a freckle Participant enriched with Billable and Unbillable information.
+type ParticipantKpi struct {
+	freckle.Participant
+
+	BillableMinutes   int
+	UnbillableMinutes int
+	// EntryCount is the number of entries logged by the participant
+	EntryCount int
+}
+
+// AverageEntryMinutes returns the average length of the entries of the participant, zero without entries.
+func (p ParticipantKpi) AverageEntryMinutes() float64 {
+	if p.EntryCount == 0 {
+		return 0
+	}
+	return float64(p.BillableMinutes+p.UnbillableMinutes) / float64(p.EntryCount)
+}
+
+// add accumulates the minutes of the entry.
+func (p *ParticipantKpi) add(entry freckle.Entry) {
+	if entry.Billable {
+		p.BillableMinutes += entry.Minutes
+	} else {
+		p.UnbillableMinutes += entry.Minutes
+	}
+	p.EntryCount++
+}
+
+// DisplayName returns the "First Last" name of the participant, falling back to the local part
+// of its email and then to its ID when the names are empty, e.g. for contractors invited by email.
+func (p ParticipantKpi) DisplayName() string {
+	name := strings.TrimSpace(strings.TrimSpace(p.FirstName) + " " + strings.TrimSpace(p.LastName))
+	if name != "" {
+		return name
+	}
+	if local := strings.TrimSpace(strings.SplitN(p.Email, "@", 2)[0]); local != "" {
+		return local
+	}
+	return strconv.Itoa(p.Id)
+}
+
+func (p ParticipantKpi) String() string {
+	return p.Format(DefaultFormatter)
+}
+
+// Format is String with the display settings of f.
+func (p ParticipantKpi) Format(f Formatter) string {
+	return fmt.Sprintf(
+		"%s Billable : %s - Unbillable : %s - Entries : %d (%.0fmin avg)",
+		p.DisplayName(),
+		f.FormatDuration(float64(p.BillableMinutes)),
+		f.FormatDuration(float64(p.UnbillableMinutes)),
+		p.EntryCount, p.AverageEntryMinutes(),
+	)
+
+}
+
+// percentOf returns part in percent of total, zero when total is zero, e.g. the unbillable minutes with -billable only.
+func percentOf(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total) * 100
+}
+
+// VerboseString prints detailed information for a Participant in the context of a project.
+func (p ParticipantKpi) VerboseString(prj ProjectKpi, f Formatter) string {
+	billablePercent := percentOf(p.BillableMinutes, prj.BillableMinutes)
+	unbillablePercent := percentOf(p.UnbillableMinutes, prj.UnbillableMinutes)
+	return fmt.Sprintf(
+		"%s Billable : %s (%f %%) - Unbillable : %s (%f %%) - Entries : %d (%.0fmin avg)",
+		p.DisplayName(),
+		f.FormatDuration(float64(p.BillableMinutes)), billablePercent,
+		f.FormatDuration(float64(p.UnbillableMinutes)), unbillablePercent,
+		p.EntryCount, p.AverageEntryMinutes(),
+	)
+}
+
+// GetParticipantKpis calculates slice of ParticipantKpi based on a slice of Freckle Entry.
+func GetParticipantKpis(fes []freckle.Entry) ParticipantKpis {
+	b := NewParticipantKpisBuilder()
+	for _, entry := range fes {
+		b.Add(entry)
+	}
+	return b.ParticipantKpis()
+}
+
+// ParticipantKpisBuilder accumulates the ParticipantKpi of entries added one at a time,
+// so the entries don't need to be held in memory.
+type ParticipantKpisBuilder struct {
+	participants map[int]ParticipantKpi
+}
+
+// NewParticipantKpisBuilder returns an empty ParticipantKpisBuilder.
+func NewParticipantKpisBuilder() *ParticipantKpisBuilder {
+	return &ParticipantKpisBuilder{participants: make(map[int]ParticipantKpi)}
+}
+
+// Add accumulates the entry in the ParticipantKpi of its user.
+func (b *ParticipantKpisBuilder) Add(entry freckle.Entry) {
+	pkpi, ok := b.participants[entry.User.Id]
+	if !ok {
+		pkpi = ParticipantKpi{Participant: entry.User}
+	}
+	pkpi.add(entry)
+	b.participants[entry.User.Id] = pkpi
+}
+
+// Merge accumulates ParticipantKpis already aggregated, e.g. the ones of another project.
+func (b *ParticipantKpisBuilder) Merge(pks ParticipantKpis) {
+	for _, p := range pks {
+		pkpi, ok := b.participants[p.Id]
+		if !ok {
+			b.participants[p.Id] = p
+			continue
+		}
+		pkpi.BillableMinutes += p.BillableMinutes
+		pkpi.UnbillableMinutes += p.UnbillableMinutes
+		pkpi.EntryCount += p.EntryCount
+		b.participants[p.Id] = pkpi
+	}
+}
+
+// ParticipantKpis returns the ParticipantKpi accumulated, sorted by descending total time.
+func (b *ParticipantKpisBuilder) ParticipantKpis() ParticipantKpis {
+	var pks ParticipantKpis
+	for _, v := range b.participants {
+		pks = append(pks, v)
+	}
+	sort.Sort(participantsByDescendingTime{pks})
+	return pks
+}
+
+// ParticipantKpis is a type alias on which we are going to implement the methods required by the Sort interface.
+type ParticipantKpis []ParticipantKpi
+
+func (slice ParticipantKpis) Len() int {
+	return len(slice)
+}
+
+// Less orders the participants by ascending total time, the ties are broken by email then ID
+// so the output is deterministic between runs.
+func (slice ParticipantKpis) Less(i, j int) bool {
+	ti := slice[i].BillableMinutes + slice[i].UnbillableMinutes
+	tj := slice[j].BillableMinutes + slice[j].UnbillableMinutes
+	if ti != tj {
+		return ti < tj
+	}
+	if slice[i].Email != slice[j].Email {
+		return slice[i].Email < slice[j].Email
+	}
+	return slice[i].Id < slice[j].Id
+}
+
+func (slice ParticipantKpis) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+// participantsByDescendingTime orders the participants by descending total time, the ties are still broken
+// by ascending email then ID, which sort.Reverse would flip.
+type participantsByDescendingTime struct {
+	ParticipantKpis
+}
+
+func (slice participantsByDescendingTime) Less(i, j int) bool {
+	ti := slice.ParticipantKpis[i].BillableMinutes + slice.ParticipantKpis[i].UnbillableMinutes
+	tj := slice.ParticipantKpis[j].BillableMinutes + slice.ParticipantKpis[j].UnbillableMinutes
+	if ti != tj {
+		return ti > tj
+	}
+	return slice.ParticipantKpis.Less(i, j)
+}
+
+// Split returns the first n ParticipantKpi and the remaining ones. A n lower or equal to 0 keeps all of them.
+func (slice ParticipantKpis) Split(n int) (ParticipantKpis, ParticipantKpis) {
+	if n <= 0 || n >= len(slice) {
+		return slice, nil
+	}
+	return slice[:n], slice[n:]
+}
+
+// OthersString prints a single line summarizing the Billable and Unbillable time of all the participants.
+func (slice ParticipantKpis) OthersString(f Formatter) string {
+	var billableMinutes, unbillableMinutes int
+	for _, p := range slice {
+		billableMinutes += p.BillableMinutes
+		unbillableMinutes += p.UnbillableMinutes
+	}
+	return fmt.Sprintf(
+		"…and %d others: %s billable / %s unbillable",
+		len(slice),
+		f.FormatDuration(float64(billableMinutes)),
+		f.FormatDuration(float64(unbillableMinutes)),
+	)
+}
+
+// uninvoicedPeriodKey is the aggregation key of the entries not invoiced yet, it sorts after all the dated periods.
+const uninvoicedPeriodKey = math.MaxInt32
+
+// uninvoicedLabel is printed instead of the period for the entries not invoiced yet.
+const uninvoicedLabel = "uninvoiced"
+
+// getEntryDate returns the date of the entry according to the DateBasis.
+// ok is false when the entry is not invoiced yet in the DateBasisInvoiced basis.
+func getEntryDate(basis DateBasis, entry freckle.Entry) (t time.Time, ok bool, err error) {
+	if basis != DateBasisInvoiced {
+		t, err = ParseDate(entry.Date)
+		return t, err == nil, err
+	}
+	if entry.InvoicedAt == "" {
+		return t, false, nil
+	}
+	t, err = ParseDate(entry.InvoicedAt)
+	return t, err == nil, err
+}
+
+// ParticipantsPeriod is used to aggregate a list of ParticipantKpi over a period.
+type ParticipantsPeriod struct {
+	TimeAgg      TimeAggregater
+	Period       time.Time
+	Uninvoiced   bool
+	Participants ParticipantKpis
+	// Months are the months of the period with entries
+	Months MonthSet
+}
+
+// key returns the int used to aggregate and sort the ParticipantsPeriod.
+func (pp ParticipantsPeriod) key() (int, error) {
+	if pp.Uninvoiced {
+		return uninvoicedPeriodKey, nil
+	}
+	return pp.TimeAgg.GetInt(pp.Period)
+}
+
+// GetParticipantsPeriodPerPeriod Builds a slice of ParticipantsPeriod over the period of the given freckle entries.
+// The DateBasis selects if the entries are attributed to the period they were worked or invoiced in,
+// the entries not invoiced yet are gathered in a dedicated uninvoiced ParticipantsPeriod.
+func GetParticipantsPeriodPerPeriod(tagg TimeAggregater, basis DateBasis, fes []freckle.Entry) ([]ParticipantsPeriod, error) {
+	b := NewParticipantsPeriodBuilder(tagg, basis)
+	for _, entry := range fes {
+		if err := b.Add(entry); err != nil {
+			return nil, err
+		}
+	}
+	return b.ParticipantsPeriods(), nil
+}
+
+// ParticipantsPeriodBuilder accumulates the ParticipantsPeriod of entries added one at a time,
+// so the entries don't need to be held in memory.
+type ParticipantsPeriodBuilder struct {
+	tagg              TimeAggregater
+	basis             DateBasis
+	dedupParticipants map[int]ParticipantsPeriod
+	keys              []int
+}
+
+// NewParticipantsPeriodBuilder returns an empty ParticipantsPeriodBuilder aggregating the entries per period of tagg,
+// according to the DateBasis.
+func NewParticipantsPeriodBuilder(tagg TimeAggregater, basis DateBasis) *ParticipantsPeriodBuilder {
+	return &ParticipantsPeriodBuilder{tagg: tagg, basis: basis, dedupParticipants: make(map[int]ParticipantsPeriod)}
+}
+
+// Add accumulates the entry in the ParticipantKpi of its user for the period of the entry.
+func (b *ParticipantsPeriodBuilder) Add(entry freckle.Entry) error {
+	t, dated, err := getEntryDate(b.basis, entry)
+	if err != nil {
+		return err
+	}
+	key := uninvoicedPeriodKey
+	if dated {
+		key, err = b.tagg.GetInt(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	pk, ok := b.dedupParticipants[key]
+	if !ok {
+		b.keys = append(b.keys, key)
+	}
+	if dated {
+		pk.Period = b.tagg.GetPeriod(t)
+		pk.Months = pk.Months.Add(t.Month())
+	}
+	pk.Uninvoiced = !dated
+	pk.TimeAgg = b.tagg
+
+	// Check if the ParticipantKpi already exist in the slice
+	foundFlag := false
+	for i := range pk.Participants {
+		if pk.Participants[i].Id == entry.User.Id {
+			pk.Participants[i].add(entry)
+			foundFlag = true
+			break
+		}
+	}
+	if !foundFlag {
+		p := ParticipantKpi{Participant: entry.User}
+		p.add(entry)
+		pk.Participants = append(pk.Participants, p)
+	}
+	b.dedupParticipants[key] = pk
+	return nil
+}
+
+// ParticipantsPeriods returns the ParticipantsPeriod accumulated, sorted by period, the uninvoiced one comes last.
+func (b *ParticipantsPeriodBuilder) ParticipantsPeriods() []ParticipantsPeriod {
+	sort.Ints(b.keys)
+	var participants []ParticipantsPeriod
+	for _, k := range b.keys {
+		v := b.dedupParticipants[k]
+		sort.Sort(participantsByDescendingTime{v.Participants})
+		participants = append(participants, v)
+	}
+	return participants
+}
+
+// GetParticipantsPeriodPerMonth Builds a slice of ParticipantsPeriod over months for the given freckle entries worked date.
+func GetParticipantsPeriodPerMonth(fes []freckle.Entry) ([]ParticipantsPeriod, error) {
+	return GetParticipantsPeriodPerPeriod(MonthAgg{}, DateBasisWorked, fes)
+}
+
+// GetParticipantsPeriodPerYear Builds a slice of ParticipantsPeriod over years for the given freckle entries worked date.
+func GetParticipantsPeriodPerYear(fes []freckle.Entry) ([]ParticipantsPeriod, error) {
+	return GetParticipantsPeriodPerPeriod(YearAgg{}, DateBasisWorked, fes)
+}
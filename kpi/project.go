@@ -0,0 +1,580 @@
+package kpi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gertv/go-freckle"
+)
+
+// ProjectKpi is a freckle project enriched with the related entries, invoices and expenses
+type ProjectKpi struct {
+	freckle.Project
+	DetailedEntries []freckle.Entry
+	// Invoices are the invoices of the project with their currency, they shadow the ones of the projects payload
+	Invoices []Invoice
+	Expenses []Expense
+	// InvoiceOptions selects the invoices counted in the invoiced amounts and the currency of the ones without currency
+	InvoiceOptions InvoiceOptions
+}
+
+// ExcludedInvoices returns the number of invoices not counted in the invoiced amounts because of their state, see InvoiceOptions.
+func (pi *ProjectKpi) ExcludedInvoices() int {
+	var n int
+	for _, invoice := range pi.Invoices {
+		if pi.InvoiceOptions.isExcluded(invoice) {
+			n++
+		}
+	}
+	return n
+}
+
+// GetInvoicedTotal return the grand total of amount invoiced, regardless of the invoice currency
+func (pi *ProjectKpi) GetInvoicedTotal() float64 {
+	invoicedAmount := 0.0
+	for _, invoice := range pi.Invoices {
+		if !pi.InvoiceOptions.isExcluded(invoice) {
+			invoicedAmount += invoice.TotalAmount
+		}
+	}
+	return invoicedAmount
+}
+
+// GetInvoicedTotalPerCurrency return the total of amount invoiced for each currency
+func (pi *ProjectKpi) GetInvoicedTotalPerCurrency() Amounts {
+	invoicedAmounts := make(Amounts)
+	for _, invoice := range pi.Invoices {
+		if !pi.InvoiceOptions.isExcluded(invoice) {
+			invoicedAmounts[pi.InvoiceOptions.currency(invoice)] += invoice.TotalAmount
+		}
+	}
+	return invoicedAmounts
+}
+
+// GetInvoicedTotalInCurrency return the total of amount invoiced in the currency of the InvoiceOptions,
+// the invoices in the other currencies are ignored since their amounts can't be added
+func (pi *ProjectKpi) GetInvoicedTotalInCurrency() float64 {
+	return pi.GetInvoicedTotalPerCurrency()[CurrencyOrDefault(pi.InvoiceOptions.Currency)]
+}
+
+// GetPaidTotalPerCurrency return the total of amount invoiced and paid for each currency
+func (pi *ProjectKpi) GetPaidTotalPerCurrency() Amounts {
+	paidAmounts := make(Amounts)
+	for _, invoice := range pi.Invoices {
+		if !pi.InvoiceOptions.isExcluded(invoice) && isInvoicePaid(invoice) {
+			paidAmounts[pi.InvoiceOptions.currency(invoice)] += invoice.TotalAmount
+		}
+	}
+	return paidAmounts
+}
+
+// GetOutstandingTotalPerCurrency return the total of amount invoiced and not paid yet for each currency
+func (pi *ProjectKpi) GetOutstandingTotalPerCurrency() Amounts {
+	outstandingAmounts := make(Amounts)
+	for _, invoice := range pi.Invoices {
+		if !pi.InvoiceOptions.isExcluded(invoice) && !isInvoicePaid(invoice) {
+			outstandingAmounts[pi.InvoiceOptions.currency(invoice)] += invoice.TotalAmount
+		}
+	}
+	return outstandingAmounts
+}
+
+func (pi ProjectKpi) String() string {
+	return pi.Format(DefaultFormatter)
+}
+
+// Format is String with the display settings of f.
+func (pi ProjectKpi) Format(f Formatter) string {
+	invoiced := pi.GetInvoicedTotalPerCurrency()
+	billableHours := float64(pi.BillableMinutes) / 60
+	invoicedHours := float64(pi.InvoicedMinutes) / 60
+	return fmt.Sprintf(
+		"%s total invoiced : %s %s, %s (%s) - Billable : %s (%s) - Unbillable : %s - expenses: %s, net invoiced: %s",
+		pi.Name,
+		f.FormatAmounts(invoiced), f.splitString(pi.GetPaidTotalPerCurrency(), pi.GetOutstandingTotalPerCurrency()),
+		f.FormatDuration(float64(pi.InvoicedMinutes)), f.FormatRates(invoiced, invoicedHours),
+		f.FormatDuration(float64(pi.BillableMinutes)), f.FormatRates(invoiced, billableHours),
+		f.FormatDuration(float64(pi.UnbillableMinutes)),
+		f.FormatAmounts(pi.GetExpensesTotalPerCurrency()), f.FormatAmounts(pi.GetNetInvoicedPerCurrency()))
+}
+
+// FilteredString is Format for a project whose entries are filtered by the BillableFilter.
+// The invoiced amounts don't depend on the entries, so they are printed apart from the hours and no rate is computed.
+func (pi ProjectKpi) FilteredString(filter BillableFilter, f Formatter) string {
+	return fmt.Sprintf(
+		"%s (%s)\n\t invoices : total invoiced : %s %s - expenses: %s, net invoiced: %s\n\t entries : %s invoiced - Billable : %s - Unbillable : %s",
+		pi.Name, filter.Description(),
+		f.FormatAmounts(pi.GetInvoicedTotalPerCurrency()), f.splitString(pi.GetPaidTotalPerCurrency(), pi.GetOutstandingTotalPerCurrency()),
+		f.FormatAmounts(pi.GetExpensesTotalPerCurrency()), f.FormatAmounts(pi.GetNetInvoicedPerCurrency()),
+		f.FormatDuration(float64(pi.InvoicedMinutes)),
+		f.FormatDuration(float64(pi.BillableMinutes)),
+		f.FormatDuration(float64(pi.UnbillableMinutes)))
+}
+
+// FilterProjectKpiFrom keeps the entries worked and the invoices dated on or after from.
+// The billable, unbillable and invoiced minutes of the project are recomputed from the kept entries.
+func FilterProjectKpiFrom(p ProjectKpi, from time.Time) (ProjectKpi, error) {
+	day := formatDay(from)
+	filtered, err := FilterInvoicesFrom(p, from)
+	if err != nil {
+		return p, err
+	}
+	filtered.DetailedEntries = nil
+	filtered.BillableMinutes, filtered.UnbillableMinutes, filtered.InvoicedMinutes = 0, 0, 0
+
+	for _, entry := range p.DetailedEntries {
+		t, err := ParseDate(entry.Date)
+		if err != nil {
+			return p, err
+		}
+		if formatDay(t) < day {
+			continue
+		}
+		filtered.DetailedEntries = append(filtered.DetailedEntries, entry)
+		if !entry.Billable {
+			filtered.UnbillableMinutes += entry.Minutes
+			continue
+		}
+		filtered.BillableMinutes += entry.Minutes
+		if entry.InvoicedAt != "" {
+			filtered.InvoicedMinutes += entry.Minutes
+		}
+	}
+	return filtered, nil
+}
+
+// FilterInvoicesFrom keeps the invoices and the expenses dated on or after from, the entries are left untouched.
+func FilterInvoicesFrom(p ProjectKpi, from time.Time) (ProjectKpi, error) {
+	day := formatDay(from)
+	filtered := p
+	filtered.Invoices = nil
+	filtered.Expenses = nil
+
+	for _, invoice := range p.Invoices {
+		t, err := ParseDate(invoice.InvoiceDate)
+		if err != nil {
+			return p, err
+		}
+		if formatDay(t) >= day {
+			filtered.Invoices = append(filtered.Invoices, invoice)
+		}
+	}
+
+	for _, expense := range p.Expenses {
+		t, err := ParseDate(expense.Date)
+		if err != nil {
+			return p, err
+		}
+		if formatDay(t) >= day {
+			filtered.Expenses = append(filtered.Expenses, expense)
+		}
+	}
+	return filtered, nil
+}
+
+// ProjectPeriodKpi represents the project information for a period.
+type ProjectPeriodKpi struct {
+	Name       string
+	TimeAgg    TimeAggregater
+	Period     time.Time
+	Uninvoiced bool
+	Invoices   []InvoicePeriodKpi
+	// Expenses holds the amount spent during the period for each currency
+	Expenses     Amounts
+	Participants []ParticipantKpi
+	// DefaultCurrency is the currency of the invoices and the expenses of the project without currency,
+	// the zero amounts are in it, DefaultCurrency when empty
+	DefaultCurrency string
+	Trend           *PeriodTrend
+	// Months are the months of the period with entries, see PeriodMonths
+	Months MonthSet
+}
+
+// Delta represents the change of a value versus the previous period.
+type Delta struct {
+	Absolute float64
+	Percent  float64
+	// HasPercent is false when the previous value is zero
+	HasPercent bool
+}
+
+func newDelta(previous, current float64) Delta {
+	d := Delta{Absolute: current - previous}
+	if previous != 0 {
+		d.Percent = d.Absolute / previous * 100
+		d.HasPercent = true
+	}
+	return d
+}
+
+// PeriodTrend represents the change of a ProjectPeriodKpi versus the previous period.
+type PeriodTrend struct {
+	Previous string
+	Invoiced map[string]Delta
+	Minutes  Delta
+}
+
+// Currencies returns the sorted currencies of the invoiced change.
+func (t PeriodTrend) Currencies() []string {
+	var currencies []string
+	for currency := range t.Invoiced {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+func (t PeriodTrend) String() string {
+	return t.Format(DefaultFormatter)
+}
+
+// Format is String with the display settings of f.
+func (t PeriodTrend) Format(f Formatter) string {
+	var invoiced []string
+	for _, currency := range t.Currencies() {
+		d := t.Invoiced[currency]
+		if d.HasPercent {
+			invoiced = append(invoiced, fmt.Sprintf("%+.0f%%", d.Percent))
+		} else {
+			sign := "+"
+			if d.Absolute < 0 {
+				sign = ""
+			}
+			invoiced = append(invoiced, sign+f.FormatAmount(currency, d.Absolute))
+		}
+	}
+	hours := f.formatDurationChange(t.Minutes.Absolute)
+	if t.Minutes.HasPercent {
+		hours = fmt.Sprintf("%+.0f%%", t.Minutes.Percent)
+	}
+	return fmt.Sprintf("%s vs %s, hours %s", strings.Join(invoiced, " / "), t.Previous, hours)
+}
+
+// GetMinutes returns the billable and unbillable minutes of all the participants during the period.
+func (pp ProjectPeriodKpi) GetMinutes() (billable, unbillable int) {
+	for _, p := range pp.Participants {
+		billable += p.BillableMinutes
+		unbillable += p.UnbillableMinutes
+	}
+	return billable, unbillable
+}
+
+// GetRealizedHourlyRate returns the amount invoiced during the period per billable hour worked during the period,
+// for each currency. ok is false when the period has no billable hours, e.g. a retainer invoiced in a quiet month,
+// and for the entries not invoiced yet.
+func (pp ProjectPeriodKpi) GetRealizedHourlyRate() (rates Amounts, ok bool) {
+	billable, _ := pp.GetMinutes()
+	if billable == 0 || pp.Uninvoiced {
+		return nil, false
+	}
+	hours := float64(billable) / 60
+	rates = make(Amounts)
+	for currency, amount := range pp.GetInvoicedAmounts() {
+		rates[currency] = amount / hours
+	}
+	return rates, true
+}
+
+// annotateTrend sets the Trend of each ProjectPeriodKpi versus the immediately preceding period.
+// A period following a gap, the first one and the uninvoiced one don't get a Trend.
+func annotateTrend(ppks []ProjectPeriodKpi) {
+	for i := 1; i < len(ppks); i++ {
+		prev, cur := ppks[i-1], ppks[i]
+		if prev.Uninvoiced || cur.Uninvoiced {
+			continue
+		}
+		if !prev.TimeAgg.Next(prev.Period).Equal(cur.Period) {
+			continue
+		}
+
+		prevAmounts, curAmounts := prev.GetInvoicedAmounts(), cur.GetInvoicedAmounts()
+		invoiced := make(map[string]Delta)
+		for currency, amount := range curAmounts {
+			invoiced[currency] = newDelta(prevAmounts[currency], amount)
+		}
+		for currency, amount := range prevAmounts {
+			if _, ok := curAmounts[currency]; !ok {
+				invoiced[currency] = newDelta(amount, 0)
+			}
+		}
+		if len(invoiced) == 0 {
+			invoiced[CurrencyOrDefault(cur.DefaultCurrency)] = Delta{}
+		}
+
+		prevBillable, prevUnbillable := prev.GetMinutes()
+		curBillable, curUnbillable := cur.GetMinutes()
+		ppks[i].Trend = &PeriodTrend{
+			Previous: prev.Label(),
+			Invoiced: invoiced,
+			Minutes:  newDelta(float64(prevBillable+prevUnbillable), float64(curBillable+curUnbillable)),
+		}
+	}
+}
+
+// Label returns the period printed in the output, or uninvoiced for the entries not invoiced yet.
+func (pp ProjectPeriodKpi) Label() string {
+	if pp.Uninvoiced {
+		return uninvoicedLabel
+	}
+	return pp.TimeAgg.GetString(pp.Period)
+}
+
+// GetInvoicedAmounts returns the amount invoiced during the period for each currency.
+func (pp ProjectPeriodKpi) GetInvoicedAmounts() Amounts {
+	amounts := make(Amounts)
+	for _, invoice := range pp.Invoices {
+		amounts[invoice.Currency] += invoice.Amount
+	}
+	return amounts
+}
+
+// GetPaidAmounts returns the amount invoiced during the period and paid for each currency.
+func (pp ProjectPeriodKpi) GetPaidAmounts() Amounts {
+	amounts := make(Amounts)
+	for _, invoice := range pp.Invoices {
+		if invoice.Paid != 0 {
+			amounts[invoice.Currency] += invoice.Paid
+		}
+	}
+	return amounts
+}
+
+// GetOutstandingAmounts returns the amount invoiced during the period and not paid yet for each currency.
+func (pp ProjectPeriodKpi) GetOutstandingAmounts() Amounts {
+	amounts := make(Amounts)
+	for _, invoice := range pp.Invoices {
+		if invoice.Outstanding != 0 {
+			amounts[invoice.Currency] += invoice.Outstanding
+		}
+	}
+	return amounts
+}
+
+func (pp ProjectPeriodKpi) String() string {
+	return pp.Format(DefaultFormatter)
+}
+
+// Format is String with the display settings of f.
+func (pp ProjectPeriodKpi) Format(f Formatter) string {
+	s := fmt.Sprintf("%s %s invoiced", pp.Label(), f.FormatAmounts(pp.GetInvoicedAmounts()))
+	if paid, outstanding := pp.GetPaidAmounts(), pp.GetOutstandingAmounts(); len(paid)+len(outstanding) > 0 {
+		s += " " + f.splitString(paid, outstanding)
+	}
+	if len(pp.Expenses) > 0 {
+		s += fmt.Sprintf(", %s spent", f.FormatAmounts(pp.Expenses))
+	}
+	if rates, ok := pp.GetRealizedHourlyRate(); ok {
+		s += ", rate: " + f.FormatRates(rates, 1)
+	} else {
+		s += ", rate: n/a"
+	}
+	if pp.Trend != nil {
+		s += fmt.Sprintf(" (%s)", pp.Trend.Format(f))
+	}
+	return s
+}
+
+// PeriodOptions tunes how GetProjectKpiPerPeriod aggregates the entries and invoices per period.
+type PeriodOptions struct {
+	// DateBasis selects if the entries are attributed to the period they were worked or invoiced in
+	DateBasis DateBasis
+	// FillGaps inserts zero valued periods between the earliest and the latest period
+	FillGaps bool
+}
+
+// fillProjectKpiGaps inserts a zero valued ProjectPeriodKpi for each period missing between
+// the earliest and the latest dated period of the sorted slice of ProjectPeriodKpi.
+func fillProjectKpiGaps(tagg TimeAggregater, p ProjectKpi, ppks []ProjectPeriodKpi) []ProjectPeriodKpi {
+	var filled []ProjectPeriodKpi
+	var expected time.Time
+	for i, ppk := range ppks {
+		if !ppk.Uninvoiced {
+			if i > 0 {
+				for ; expected.Before(ppk.Period); expected = tagg.Next(expected) {
+					filled = append(filled, ProjectPeriodKpi{Name: p.Name, TimeAgg: tagg, Period: expected, DefaultCurrency: p.InvoiceOptions.Currency})
+				}
+			}
+			expected = tagg.Next(ppk.Period)
+		}
+		filled = append(filled, ppk)
+	}
+	return filled
+}
+
+// GetProjectKpiPerPeriod returns the slice of ProjectPeriodKpi aggregated according to the PeriodOptions.
+func GetProjectKpiPerPeriod(tagg TimeAggregater, opts PeriodOptions, p ProjectKpi) ([]ProjectPeriodKpi, error) {
+	participantKpiPerPeriod, err := GetParticipantsPeriodPerPeriod(tagg, opts.DateBasis, p.DetailedEntries)
+	if err != nil {
+		return nil, err
+	}
+	return BuildProjectKpiPerPeriod(tagg, opts, p, participantKpiPerPeriod)
+}
+
+// BuildProjectKpiPerPeriod is GetProjectKpiPerPeriod with the participants already aggregated per period,
+// e.g. by an EntryAggregator, the DetailedEntries of the project are not used.
+func BuildProjectKpiPerPeriod(tagg TimeAggregater, opts PeriodOptions, p ProjectKpi, participantKpiPerPeriod []ParticipantsPeriod) ([]ProjectPeriodKpi, error) {
+	invoiceAmonthPerPeriod, err := GetInvoiceKpiPerPeriod(tagg, p.Invoices, p.InvoiceOptions)
+	if err != nil {
+		return nil, err
+	}
+	if opts.FillGaps {
+		invoiceAmonthPerPeriod = FillInvoiceKpiGaps(tagg, invoiceAmonthPerPeriod, p.InvoiceOptions.Currency)
+	}
+
+	// Each source only sets its own field of the ProjectPeriodKpi of the period,
+	// so the result doesn't depend on the order the sources are accumulated in
+	mapProjectKpiPerMonth := make(map[int]ProjectPeriodKpi)
+	getPeriod := func(key int, period time.Time) ProjectPeriodKpi {
+		ppm, ok := mapProjectKpiPerMonth[key]
+		if !ok {
+			ppm = ProjectPeriodKpi{Name: p.Name, TimeAgg: tagg, Period: period, DefaultCurrency: p.InvoiceOptions.Currency}
+		}
+		return ppm
+	}
+
+	// Acummulates the invoices for the ProjectKpi per period
+	for _, invoice := range invoiceAmonthPerPeriod {
+		key, err := invoice.TimeAgg.GetInt(invoice.Period)
+		if err != nil {
+			return nil, err
+		}
+		ppm := getPeriod(key, invoice.Period)
+		ppm.Invoices = append(ppm.Invoices, invoice)
+		mapProjectKpiPerMonth[key] = ppm
+	}
+
+	// Accumulates the particpants for the ProjectKpi per period
+	for _, participants := range participantKpiPerPeriod {
+		key, err := participants.key()
+		if err != nil {
+			return nil, err
+		}
+		ppm := getPeriod(key, participants.Period)
+		ppm.Uninvoiced = participants.Uninvoiced
+		ppm.Participants = append(ppm.Participants, participants.Participants...)
+		ppm.Months = participants.Months
+		mapProjectKpiPerMonth[key] = ppm
+	}
+
+	// Accumulates the expenses for the ProjectKpi per period
+	expensesPerPeriod, expensesPeriods, err := getExpensesPerPeriod(tagg, p.Expenses, p.InvoiceOptions.Currency)
+	if err != nil {
+		return nil, err
+	}
+	for key, expenses := range expensesPerPeriod {
+		ppm := getPeriod(key, expensesPeriods[key])
+		ppm.Expenses = expenses
+		mapProjectKpiPerMonth[key] = ppm
+	}
+
+	// returns the slice of ProjectPeriodKpi sorted by the unique keys, the uninvoiced one comes last
+	keys := make([]int, 0, len(mapProjectKpiPerMonth))
+	for key := range mapProjectKpiPerMonth {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	var projectsPeriod []ProjectPeriodKpi
+	for _, v := range keys {
+		projectsPeriod = append(projectsPeriod, mapProjectKpiPerMonth[v])
+	}
+	if opts.FillGaps {
+		projectsPeriod = fillProjectKpiGaps(tagg, p, projectsPeriod)
+	}
+	annotateTrend(projectsPeriod)
+	return projectsPeriod, nil
+}
+
+// GetProjectKpiPerMonth returns the slice of ProjectPeriodKpi per month the entries were worked.
+func GetProjectKpiPerMonth(p ProjectKpi) ([]ProjectPeriodKpi, error) {
+	return GetProjectKpiPerPeriod(MonthAgg{}, PeriodOptions{DateBasis: DateBasisWorked}, p)
+}
+
+// GetProjectKpiPerYear returns the slice of ProjectPeriodKpi per year the entries were worked.
+func GetProjectKpiPerYear(p ProjectKpi) ([]ProjectPeriodKpi, error) {
+	return GetProjectKpiPerPeriod(YearAgg{}, PeriodOptions{DateBasis: DateBasisWorked}, p)
+}
+
+// Project sort keys accepted by SortProjectKpis.
+const (
+	sortKeyName       = "name"
+	sortKeyInvoiced   = "invoiced"
+	sortKeyBillable   = "billable"
+	sortKeyUnbillable = "unbillable"
+	sortKeyRate       = "rate"
+)
+
+// GetHourlyRate returns the amount invoiced in the currency of the InvoiceOptions per billable hour,
+// ok is false when the project has no billable hours.
+func (pi ProjectKpi) GetHourlyRate() (rate float64, ok bool) {
+	if pi.BillableMinutes == 0 {
+		return 0, false
+	}
+	return pi.GetInvoicedTotalInCurrency() / (float64(pi.BillableMinutes) / 60), true
+}
+
+// projectKpiSorter implements the sort interface for a slice of ProjectKpi ordered by a sort key.
+type projectKpiSorter struct {
+	projects []ProjectKpi
+	key      string
+	desc     bool
+}
+
+func (s projectKpiSorter) Len() int {
+	return len(s.projects)
+}
+
+func (s projectKpiSorter) Swap(i, j int) {
+	s.projects[i], s.projects[j] = s.projects[j], s.projects[i]
+}
+
+func (s projectKpiSorter) Less(i, j int) bool {
+	pi, pj := s.projects[i], s.projects[j]
+	var vi, vj float64
+	switch s.key {
+	case sortKeyInvoiced:
+		vi, vj = pi.GetInvoicedTotalInCurrency(), pj.GetInvoicedTotalInCurrency()
+	case sortKeyBillable:
+		vi, vj = float64(pi.BillableMinutes), float64(pj.BillableMinutes)
+	case sortKeyUnbillable:
+		vi, vj = float64(pi.UnbillableMinutes), float64(pj.UnbillableMinutes)
+	case sortKeyRate:
+		// Projects without billable hours have no rate, they are always sorted last
+		var oki, okj bool
+		vi, oki = pi.GetHourlyRate()
+		vj, okj = pj.GetHourlyRate()
+		if oki != okj {
+			return oki
+		}
+	}
+	if vi != vj {
+		if s.desc {
+			return vi > vj
+		}
+		return vi < vj
+	}
+	// Ties are broken by name, then ID, so the output is deterministic between runs
+	if pi.Name != pj.Name {
+		if s.key == sortKeyName && s.desc {
+			return pi.Name > pj.Name
+		}
+		return pi.Name < pj.Name
+	}
+	return pi.Id < pj.Id
+}
+
+// IsValidSortKey reports whether key can be used to sort a slice of ProjectKpi.
+func IsValidSortKey(key string) bool {
+	switch key {
+	case sortKeyName, sortKeyInvoiced, sortKeyBillable, sortKeyUnbillable, sortKeyRate:
+		return true
+	}
+	return false
+}
+
+// SortProjectKpis sorts the slice of ProjectKpi in place by name, invoiced, billable, unbillable or rate.
+// The invoiced amounts and the rates are compared in the currency of the InvoiceOptions of the projects.
+func SortProjectKpis(projects []ProjectKpi, key string, desc bool) {
+	sort.Stable(projectKpiSorter{projects, key, desc})
+}
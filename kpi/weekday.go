@@ -0,0 +1,68 @@
+package kpi
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gertv/go-freckle"
+)
+
+// Weekdays are the days of the week in the order they are printed, Monday first.
+var Weekdays = []time.Weekday{
+	time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday,
+}
+
+// WeekdayKpi holds the billable and unbillable minutes of the entries per day of the week, indexed by time.Weekday.
+type WeekdayKpi struct {
+	BillableMinutes   [7]int
+	UnbillableMinutes [7]int
+}
+
+// EntryWeekday returns the day of the week the entry was worked in loc. The timestamps are converted to loc,
+// the bare dates are taken as they are.
+func EntryWeekday(entry freckle.Entry, loc *time.Location) (time.Weekday, error) {
+	t, err := ParseDateIn(entry.Date, loc)
+	if err != nil {
+		return 0, err
+	}
+	return t.In(loc).Weekday(), nil
+}
+
+// Add accumulates the minutes of the entry on the day of the week it was worked in loc.
+func (w *WeekdayKpi) Add(entry freckle.Entry, loc *time.Location) error {
+	day, err := EntryWeekday(entry, loc)
+	if err != nil {
+		return err
+	}
+	w.add(day, entry)
+	return nil
+}
+
+// add accumulates the minutes of the entry on the day.
+func (w *WeekdayKpi) add(day time.Weekday, entry freckle.Entry) {
+	if entry.Billable {
+		w.BillableMinutes[day] += entry.Minutes
+	} else {
+		w.UnbillableMinutes[day] += entry.Minutes
+	}
+}
+
+// GetWeekdayKpi computes the WeekdayKpi of the entries worked in loc.
+func GetWeekdayKpi(fes []freckle.Entry, loc *time.Location) (WeekdayKpi, error) {
+	var w WeekdayKpi
+	for _, entry := range fes {
+		if err := w.Add(entry, loc); err != nil {
+			return w, err
+		}
+	}
+	return w, nil
+}
+
+// DayString prints the billable and unbillable time of the day, the day names are padded so the days line up.
+func (w WeekdayKpi) DayString(day time.Weekday, f Formatter) string {
+	return fmt.Sprintf(
+		"%-9s Billable : %s - Unbillable : %s",
+		day,
+		f.FormatDuration(float64(w.BillableMinutes[day])),
+		f.FormatDuration(float64(w.UnbillableMinutes[day])))
+}
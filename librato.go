@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/samuel/go-librato/librato"
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+// metricsURL is the endpoint of the librato legacy metrics API.
+var metricsURL = "https://metrics-api.librato.com/v1/metrics"
+
+// libratoRetryDelay is the delay before the first retry of a post, it doubles with each retry.
+var libratoRetryDelay = time.Second
+
+// libratoExcerptLength is the maximum length of the response body quoted in the errors.
+const libratoExcerptLength = 512
+
+// libratoAPI posts to librato. go-librato sends its requests with http.DefaultClient, without timeout,
+// so the payloads are posted with Client instead.
+type libratoAPI struct {
+	Client  *http.Client
+	Account string
+	Token   string
+	// Retries is the number of times a post failing with a 5xx status or a network error is retried
+	Retries int
+}
+
+// libratoError is a post refused by librato.
+type libratoError struct {
+	Status string
+	Code   int
+	// Excerpt is the beginning of the response body, librato describes the invalid measures in it
+	Excerpt string
+	// Measures is the number of gauges or measurements posted
+	Measures int
+	// Invalid are the names of the gauges librato refuses, found for the 400 responses
+	Invalid []string
+}
+
+func (e *libratoError) Error() string {
+	msg := fmt.Sprintf("librato responded %s to the %d measures posted : %s", e.Status, e.Measures, e.Excerpt)
+	if len(e.Invalid) > 0 {
+		msg += fmt.Sprintf(" (invalid names : %s)", strings.Join(e.Invalid, ", "))
+	}
+	return msg
+}
+
+// excerpt returns the beginning of the body, up to libratoExcerptLength bytes.
+func excerpt(body []byte) string {
+	s := strings.TrimSpace(string(body))
+	if len(s) > libratoExcerptLength {
+		s = s[:libratoExcerptLength] + "…"
+	}
+	return s
+}
+
+// isRetryable reports whether the post may succeed when retried : librato is unavailable or didn't respond in time.
+func isRetryable(err error) bool {
+	if e, ok := err.(*libratoError); ok {
+		return e.Code >= 500
+	}
+	_, isNet := err.(net.Error)
+	return isNet
+}
+
+// post posts the payload of the names measures to url, the failures with a 5xx status or a network error are retried
+// with an exponential backoff. The names are the ones of the gauges or measurements posted, the ones refused
+// by librato are listed in the error of a 400 response.
+func (api libratoAPI) post(ctx context.Context, url string, payload interface{}, names []string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	delay := libratoRetryDelay
+	for attempt := 0; ; attempt++ {
+		err = api.postOnce(ctx, url, body, names)
+		if err == nil || attempt >= api.Retries || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+func (api libratoAPI) postOnce(ctx context.Context, url string, body []byte, names []string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(api.Account, api.Token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := api.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	e := &libratoError{Status: resp.Status, Code: resp.StatusCode, Excerpt: excerpt(data), Measures: len(names)}
+	if resp.StatusCode == http.StatusBadRequest {
+		e.Invalid = invalidNames(names, string(data))
+	}
+	return e
+}
+
+// invalidNames returns the sorted names librato refuses, or named in the body of its response.
+func invalidNames(names []string, body string) []string {
+	seen := make(map[string]bool)
+	var invalid []string
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		if !libratoexport.IsValidMetricName(name) || strings.Contains(body, `"`+name+`"`) {
+			seen[name] = true
+			invalid = append(invalid, name)
+		}
+	}
+	sort.Strings(invalid)
+	return invalid
+}
+
+// postMetrics posts the gauges to the librato legacy metrics API.
+func (api libratoAPI) postMetrics(ctx context.Context, metrics *librato.Metrics) error {
+	if len(metrics.Counters) == 0 && len(metrics.Gauges) == 0 {
+		return nil
+	}
+	var names []string
+	for _, g := range metrics.Gauges {
+		if g, ok := g.(librato.Gauge); ok {
+			names = append(names, g.Name)
+		}
+	}
+	return api.post(ctx, metricsURL, metrics, names)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-librato/librato"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostMetrics(t *testing.T) {
+	var posts int
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		user, token, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "account", user)
+		assert.Equal(t, "token", token)
+		assert.Equal(t, userAgent, r.Header.Get("User-Agent"))
+		switch {
+		case status == http.StatusBadRequest:
+			http.Error(w, `{"errors":{"params":{"name":["FreckleAPI.participants.BillableMinutes.Jane Doe is invalid"]}}}`, status)
+		case posts < 3:
+			http.Error(w, "unavailable", status)
+		}
+	}))
+	defer server.Close()
+	defer func(url string, delay time.Duration) { metricsURL, libratoRetryDelay = url, delay }(metricsURL, libratoRetryDelay)
+	metricsURL, libratoRetryDelay = server.URL, time.Millisecond
+
+	metrics := &librato.Metrics{Gauges: []interface{}{
+		librato.Gauge{Name: "FreckleAPI.projects.BillableMinutes", Source: "Acme-Web", Count: 1, Sum: 60},
+		librato.Gauge{Name: "FreckleAPI.participants.BillableMinutes.Jane Doe", Source: "Acme-Web", Count: 1, Sum: 60},
+	}}
+	api := libratoAPI{Client: server.Client(), Account: "account", Token: "token", Retries: 2}
+	assert.NoError(t, api.postMetrics(context.Background(), metrics))
+	assert.Equal(t, 3, posts, "the 5xx responses are retried")
+
+	posts = 0
+	api.Retries = 1
+	err := api.postMetrics(context.Background(), metrics)
+	assert.EqualError(t, err, "librato responded 503 Service Unavailable to the 2 measures posted : unavailable")
+	assert.Equal(t, 2, posts)
+
+	posts, status = 0, http.StatusBadRequest
+	err = api.postMetrics(context.Background(), metrics)
+	if assert.IsType(t, &libratoError{}, err) {
+		assert.Equal(t, []string{"FreckleAPI.participants.BillableMinutes.Jane Doe"}, err.(*libratoError).Invalid)
+	}
+	assert.Equal(t, 1, posts, "the 400 responses are not retried")
+}
+
+func TestPostMetricsTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	defer func(url string) { metricsURL = url }(metricsURL)
+	metricsURL = server.URL
+
+	api := libratoAPI{Client: &http.Client{Timeout: 10 * time.Millisecond}}
+	err := api.postMetrics(context.Background(), &librato.Metrics{Gauges: []interface{}{librato.Gauge{Name: "FreckleAPI.projects.BillableMinutes"}}})
+	assert.Error(t, err)
+	assert.True(t, isRetryable(err))
+}
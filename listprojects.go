@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// Output formats of the -list-projects listing, on top of formatText.
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// listedProject is a project of the -list-projects listing.
+type listedProject struct {
+	// Account is the account of the project, omitted for the unnamed account
+	Account           string `json:"account,omitempty"`
+	Id                int    `json:"id"`
+	Name              string `json:"name"`
+	State             string `json:"state"`
+	BillableMinutes   int    `json:"billable_minutes"`
+	UnbillableMinutes int    `json:"unbillable_minutes"`
+}
+
+// projectState returns the state of the project printed in the listing.
+func projectState(project kpi.ProjectKpi) string {
+	if project.Enabled {
+		return "enabled"
+	}
+	return "archived"
+}
+
+// ListProjects returns the projects selected by the options, as Run would, without fetching their entries nor invoices.
+// skipped counts the archived projects left out.
+func ListProjects(ctx context.Context, ds DataSource, opts Options) (projects []kpi.ProjectKpi, skipped int, err error) {
+	fps, err := ds.Projects(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	projects = make([]kpi.ProjectKpi, len(fps))
+	for i, project := range fps {
+		projects[i].Project = project
+	}
+	projects, skipped = selectProjects(projects, opts.ProjectNames, opts.IncludeArchived)
+	if opts.SortKey != "" {
+		kpi.SortProjectKpis(projects, opts.SortKey, opts.Desc)
+	}
+	return projects, skipped, nil
+}
+
+// newListedProjects returns the listing of the projects of the account, which is empty for the unnamed account.
+func newListedProjects(account string, projects []kpi.ProjectKpi) []listedProject {
+	listed := make([]listedProject, len(projects))
+	for i, project := range projects {
+		listed[i] = listedProject{
+			Account:           account,
+			Id:                project.Id,
+			Name:              project.Name,
+			State:             projectState(project),
+			BillableMinutes:   project.BillableMinutes,
+			UnbillableMinutes: project.UnbillableMinutes,
+		}
+	}
+	return listed
+}
+
+// writeProjectList writes the ID, name, state and minute totals of the listed projects in the format,
+// preceded by their account when a project has one.
+func writeProjectList(w io.Writer, listed []listedProject, format string, f kpi.Formatter) error {
+	var withAccount bool
+	for _, p := range listed {
+		withAccount = withAccount || p.Account != ""
+	}
+
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(listed)
+	case formatCSV:
+		cw := csv.NewWriter(w)
+		header := []string{"id", "name", "state", "billable_minutes", "unbillable_minutes"}
+		if withAccount {
+			header = append([]string{"account"}, header...)
+		}
+		cw.Write(header)
+		for _, p := range listed {
+			record := []string{strconv.Itoa(p.Id), p.Name, p.State, strconv.Itoa(p.BillableMinutes), strconv.Itoa(p.UnbillableMinutes)}
+			if withAccount {
+				record = append([]string{p.Account}, record...)
+			}
+			cw.Write(record)
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		if withAccount {
+			fmt.Fprint(tw, "Account\t")
+		}
+		fmt.Fprintln(tw, "ID\tName\tState\tBillable\tUnbillable")
+		for _, p := range listed {
+			if withAccount {
+				fmt.Fprintf(tw, "%s\t", p.Account)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", p.Id, p.Name, p.State,
+				f.FormatDuration(float64(p.BillableMinutes)), f.FormatDuration(float64(p.UnbillableMinutes)))
+		}
+		return tw.Flush()
+	}
+}
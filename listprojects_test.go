@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/gertv/go-freckle"
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// listingDataSource fails when the entries or invoices are fetched.
+type listingDataSource struct {
+	*MemoryDataSource
+	t *testing.T
+}
+
+func (ds listingDataSource) Entries(ctx context.Context, projectID int) ([]freckle.Entry, error) {
+	ds.t.Errorf("the entries of %d were fetched", projectID)
+	return nil, nil
+}
+
+func (ds listingDataSource) Invoices(ctx context.Context, projectID int) ([]kpi.Invoice, error) {
+	ds.t.Errorf("the invoices of %d were fetched", projectID)
+	return nil, nil
+}
+
+func TestListProjects(t *testing.T) {
+	ds := listingDataSource{fixtureDataSource(t), t}
+	projects, skipped, err := ListProjects(context.Background(), ds, Options{})
+	assert.NoError(t, err)
+	assert.Len(t, projects, 2)
+	assert.Equal(t, 1, skipped)
+
+	projects, skipped, err = ListProjects(context.Background(), ds, Options{ProjectNames: []string{"*e*"}, IncludeArchived: true, SortKey: "name", Desc: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, skipped)
+	var buf bytes.Buffer
+	assert.NoError(t, writeProjectList(&buf, newListedProjects("", projects), formatText, kpi.DefaultFormatter))
+	assert.Equal(t, ""+
+		"ID   Name            State     Billable  Unbillable\n"+
+		"103  Initech Legacy  archived  1.0h      0.0h\n"+
+		"102  Globex Mobile   enabled   4.0h      1.5h\n"+
+		"101  Acme Web        enabled   10.0h     1.8h\n", buf.String())
+
+	// The glob patterns select the same projects in a full run
+	report, err := Run(context.Background(), fixtureDataSource(t), Options{ProjectNames: []string{"Acme*"}, TimeAgg: monthlyOptions().TimeAgg})
+	assert.NoError(t, err)
+	assert.Len(t, report.Projects, 1)
+	assert.Equal(t, "Acme Web", report.Projects[0].Name)
+}
+
+func TestWriteProjectList(t *testing.T) {
+	projects, _, err := ListProjects(context.Background(), fixtureDataSource(t), Options{ProjectNames: []string{"101"}})
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeProjectList(&buf, newListedProjects("", projects), formatCSV, kpi.DefaultFormatter))
+	assert.Equal(t, "id,name,state,billable_minutes,unbillable_minutes\n101,Acme Web,enabled,600,105\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(t, writeProjectList(&buf, newListedProjects("", projects), formatJSON, kpi.DefaultFormatter))
+	assert.JSONEq(t, `[{"id": 101, "name": "Acme Web", "state": "enabled", "billable_minutes": 600, "unbillable_minutes": 105}]`, buf.String())
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// LogLevel selects the diagnostics written by a Logger.
+type LogLevel int
+
+const (
+	// LogLevelQuiet only writes the errors.
+	LogLevelQuiet LogLevel = iota
+	// LogLevelDefault writes the errors, the warnings and the informations.
+	LogLevelDefault
+	// LogLevelVerbose also writes the progress of the run.
+	LogLevelVerbose
+)
+
+// Logger writes the diagnostics of the run, e.g. to stderr so stdout only carries the report.
+// It is safe for concurrent use.
+type Logger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level LogLevel
+}
+
+// NewLogger returns a Logger writing the diagnostics of the level to w.
+func NewLogger(w io.Writer, level LogLevel) *Logger {
+	return &Logger{w: w, level: level}
+}
+
+// discardLogger is used when no Logger is injected.
+var discardLogger = NewLogger(ioutil.Discard, LogLevelQuiet)
+
+// Verbose reports whether the progress of the run is written.
+func (l *Logger) Verbose() bool {
+	return l.level >= LogLevelVerbose
+}
+
+func (l *Logger) logf(level LogLevel, prefix, format string, args ...interface{}) {
+	if l.level < level {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, prefix+format+"\n", args...)
+}
+
+// Errorf writes an error, whatever the level.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LogLevelQuiet, "ERROR: ", format, args...)
+}
+
+// Warnf writes a warning, unless the Logger is quiet.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LogLevelDefault, "WARNING: ", format, args...)
+}
+
+// Infof writes an information, unless the Logger is quiet.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LogLevelDefault, "INFO: ", format, args...)
+}
+
+// Debugf writes the progress of the run, only when the Logger is verbose.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LogLevelVerbose, "DEBUG: ", format, args...)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	for level, expected := range map[LogLevel]string{
+		LogLevelQuiet:   "ERROR: e\n",
+		LogLevelDefault: "ERROR: e\nWARNING: w\nINFO: i\n",
+		LogLevelVerbose: "ERROR: e\nWARNING: w\nINFO: i\nDEBUG: d\n",
+	} {
+		var buf bytes.Buffer
+		logger := NewLogger(&buf, level)
+		logger.Errorf("e")
+		logger.Warnf("w")
+		logger.Infof("i")
+		logger.Debugf("d")
+		assert.Equal(t, expected, buf.String())
+		assert.Equal(t, level == LogLevelVerbose, logger.Verbose())
+	}
+}
+
+func TestRunLogsProgress(t *testing.T) {
+	var buf bytes.Buffer
+	opts := monthlyOptions()
+	opts.ProjectNames = []string{"Globex Mobile"}
+	opts.Logger = NewLogger(&buf, LogLevelVerbose)
+	_, err := Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "DEBUG: project Globex Mobile : 3 entries and 0 invoices fetched in ")
+}
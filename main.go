@@ -1,631 +1,1147 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
 	"os"
-	"sort"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gertv/go-freckle"
 	"github.com/samuel/go-librato/librato"
+	"github.com/yml/freckle-project-indicators/kpi"
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
 )
 
 const (
 	freckleAppName      = "DoesNotMatter"
 	freckleTokenVarName = "FRECKLE_APP_TOKEN"
 
-	libratoAccountVarName        = "LIBRATO_ACCOUNT"
-	libratoTokenVarName          = "LIBRATO_TOKEN"
-	libratoBaseName              = "FreckleAPI"
-	libratoCatProjects           = "projects"
-	libratoCatParticipants       = "participants"
-	libratoCatYearlyParticipants = "yearlyParticipants"
+	libratoAccountVarName = "LIBRATO_ACCOUNT"
+	libratoTokenVarName   = "LIBRATO_TOKEN"
 )
+
+const (
+	version = "0.1.0"
+	// userAgent identifies the requests sent to the Noko and librato APIs
+	userAgent = "freckle-project-indicators/" + version
+)
+
 const (
 	exitCodeOk = iota
 	exitCodeNotOk
 )
 
-func sanitizeMetricName(s string) string {
-	s = strings.Replace(s, " ", "-", -1)
-	s = strings.Replace(s, "/", "-", -1)
-	s = strings.Replace(s, "\\", "-", -1)
-	s = strings.Replace(s, "#", "", -1)
-	s = strings.Replace(s, "(", "", -1)
-	s = strings.Replace(s, ")", "", -1)
-	return s
-}
-
-// ParticipantKpi represents a freckle Participant enriched with Billable and Unbillable information.
-type ParticipantKpi struct {
-	freckle.Participant
-
-	BillableMinutes   int
-	UnbillableMinutes int
-}
-
-func (p ParticipantKpi) String() string {
-	return fmt.Sprintf(
-		"%s Billable : %.1fh - Unbillable : %.1fh",
-		p.Email,
-		float64(p.BillableMinutes)/60,
-		float64(p.UnbillableMinutes)/60,
-	)
+var (
+	libratoFlag         bool
+	timeAggFlag         string
+	sortFlag            string
+	descFlag            bool
+	topFlag             int
+	dateBasisFlag       string
+	trendFlag           bool
+	fillGapsFlag        bool
+	timeoutFlag         time.Duration
+	maxRPSFlag          float64
+	backoffFlag         time.Duration
+	dryRunFlag          bool
+	snapshotFlag        string
+	configFlag          string
+	printConfigFlag     bool
+	participantKeyFlag  string
+	fromFlag            string
+	sinceFlag           string
+	compareFlag         string
+	slackWebhookFlag    string
+	emailToFlag         string
+	emailFromFlag       string
+	emailSubjectFlag    string
+	emailDryRunFlag     bool
+	quietFlag           bool
+	verboseFlag         bool
+	formatFlag          string
+	ndjsonSummaryFlag   bool
+	includeArchivedFlag bool
+	byClientFlag        bool
+	clientMapFlag       string
+	duplicateGaugesFlag string
+	histogramFlag       bool
+	histogramBucketFlag string
+	byWeekdayFlag       bool
+	tzFlag              string
+	capacityFlag        kpi.Capacity
+	capacityPresentFlag bool
+	listProjectsFlag    bool
+	billableFlag        string
+	periodFormatFlag    string
+	pushgatewayFlag     string
+	libratoTagsFlag     bool
+	durationFormatFlag  string
+	precisionFlag       string
+	invoiceStatesFlag   string
+	currencyFlag        string
+	inputFlag           string
+	libratoTimeoutFlag  time.Duration
+	libratoRetriesFlag  int
+	dumpFlag            string
+	apiFlag             string
+	accountFlags        accountsFlag
+	postOnPartialFlag   bool
+	colorFlag           string
+	lowBillableFlag     float64
+	anonymizeFlag       bool
+	anonymizeSaltFlag   string
+	anonProjectsFlag    bool
+	Usage               = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Options :\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExample:\n")
+		fmt.Fprintf(os.Stderr, "  You can restict the extraction to a project list\n")
+		fmt.Fprintf(os.Stderr, "  %s -period=month \"foo project\" \"bar project\"\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  You can list the projects with the largest invoiced amount first\n")
+		fmt.Fprintf(os.Stderr, "  %s -sort invoiced -desc\n", os.Args[0])
+	}
+)
 
+func init() {
+	flag.BoolVar(&quietFlag, "quiet", false, "Only print the report, and the errors on stderr")
+	flag.BoolVar(&verboseFlag, "v", false, "Also print the progress of the run and a timing summary on stderr")
+	flag.StringVar(&formatFlag, "format", formatText, "Output format : text, table for aligned columns, or ndjson-metrics to stream the gauges as one JSON object per line, json or csv with -list-projects")
+	flag.StringVar(&colorFlag, "color", colorAuto, "Highlight the decreases and the low billable ratios of -format table : auto when printing to a terminal, always, never")
+	flag.Float64Var(&lowBillableFlag, "low-billable", 50, "Billable percentage under which -format table highlights the billable ratios")
+	flag.BoolVar(&listProjectsFlag, "list-projects", false, "Only list the projects a run would select, without fetching their entries nor invoices")
+	flag.BoolVar(&ndjsonSummaryFlag, "ndjson-summary", false, "End the ndjson-metrics stream with a line counting the gauges")
+	flag.StringVar(&configFlag, "config", "", "Configuration file (default ./"+configFileName+" or ~/.config/"+configFileName+")")
+	flag.BoolVar(&printConfigFlag, "print-config", false, "Print the effective configuration, without the secrets, and exit")
+	flag.StringVar(&apiFlag, "api", apiAuto, "API the data is fetched from : v1 the legacy Freckle API with $"+freckleTokenVarName+", v2 the Noko API with $"+nokoTokenVarName+", auto tries v2 first when $"+nokoTokenVarName+" is set")
+	flag.Var(&accountFlags, "account", "Account processed by the run as name=token, repeat it to process several accounts (default $"+accountsVarName+", a comma or space separated list of them)")
+	flag.StringVar(&inputFlag, "input", "", "Directory of a snapshot written by -dump the report is computed from, without calling the API")
+	flag.StringVar(&dumpFlag, "dump", "", "Directory the projects, entries and invoices fetched are written to, to replay the run later with -input")
+	flag.BoolVar(&libratoFlag, "librato", false, "Push metrics to librato")
+	flag.StringVar(&pushgatewayFlag, "pushgateway", "", "Prometheus Pushgateway URL the metrics are pushed to, e.g. http://localhost:9091")
+	flag.DurationVar(&libratoTimeoutFlag, "librato-timeout", 30*time.Second, "Abandon a post to librato which doesn't complete within this duration")
+	flag.IntVar(&libratoRetriesFlag, "librato-retries", 2, "Number of times a post to librato failing with a 5xx status or a timeout is retried, with an exponential backoff")
+	flag.BoolVar(&libratoTagsFlag, "librato-tags", false, "Post tagged measurements like freckle.billable_minutes to librato instead of the legacy gauges with sources")
+	flag.BoolVar(&postOnPartialFlag, "post-on-partial", false, "Push the metrics even when some projects couldn't be fetched, along with a FailedProjects gauge")
+	flag.BoolVar(&dryRunFlag, "dry-run", false, "Print the metrics that would be pushed to librato instead of pushing them")
+	flag.StringVar(&duplicateGaugesFlag, "duplicate-gauges", string(libratoexport.DuplicateMax), "Value kept for the gauges registered twice with differing values : max, sum")
+	flag.StringVar(&snapshotFlag, "dry-run-snapshot", "", "File keeping the metric names of the previous dry run, to count the new ones")
+	flag.StringVar(&slackWebhookFlag, "slack-webhook", "", "Slack incoming webhook URL the digest of the run is posted to (default $"+slackWebhookVarName+")")
+	flag.StringVar(&emailToFlag, "email-to", "", "Comma separated email addresses the report is sent to, through the $"+smtpHostVarName+" server")
+	flag.StringVar(&emailFromFlag, "email-from", "", "Sender address of the report email")
+	flag.StringVar(&emailSubjectFlag, "email-subject", defaultEmailSubject, "Template of the report email subject, {{.Period}} is the latest period and {{.Window}} the -since range")
+	flag.BoolVar(&emailDryRunFlag, "email-dry-run", false, "Print the report email instead of sending it")
+	flag.BoolVar(&includeArchivedFlag, "include-archived", false, "Also report the archived projects, the ones named as arguments are always reported")
+	flag.BoolVar(&byClientFlag, "by-client", false, "Also report and push the totals per client, i.e. per freckle project group")
+	flag.StringVar(&clientMapFlag, "client-map", "", "Clients of the projects without group, e.g. \"Acme=Acme Web,Acme Mobile;Globex=Globex Mobile\"")
+	flag.StringVar(&timeAggFlag, "period", "year", "Time periods you want to build the aggregation on : month, year, a comma separated list of them or all, the first one is compared and emailed")
+	flag.StringVar(&periodFormatFlag, "period-format", "", "Go time layout of the period labels printed and pushed as sources, e.g. \"Jan 2006\" (default 2006-01 or 2006)")
+	flag.StringVar(&dateBasisFlag, "date-basis", string(kpi.DateBasisWorked), "Date the entries are attributed to a period by : worked, invoiced")
+	flag.StringVar(&fromFlag, "from", "", "Only report the entries worked and the invoices dated since this date, e.g. 2016-01-01")
+	flag.StringVar(&sinceFlag, "since", "", "Only report the entries and invoices of this window relative to today : 7d, 12w, 6m, 1y (excludes -from)")
+	flag.StringVar(&billableFlag, "billable", string(kpi.BillableAll), "Only compute the KPIs from the entries : all, only the billable ones, or exclude the billable ones")
+	flag.StringVar(&compareFlag, "compare", "", "Print two periods of the -period side by side instead of the report, e.g. 2016-05,2016-06")
+	flag.BoolVar(&histogramFlag, "histogram", false, "Print and push the distribution of the entry durations of each project")
+	flag.StringVar(&histogramBucketFlag, "histogram-buckets", formatBounds(kpi.DefaultHistogramBounds), "Upper bounds in minutes of the buckets of the -histogram")
+	flag.BoolVar(&byWeekdayFlag, "by-weekday", false, "Print and push the billable and unbillable time of each project per day of the week")
+	flag.StringVar(&tzFlag, "tz", "", "Time zone the weekday of the entry timestamps is taken in, e.g. Europe/Paris (default the local time zone)")
+	flag.Var(capacityValue{&capacityFlag}, "capacity", "Hours a participant can work per month, e.g. 160h, to print and push the utilization of the participants per period")
+	flag.Var(capacityForValue{&capacityFlag}, "capacity-for", "Capacity of a participant overriding the -capacity, e.g. alice@example.com=80h for a part-timer, repeat it for each participant")
+	flag.BoolVar(&capacityPresentFlag, "capacity-present-months", false, "Scale the monthly capacity by the months of the period with entries instead of all its months, e.g. for the current year")
+	flag.BoolVar(&fillGapsFlag, "fill-gaps", false, "Print and push zero valued periods for the periods without invoices nor entries")
+	flag.StringVar(&participantKeyFlag, "participant-metric-key", string(libratoexport.ParticipantKeyEmail), "Identify the participants in the metric names by : name, email, id")
+	flag.BoolVar(&trendFlag, "trend", false, "Push the change versus the previous period to librato")
+	flag.StringVar(&sortFlag, "sort", "", "Sort the projects by : name, invoiced, billable, unbillable, rate (default API order)")
+	flag.BoolVar(&descFlag, "desc", false, "Sort the projects in descending order")
+	flag.StringVar(&durationFormatFlag, "duration-format", string(kpi.DurationHours), "Format of the printed durations : hours, hhmm or minutes, the metrics are always in minutes")
+	flag.StringVar(&precisionFlag, "precision", "1,2", "Decimals of the printed hours and amounts, e.g. 1,2, a single number applies to both")
+	flag.StringVar(&invoiceStatesFlag, "invoice-states", "", "Comma separated states of the invoices counted in the invoiced amounts, e.g. paid (default all but the cancelled and rejected ones)")
+	flag.StringVar(&currencyFlag, "currency", kpi.DefaultCurrency, "ISO 4217 code of the currency used for the invoices without one")
+	flag.DurationVar(&timeoutFlag, "timeout", 0, "Abandon the run after this duration, e.g. 10m (default no timeout)")
+	flag.Float64Var(&maxRPSFlag, "max-rps", 0, "Maximum number of requests per second sent to the Freckle API (default no limit)")
+	flag.DurationVar(&backoffFlag, "rate-limit-backoff", 60*time.Second, "Delay before retrying a rate limited request when the API doesn't specify one")
+	flag.BoolVar(&anonymizeFlag, "anonymize", false, "Replace the participants by pseudonyms like Person 01, numbered by descending time, in all the outputs and the metric names")
+	flag.StringVar(&anonymizeSaltFlag, "anonymize-salt", "", "Salt hashed with the participants into pseudonyms like Person 3fa2c1d0 which are stable across runs, implies -anonymize")
+	flag.BoolVar(&anonProjectsFlag, "anonymize-projects", false, "Also replace the project and client names by pseudonyms like Project 01, implies -anonymize")
+	flag.IntVar(&topFlag, "top", 0, "Only print the N participants with the most time, the others are summarized on one line (default all)")
 }
 
-// VerboseString prints detailed information for a Participant in the context of a project.
-func (p ParticipantKpi) VerboseString(prj ProjectKpi) string {
-	billablePercent := float64(p.BillableMinutes) / float64(prj.BillableMinutes) * 100
-	unbillablePercent := float64(p.UnbillableMinutes) / float64(prj.UnbillableMinutes) * 100
-	return fmt.Sprintf(
-		"%s Billable : %.1fh (%f %%) - Unbillable : %.1fh (%f %%)",
-		p.Email,
-		float64(p.BillableMinutes)/60, billablePercent,
-		float64(p.UnbillableMinutes)/60, unbillablePercent,
-	)
+// printConsoleReports prints the reports on the standard output in the layout of the -format,
+// nothing is printed in the ndjson-metrics one.
+func printConsoleReports(reports []AccountReport, f kpi.Formatter) {
+	switch formatFlag {
+	case formatText:
+		printReports(os.Stdout, reports, f)
+	case formatTable:
+		color := useColor(colorFlag, os.Stdout)
+		renderReports(os.Stdout, reports, f, func(w io.Writer, report Report) {
+			printTable(w, report, color, lowBillableFlag/100, f)
+		})
+	}
 }
 
-// RegisterMetrics regiters project metrics and update their value
-func (p ParticipantKpi) RegisterMetrics(m *librato.Metrics, prefix, source string) {
-	source = sanitizeMetricName(source)
+// printReport prints the report to w with the display settings of f.
+func printReport(w io.Writer, report Report, f kpi.Formatter) {
+	for _, project := range report.Projects {
+		// Print out the project information, the invoiced amounts are set apart from the filtered hours
+		if filter := kpi.BillableFilter(billableFlag); filter.IsActive() {
+			fmt.Fprintln(w, project.FilteredString(filter, f))
+		} else {
+			fmt.Fprintln(w, project.Format(f))
+		}
 
-	m.Gauges = append(m.Gauges,
-		librato.Gauge{
-			Name:   fmt.Sprintf("%s.UnbillableMinutes.%s-%s", prefix, p.FirstName, p.LastName),
-			Source: source,
-			Count:  1,
-			Sum:    float64(p.UnbillableMinutes),
-		})
+		// The truncation only applies to the console output, metrics cover every participant
+		topParticipants, otherParticipants := project.Participants.Split(topFlag)
+		for _, p := range topParticipants {
+			fmt.Fprintln(w, "\t", p.VerboseString(project.ProjectKpi, f))
+		}
+		if len(otherParticipants) > 0 {
+			fmt.Fprintln(w, "\t", otherParticipants.OthersString(f))
+		}
 
-	m.Gauges = append(m.Gauges,
-		librato.Gauge{
-			Name:   fmt.Sprintf("%s.BillableMinutes.%s-%s", prefix, p.FirstName, p.LastName),
-			Source: source,
-			Count:  1,
-			Sum:    float64(p.BillableMinutes),
-		})
-}
+		if project.Histogram != nil {
+			fmt.Fprintln(w, "\n\tentry durations")
+			for _, b := range project.Histogram.Buckets {
+				fmt.Fprintln(w, "\t\t", b.String())
+			}
+			if project.Histogram.Invalid.Count() > 0 {
+				fmt.Fprintln(w, "\t\t", project.Histogram.Invalid.String())
+			}
+		}
 
-// GetParticipantKpis calculates slice of ParticipantKpi based on a slice of Freckle Entry.
-func GetParticipantKpis(fes []freckle.Entry) ParticipantKpis {
-	participantsMap := make(map[int]ParticipantKpi)
-	var user freckle.Participant
-	for _, entry := range fes {
-		user = entry.User
-		pkpi, ok := participantsMap[user.Id]
-		if !ok {
-			pkpi = ParticipantKpi{user, 0, 0}
-		}
-		if entry.Billable {
-			pkpi.BillableMinutes += entry.Minutes
-		} else {
-			pkpi.UnbillableMinutes += entry.Minutes
+		if project.Weekdays != nil {
+			fmt.Fprintln(w, "\n\ttime per weekday")
+			for _, day := range kpi.Weekdays {
+				fmt.Fprintln(w, "\t\t", project.Weekdays.DayString(day, f))
+			}
 		}
-		participantsMap[user.Id] = pkpi
 
+		// Print out the per period information
+		for _, b := range project.Breakdowns {
+			fmt.Fprintf(w, "\n\tbreakdown per %s (%s date)\n", periodName(b.TimeAgg), dateBasisFlag)
+			for _, ppm := range b.Periods {
+				fmt.Fprintln(w, "\t\t", ppm.Format(f))
+				topParticipants, otherParticipants := kpi.ParticipantKpis(ppm.Participants).Split(topFlag)
+				// The utilization is only printed over all the projects, the time of one project is a share of the capacity
+				for _, participant := range topParticipants {
+					fmt.Fprintln(w, "\t\t\t", participant.Format(f))
+				}
+				if len(otherParticipants) > 0 {
+					fmt.Fprintln(w, "\t\t\t", otherParticipants.OthersString(f))
+				}
+			}
+		}
 	}
 
-	var pks ParticipantKpis
-	for _, v := range participantsMap {
-		pks = append(pks, v)
+	if len(report.Clients) > 0 {
+		fmt.Fprintln(w, "\nClients")
+	}
+	for _, client := range report.Clients {
+		fmt.Fprintln(w, client.Format(f))
+		topParticipants, otherParticipants := client.Participants.Split(topFlag)
+		for _, p := range topParticipants {
+			fmt.Fprintln(w, "\t", p.Format(f))
+		}
+		if len(otherParticipants) > 0 {
+			fmt.Fprintln(w, "\t", otherParticipants.OthersString(f))
+		}
 	}
-	sort.Sort(sort.Reverse(pks))
-	return pks
-}
-
-// ParticipantKpis is a type alias on which we are going to implement the methods required by the Sort interface.
-type ParticipantKpis []ParticipantKpi
-
-func (slice ParticipantKpis) Len() int {
-	return len(slice)
-}
 
-func (slice ParticipantKpis) Less(i, j int) bool {
-	return slice[i].BillableMinutes+slice[i].UnbillableMinutes < slice[j].BillableMinutes+slice[j].UnbillableMinutes
+	if len(report.Utilization) > 0 {
+		fmt.Fprintf(w, "\nUtilization per %s\n", periodName(report.Utilization[0].TimeAgg))
+	}
+	for _, up := range report.Utilization {
+		fmt.Fprintln(w, "\t", up.Label())
+		for _, p := range up.Participants {
+			if u, ok := participantUtilization(p, up.TimeAgg, up.Period, up.Months); ok {
+				fmt.Fprintln(w, "\t\t", p.DisplayName(), u.String())
+			}
+		}
+	}
 }
 
-func (slice ParticipantKpis) Swap(i, j int) {
-	slice[i], slice[j] = slice[j], slice[i]
+// reportParticipants returns the participants of all the projects of the report.
+func reportParticipants(report Report) []freckle.Participant {
+	var participants []freckle.Participant
+	for _, project := range report.Projects {
+		for _, p := range project.Participants {
+			participants = append(participants, p.Participant)
+		}
+	}
+	return participants
 }
 
-// TimeAggregater represents the set of method we need to extract information from time.Time
-type TimeAggregater interface {
-	GetInt(time.Time) (int, error)
-	GetPeriod(time.Time) time.Time
-	GetString(time.Time) string
+// logParticipantKeyTransition logs how the participant metric names differ from
+// the display name ones, to help moving the existing dashboards to the new names.
+func logParticipantKeyTransition(logger *Logger, report Report) {
+	key := libratoexport.ParticipantKey(participantKeyFlag)
+	if key == libratoexport.ParticipantKeyName {
+		return
+	}
+	participants := reportParticipants(report)
+	changes := libratoexport.NewParticipantNames(key, participants).Changes(
+		libratoexport.NewParticipantNames(libratoexport.ParticipantKeyName, participants))
+	if len(changes) == 0 {
+		return
+	}
+	logger.Infof("participant metric names are keyed by %s instead of name :", key)
+	for _, change := range changes {
+		logger.Infof("\t%s", change)
+	}
 }
 
-// MonthAgg reprents a monthly TimeAggregater
-type MonthAgg struct{}
+// registerMetrics registers the metrics of the report in the sink.
+func registerMetrics(metrics libratoexport.Sink, report Report) {
+	participants := reportParticipants(report)
+	names := libratoexport.NewParticipantNames(libratoexport.ParticipantKey(participantKeyFlag), participants)
 
-// GetInt returns the int composed by the Year and a double digit Month
-func (m MonthAgg) GetInt(t time.Time) (int, error) {
-	return strconv.Atoi(fmt.Sprintf("%d%02d", t.Year(), t.Month()))
-}
+	for _, project := range report.Projects {
+		libratoexport.RegisterProjectKpi(metrics, project.ProjectKpi)
+		if project.Histogram != nil {
+			libratoexport.RegisterHistogram(metrics, project.Name, *project.Histogram)
+		}
+		if project.Weekdays != nil {
+			libratoexport.RegisterWeekdays(metrics, project.Name, *project.Weekdays)
+		}
+		for _, p := range project.Participants {
+			libratoexport.RegisterParticipantKpi(
+				metrics,
+				names,
+				p,
+				fmt.Sprintf("%s.%s", libratoexport.BaseName, libratoexport.CatParticipants),
+				project.Name)
+		}
+		for _, b := range project.Breakdowns {
+			registerPeriodMetrics(metrics, periodCategory(b.TimeAgg), b.Periods)
+		}
+	}
 
-// GetString returns the string composed by the Year and a double digit Month separated by a `-`
-func (m MonthAgg) GetString(t time.Time) string {
-	return fmt.Sprintf("%d-%02d", t.Year(), t.Month())
-}
+	for _, client := range report.Clients {
+		libratoexport.RegisterClientKpi(metrics, client)
+	}
 
-// GetPeriod returns the time.Time truncated after the Year and Month
-func (m MonthAgg) GetPeriod(t time.Time) time.Time {
-	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for _, up := range report.Utilization {
+		for _, p := range up.Participants {
+			if u, ok := participantUtilization(p, up.TimeAgg, up.Period, up.Months); ok {
+				libratoexport.RegisterUtilization(metrics, names, p.Participant, up, u)
+			}
+		}
+	}
 }
 
-// YearAgg reprents a monthly TimeAggregater
-type YearAgg struct{}
+// periodAggs are the TimeAggregater of the -period names, allPeriods lists them in the order of -period all.
+var (
+	periodAggs = map[string]kpi.TimeAggregater{
+		"month": kpi.MonthAgg{},
+		"year":  kpi.YearAgg{},
+	}
+	allPeriods = []string{"month", "year"}
+)
 
-// GetInt returns the int composed by the Year
-func (y YearAgg) GetInt(t time.Time) (int, error) {
-	return strconv.Atoi(fmt.Sprintf("%d", t.Year()))
+// periodCategories are the categories of the gauges of the breakdown per -period name,
+// so the monthly and the yearly series never share a metric name.
+var periodCategories = map[string]string{
+	"month": libratoexport.CatMonthlyParticipants,
+	"year":  libratoexport.CatYearlyParticipants,
 }
 
-// GetString returns the string composed by the Year
-func (y YearAgg) GetString(t time.Time) string {
-	return fmt.Sprintf("%d", t.Year())
+// parsePeriods parses the comma separated -period names, all stands for allPeriods.
+// The names are returned in order without duplicates.
+func parsePeriods(value string) ([]string, error) {
+	var periods []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		names := []string{name}
+		if name == "all" {
+			names = allPeriods
+		} else if _, ok := periodAggs[name]; !ok {
+			return nil, fmt.Errorf("%s is not a valid choice. Time period options are : %s or all", name, strings.Join(allPeriods, ", "))
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				periods = append(periods, name)
+			}
+		}
+	}
+	return periods, nil
 }
 
-// GetPeriod returns the time.Time truncated after the Year
-func (y YearAgg) GetPeriod(t time.Time) time.Time {
-	return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+// periodName returns the -period name of tagg, e.g. month, whatever its -period-format.
+func periodName(tagg kpi.TimeAggregater) string {
+	if formatted, ok := tagg.(kpi.FormattedAgg); ok {
+		tagg = formatted.TimeAggregater
+	}
+	for name, agg := range periodAggs {
+		if agg == tagg {
+			return name
+		}
+	}
+	return ""
 }
 
-// InvoicePeriodKpi is used to aggregate invoice information on a period
-type InvoicePeriodKpi struct {
-	TimeAgg TimeAggregater
-	Period  time.Time
-	Amount  float64
+// periodCategory returns the category of the gauges of the breakdown per period of tagg.
+func periodCategory(tagg kpi.TimeAggregater) string {
+	return periodCategories[periodName(tagg)]
 }
 
-func (ik InvoicePeriodKpi) String() string {
-	return fmt.Sprintf("%s $%.2f invoiced", ik.TimeAgg.GetString(ik.Period), ik.Amount)
+// registerPeriodMetrics registers the breakdown per period of a project under the category,
+// along with the change versus the previous period with -trend.
+func registerPeriodMetrics(metrics libratoexport.Sink, category string, periods []kpi.ProjectPeriodKpi) {
+	for _, ppm := range periods {
+		libratoexport.RegisterProjectPeriodKpi(
+			metrics,
+			ppm,
+			fmt.Sprintf("%s.%s", libratoexport.BaseName, category))
+		if trendFlag {
+			libratoexport.RegisterProjectPeriodTrend(
+				metrics,
+				ppm,
+				fmt.Sprintf("%s.%s", libratoexport.BaseName, libratoexport.CatTrend))
+		}
+	}
 }
 
-// GetInvoiceKpiPerPeriod calculates a slice of InvoicePeriodKpi based on a slice of freckle invoice.
-func GetInvoiceKpiPerPeriod(tagg TimeAggregater, fis []freckle.Invoice) ([]InvoicePeriodKpi, error) {
-	agrregateInvoices := make(map[int]InvoicePeriodKpi)
-	var keys []int
-	var key int
-	for _, invoice := range fis {
-		t, err := time.Parse("2006-01-02", invoice.InvoiceDate)
+// parseBounds parses the comma separated -histogram-buckets, the bounds must be positive and increasing.
+func parseBounds(value string) ([]int, error) {
+	var bounds []int
+	for _, s := range strings.Split(value, ",") {
+		bound, err := strconv.Atoi(strings.TrimSpace(s))
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%q is not a number of minutes", s)
 		}
-		key, err = tagg.GetInt(t)
-		if err != nil {
-			return nil, err
+		if bound <= 0 || (len(bounds) > 0 && bound <= bounds[len(bounds)-1]) {
+			return nil, fmt.Errorf("the bounds must be positive and increasing, %d is not", bound)
 		}
+		bounds = append(bounds, bound)
+	}
+	return bounds, nil
+}
 
-		ik, ok := agrregateInvoices[key]
-		if !ok {
-			keys = append(keys, key)
+// parsePrecision parses the -precision value, the decimals of the hours and of the amounts separated by a
+// comma, or a single number for both.
+func parsePrecision(value string) (hours, amounts int, err error) {
+	parts := strings.Split(value, ",")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("%q is not a pair of decimals, e.g. 1,2", value)
+	}
+	var decimals []int
+	for _, s := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 0 || n > 6 {
+			return 0, 0, fmt.Errorf("%q is not a number of decimals between 0 and 6", s)
 		}
-		ik.Period = tagg.GetPeriod(t)
-		ik.Amount += invoice.TotalAmount
-		ik.TimeAgg = tagg
-
-		agrregateInvoices[key] = ik
+		decimals = append(decimals, n)
 	}
-	sort.Ints(keys)
-
-	var sik []InvoicePeriodKpi
-	for _, v := range keys {
-		sik = append(sik, agrregateInvoices[v])
+	if len(decimals) == 1 {
+		return decimals[0], decimals[0], nil
 	}
-	return sik, nil
+	return decimals[0], decimals[1], nil
 }
 
-// GetInvoiceKpiPerMonth calculates a slice of InvoicePeriodKpi based on a slice of freckle invoice.
-func GetInvoiceKpiPerMonth(fis []freckle.Invoice) ([]InvoicePeriodKpi, error) {
-	return GetInvoiceKpiPerPeriod(MonthAgg{}, fis)
+// formatBounds formats the bounds as a -histogram-buckets value.
+func formatBounds(bounds []int) string {
+	s := make([]string, len(bounds))
+	for i, bound := range bounds {
+		s[i] = strconv.Itoa(bound)
+	}
+	return strings.Join(s, ",")
 }
 
-// GetInvoiceKpiPerYear calculates a slice of InvoicePeriodKpi based on a slice of freckle invoice.
-func GetInvoiceKpiPerYear(fis []freckle.Invoice) ([]InvoicePeriodKpi, error) {
-	return GetInvoiceKpiPerPeriod(YearAgg{}, fis)
+// parseClientMap parses the -client-map value, clients are separated by a ';' and the projects
+// of a client by a ','. It returns the client of each project name.
+func parseClientMap(value string) (map[string]string, error) {
+	clientMap := make(map[string]string)
+	for _, mapping := range strings.Split(value, ";") {
+		if strings.TrimSpace(mapping) == "" {
+			continue
+		}
+		parts := strings.SplitN(mapping, "=", 2)
+		client := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || client == "" {
+			return nil, fmt.Errorf("%q is not a valid client mapping, e.g. Acme=Acme Web,Acme Mobile", mapping)
+		}
+		for _, project := range strings.Split(parts[1], ",") {
+			if project = strings.TrimSpace(project); project != "" {
+				clientMap[project] = client
+			}
+		}
+	}
+	return clientMap, nil
 }
 
-// ParticipantsPeriod is used to aggregate a list of ParticipantKpi over a period.
-type ParticipantsPeriod struct {
-	TimeAgg      TimeAggregater
-	Period       time.Time
-	Participants ParticipantKpis
-}
+func main() {
+	flag.Usage = Usage
+	flag.Parse()
 
-// GetParticipantsPeriodPerPeriod Builds a slice of ParticipantsPeriod over the period of the given freckle entries.
-func GetParticipantsPeriodPerPeriod(tagg TimeAggregater, fes []freckle.Entry) ([]ParticipantsPeriod, error) {
-	dedupParticipants := make(map[int]ParticipantsPeriod)
-	var keys []int
-	var key int
-	for _, entry := range fes {
-		// TODO: shall we use entry.invoiceAt
-		t, err := time.Parse("2006-01-02", entry.Date)
+	if quietFlag && verboseFlag {
+		fmt.Fprintln(os.Stderr, "-quiet and -v are mutually exclusive")
+		os.Exit(exitCodeNotOk)
+	}
+	// Diagnostics go to stderr so stdout only carries the report
+	level := LogLevelDefault
+	if quietFlag {
+		level = LogLevelQuiet
+	} else if verboseFlag {
+		level = LogLevelVerbose
+	}
+	logger := NewLogger(os.Stderr, level)
+	start := time.Now()
+
+	// Settings are taken from the flags, then the environment variables, then the configuration file
+	var cfg Config
+	configPath := configFlag
+	if configPath == "" {
+		configPath = defaultConfigPath()
+	}
+	if configPath != "" {
+		var unknown []string
+		var err error
+		cfg, unknown, err = loadConfig(configPath)
 		if err != nil {
-			return nil, err
+			logger.Errorf("an error occurred while reading the configuration file: %v", err)
+			os.Exit(exitCodeNotOk)
 		}
-		key, err = tagg.GetInt(t)
-		if err != nil {
-			return nil, err
+		for _, key := range unknown {
+			logger.Warnf("unknown key %q in %s", key, configPath)
 		}
-
-		pk, ok := dedupParticipants[key]
-		if !ok {
-			keys = append(keys, key)
+	}
+	explicit := explicitFlags()
+	if !explicit["period"] && cfg.Period != "" {
+		timeAggFlag = cfg.Period
+	}
+	if !explicit["librato"] && cfg.hasSink(sinkLibrato) {
+		libratoFlag = true
+	}
+	if !explicit["dry-run"] && cfg.hasSink(sinkDryRun) {
+		dryRunFlag = true
+	}
+	projectNames := flag.Args()
+	if len(projectNames) == 0 {
+		projectNames = cfg.Projects
+	}
+	freckleAppToken := firstNonEmpty(os.Getenv(freckleTokenVarName), cfg.FreckleToken)
+	libratoAccount := firstNonEmpty(os.Getenv(libratoAccountVarName), cfg.LibratoAccount)
+	libratoToken := firstNonEmpty(os.Getenv(libratoTokenVarName), cfg.LibratoToken)
+
+	if printConfigFlag {
+		effective := Config{
+			FreckleToken:   freckleAppToken,
+			LibratoAccount: libratoAccount,
+			LibratoToken:   libratoToken,
+			Period:         timeAggFlag,
+			Projects:       projectNames,
 		}
-		pk.Period = tagg.GetPeriod(t)
-		pk.TimeAgg = tagg
-
-		// Check if the ParticipantKpi already exist in the slice
-		foundFlag := false
-		for i, p := range pk.Participants {
-			if p.Id == entry.User.Id {
-				if entry.Billable {
-					p.BillableMinutes += entry.Minutes
-				} else {
-					p.UnbillableMinutes += entry.Minutes
-				}
-				pk.Participants[i] = p
-				foundFlag = true
-				break
-			}
+		if libratoFlag {
+			effective.Sinks = append(effective.Sinks, sinkLibrato)
 		}
-		if !foundFlag {
-			var billableMinutes, unbillableMinutes int
-			if entry.Billable {
-				billableMinutes = entry.Minutes
-			} else {
-				unbillableMinutes = entry.Minutes
-			}
-			pk.Participants = append(pk.Participants, ParticipantKpi{entry.User, billableMinutes, unbillableMinutes})
+		if dryRunFlag {
+			effective.Sinks = append(effective.Sinks, sinkDryRun)
+		}
+		if configPath != "" {
+			fmt.Println("# configuration file:", configPath)
 		}
-		dedupParticipants[key] = pk
+		fmt.Print(effective.Redacted())
+		return
 	}
 
-	var participants []ParticipantsPeriod
-	for _, v := range dedupParticipants {
-		sort.Sort(sort.Reverse(v.Participants))
-		participants = append(participants, v)
+	nokoToken := os.Getenv(nokoTokenVarName)
+	if !IsValidAPI(apiFlag) {
+		logger.Errorf("%s is not a valid choice. API options are : auto, v1 or v2", apiFlag)
+		os.Exit(exitCodeNotOk)
 	}
-	return participants, nil
-}
-
-// GetParticipantsPeriodPerMonth Builds a slice of ParticipantsPeriod over months for the given freckle entries.
-func GetParticipantsPeriodPerMonth(fes []freckle.Entry) ([]ParticipantsPeriod, error) {
-	return GetParticipantsPeriodPerPeriod(MonthAgg{}, fes)
-}
-
-// GetParticipantsPeriodPerYear Builds a slice of ParticipantsPeriod over years for the given freckle entries.
-func GetParticipantsPeriodPerYear(fes []freckle.Entry) ([]ParticipantsPeriod, error) {
-	return GetParticipantsPeriodPerPeriod(YearAgg{}, fes)
-}
-
-// ProjectKpi is a freckle project enriched with the related entries
-type ProjectKpi struct {
-	freckle.Project
-	DetailedEntries []freckle.Entry
-}
-
-// GetInvoicedTotal return the grand total of amount invoiced
-func (pi *ProjectKpi) GetInvoicedTotal() float64 {
-	invoicedAmount := 0.0
-	for _, invoice := range pi.Invoices {
-		invoicedAmount += invoice.TotalAmount
+	accounts := []Account(accountFlags)
+	if len(accounts) == 0 {
+		var err error
+		if accounts, err = parseAccounts(os.Getenv(accountsVarName)); err != nil {
+			logger.Errorf("invalid %s : %v", accountsVarName, err)
+			os.Exit(exitCodeNotOk)
+		}
+	}
+	if inputFlag != "" && dumpFlag != "" {
+		logger.Errorf("-dump can't be combined with -input")
+		os.Exit(exitCodeNotOk)
+	}
+	// The offline snapshot needs no token
+	if len(accounts) == 0 && inputFlag != "" {
+		accounts = []Account{{}}
+	}
+	if len(accounts) == 0 {
+		if freckleAppToken == "" && apiFlag == apiV1 {
+			logger.Errorf("%s environment variable is not set", freckleTokenVarName)
+			os.Exit(exitCodeNotOk)
+		}
+		if freckleAppToken == "" && nokoToken == "" {
+			logger.Errorf("%s or %s environment variable is not set", freckleTokenVarName, nokoTokenVarName)
+			os.Exit(exitCodeNotOk)
+		}
+		accounts = []Account{{}}
 	}
-	return invoicedAmount
-}
-
-func (pi ProjectKpi) String() string {
-	invoiced := pi.GetInvoicedTotal()
-	billableHours := float64(pi.BillableMinutes) / 60
-	hourlyRate := invoiced / billableHours
-	invoicedHours := float64(pi.InvoicedMinutes) / 60
-	invoicedHourlyRate := invoiced / invoicedHours
-	return fmt.Sprintf(
-		"%s total invoiced : $%.2f, %.1fh (%.1f$/h) - Billable : %.1fh (%.1f$/h) - Unbillable : %.1fh",
-		pi.Name,
-		invoiced, invoicedHours, invoicedHourlyRate,
-		billableHours, hourlyRate,
-		float64(pi.UnbillableMinutes)/60)
-}
 
-// RegisterMetrics registers project metrics and set their value
-func (pi ProjectKpi) RegisterMetrics(m *librato.Metrics) {
-	prjName := sanitizeMetricName(pi.Name)
+	// The periods are validated before any request, the first one is the main breakdown
+	periods, err := parsePeriods(timeAggFlag)
+	if err != nil {
+		logger.Errorf("invalid -period : %v", err)
+		os.Exit(exitCodeNotOk)
+	}
+	timeAgg := periodAggs[periods[0]]
+	var moreTimeAggs []kpi.TimeAggregater
+	for _, name := range periods[1:] {
+		moreTimeAggs = append(moreTimeAggs, periodAggs[name])
+	}
 
-	m.Gauges = append(m.Gauges,
-		librato.Gauge{
-			Name:   fmt.Sprintf("%s.%s.UnbillableMinutes", libratoBaseName, libratoCatProjects),
-			Source: prjName,
-			Count:  1,
-			Sum:    float64(pi.UnbillableMinutes),
-		})
+	var compareA, compareB time.Time
+	if compareFlag != "" {
+		var err error
+		compareA, compareB, err = parseCompare(compareFlag, timeAgg)
+		if err != nil {
+			logger.Errorf("invalid -compare for the %s period : %v", periods[0], err)
+			os.Exit(exitCodeNotOk)
+		}
+	}
 
-	m.Gauges = append(m.Gauges,
-		librato.Gauge{
-			Name:   fmt.Sprintf("%s.%s.BillableMinutes", libratoBaseName, libratoCatProjects),
-			Source: prjName,
-			Count:  1,
-			Sum:    float64(pi.BillableMinutes),
-		})
+	// The -compare periods are parsed above with the default labels, whatever the -period-format
+	if periodFormatFlag != "" {
+		if len(periods) > 1 {
+			logger.Errorf("-period-format only applies to a single -period")
+			os.Exit(exitCodeNotOk)
+		}
+		formatted, err := kpi.NewFormattedAgg(timeAgg, periodFormatFlag)
+		if err != nil {
+			logger.Errorf("invalid -period-format : %v", err)
+			os.Exit(exitCodeNotOk)
+		}
+		timeAgg = formatted
+	}
 
-	m.Gauges = append(m.Gauges,
-		librato.Gauge{
-			Name:   fmt.Sprintf("%s.%s.InvoicedMinutes", libratoBaseName, libratoCatProjects),
-			Source: prjName,
-			Count:  1,
-			Sum:    float64(pi.InvoicedMinutes),
-		})
+	switch formatFlag {
+	case formatText:
+	case formatTable:
+		if listProjectsFlag {
+			logger.Errorf("-format %s can't be combined with -list-projects", formatFlag)
+			os.Exit(exitCodeNotOk)
+		}
+	case formatJSON, formatCSV:
+		if !listProjectsFlag {
+			logger.Errorf("-format %s is only available with -list-projects", formatFlag)
+			os.Exit(exitCodeNotOk)
+		}
+	case formatNDJSONMetrics:
+		if listProjectsFlag {
+			logger.Errorf("-format %s can't be combined with -list-projects", formatFlag)
+			os.Exit(exitCodeNotOk)
+		}
+		// The standard output only carries the stream of gauges
+		if dryRunFlag || emailDryRunFlag || compareFlag != "" {
+			logger.Errorf("-format %s can't be combined with -dry-run, -email-dry-run nor -compare", formatFlag)
+			os.Exit(exitCodeNotOk)
+		}
+	default:
+		logger.Errorf("%s is not a valid choice. Format options are : text, table, ndjson-metrics, json or csv", formatFlag)
+		os.Exit(exitCodeNotOk)
+	}
+	if !IsValidColor(colorFlag) {
+		logger.Errorf("%s is not a valid choice. Color options are : auto, always, never", colorFlag)
+		os.Exit(exitCodeNotOk)
+	}
+	if anonymizeSaltFlag != "" || anonProjectsFlag {
+		anonymizeFlag = true
+	}
 
-	m.Gauges = append(m.Gauges,
-		librato.Gauge{
-			Name:   fmt.Sprintf("%s.%s.InvoicedAmount", libratoBaseName, libratoCatProjects),
-			Source: prjName,
-			Count:  1,
-			Sum:    float64(pi.GetInvoicedTotal()),
-		})
-}
+	if emailToFlag != "" && emailFromFlag == "" {
+		logger.Errorf("-email-from is required to send the report by email")
+		os.Exit(exitCodeNotOk)
+	}
+	if emailToFlag != "" && !emailDryRunFlag && !dryRunFlag && os.Getenv(smtpHostVarName) == "" {
+		logger.Errorf("%s environment variable is not set", smtpHostVarName)
+		os.Exit(exitCodeNotOk)
+	}
 
-// ProjectPeriodKpi represents the project information for a period.
-type ProjectPeriodKpi struct {
-	Name         string
-	TimeAgg      TimeAggregater
-	Period       time.Time
-	Invoice      InvoicePeriodKpi
-	Participants []ParticipantKpi
-}
+	if sortFlag != "" && !kpi.IsValidSortKey(sortFlag) {
+		logger.Errorf("%s is not a valid choice. Sort options are : name, invoiced, billable, unbillable or rate", sortFlag)
+		os.Exit(exitCodeNotOk)
+	}
 
-func (pp ProjectPeriodKpi) String() string {
-	return fmt.Sprintf("%s $%.2f invoiced", pp.TimeAgg.GetString(pp.Period), pp.Invoice.Amount)
-}
+	if !libratoexport.IsValidParticipantKey(libratoexport.ParticipantKey(participantKeyFlag)) {
+		logger.Errorf("%s is not a valid choice. Participant metric key options are : name, email or id", participantKeyFlag)
+		os.Exit(exitCodeNotOk)
+	}
 
-// RegisterMetrics registers project metrics and update their value
-func (pp ProjectPeriodKpi) RegisterMetrics(m *librato.Metrics, prefix string) {
-	prjName := sanitizeMetricName(pp.Name)
-	source := pp.TimeAgg.GetString(pp.Period)
-
-	m.Gauges = append(m.Gauges,
-		librato.Gauge{
-			Name:   fmt.Sprintf("%s.InvoicedAmount.%s", prefix, prjName),
-			Source: source,
-			Count:  1,
-			Sum:    float64(pp.Invoice.Amount),
-		})
+	if !libratoexport.IsValidDuplicatePolicy(libratoexport.DuplicatePolicy(duplicateGaugesFlag)) {
+		logger.Errorf("%s is not a valid choice. Duplicate gauges options are : max or sum", duplicateGaugesFlag)
+		os.Exit(exitCodeNotOk)
+	}
 
-	var billableMin int
-	var unbillableMin int
-	for _, p := range pp.Participants {
-		billableMin += p.BillableMinutes
-		unbillableMin += p.UnbillableMinutes
-	}
-	m.Gauges = append(m.Gauges,
-		librato.Gauge{
-			Name:   fmt.Sprintf("%s.UnbillableMinutes.%s", prefix, prjName),
-			Source: source,
-			Count:  1,
-			Sum:    float64(unbillableMin),
-		})
+	if !kpi.IsValidDurationFormat(kpi.DurationFormat(durationFormatFlag)) {
+		logger.Errorf("%s is not a valid choice. Duration format options are : hours, hhmm or minutes", durationFormatFlag)
+		os.Exit(exitCodeNotOk)
+	}
+	hoursPrecision, amountPrecision, err := parsePrecision(precisionFlag)
+	if err != nil {
+		logger.Errorf("invalid -precision : %v", err)
+		os.Exit(exitCodeNotOk)
+	}
+	formatter := kpi.Formatter{
+		Durations:       kpi.DurationFormat(durationFormatFlag),
+		HoursPrecision:  hoursPrecision,
+		AmountPrecision: amountPrecision,
+		Currency:        currencyFlag,
+	}
+	invoiceOpts := kpi.InvoiceOptions{Currency: currencyFlag}
+	if invoiceStatesFlag != "" {
+		invoiceOpts.CountedStates, err = kpi.ParseInvoiceStates(invoiceStatesFlag)
+		if err != nil {
+			logger.Errorf("invalid -invoice-states : %v", err)
+			os.Exit(exitCodeNotOk)
+		}
+	}
 
-	m.Gauges = append(m.Gauges,
-		librato.Gauge{
-			Name:   fmt.Sprintf("%s.BillableMinutes.%s", prefix, prjName),
-			Source: source,
-			Count:  1,
-			Sum:    float64(billableMin),
-		})
-}
+	if !kpi.IsValidBillableFilter(kpi.BillableFilter(billableFlag)) {
+		logger.Errorf("%s is not a valid choice. Billable options are : only, exclude or all", billableFlag)
+		os.Exit(exitCodeNotOk)
+	}
 
-// GetProjectKpiPerPeriod returns the slice of ProjectPeriodKpi.
-func GetProjectKpiPerPeriod(tagg TimeAggregater, p ProjectKpi) ([]ProjectPeriodKpi, error) {
-	invoiceAmonthPerPeriod, err := GetInvoiceKpiPerPeriod(tagg, p.Invoices)
-	if err != nil {
-		return nil, err
+	switch kpi.DateBasis(dateBasisFlag) {
+	case kpi.DateBasisWorked, kpi.DateBasisInvoiced:
+	default:
+		logger.Errorf("%s is not a valid choice. Date basis options are : worked or invoiced", dateBasisFlag)
+		os.Exit(exitCodeNotOk)
 	}
 
-	participantKpiPerPeriod, err := GetParticipantsPeriodPerPeriod(tagg, p.DetailedEntries)
+	clientMap, err := parseClientMap(clientMapFlag)
 	if err != nil {
-		return nil, err
+		logger.Errorf("invalid -client-map : %v", err)
+		os.Exit(exitCodeNotOk)
 	}
 
-	mapProjectKpiPerMonth := make(map[int]ProjectPeriodKpi)
-	var keys []int
-	var key int
-
-	// Acummulates the invoices for the ProjectKpi per period
-	for _, invoice := range invoiceAmonthPerPeriod {
-		key, err = invoice.TimeAgg.GetInt(invoice.Period)
+	var histogramBounds []int
+	if histogramFlag {
+		histogramBounds, err = parseBounds(histogramBucketFlag)
 		if err != nil {
-			return nil, err
-		}
-		ppm, ok := mapProjectKpiPerMonth[key]
-		if !ok {
-			keys = append(keys, key)
+			logger.Errorf("invalid -histogram-buckets : %v", err)
+			os.Exit(exitCodeNotOk)
 		}
-		ppm.Name = p.Name
-		ppm.TimeAgg = tagg
-		ppm.Period = invoice.Period
-		ppm.Invoice = invoice
-		mapProjectKpiPerMonth[key] = ppm
 	}
 
-	// Accumulates the particpants for the ProjectKpi per period
-	for _, participants := range participantKpiPerPeriod {
-		key, err = participants.TimeAgg.GetInt(participants.Period)
+	loc := time.Local
+	if tzFlag != "" {
+		loc, err = time.LoadLocation(tzFlag)
 		if err != nil {
-			return nil, err
-		}
-		ppm, ok := mapProjectKpiPerMonth[key]
-		if !ok {
-			keys = append(keys, key)
+			logger.Errorf("invalid -tz : %v", err)
+			os.Exit(exitCodeNotOk)
 		}
-		ppm.Name = p.Name
-		ppm.TimeAgg = tagg
-		ppm.Period = participants.Period
-		ppm.Participants = participants.Participants
-		mapProjectKpiPerMonth[key] = ppm
 	}
-
-	// returns the sorted slice of ProjectPeriodKpi
-	sort.Ints(keys)
-	var projectsPeriod []ProjectPeriodKpi
-	for _, v := range keys {
-		projectsPeriod = append(projectsPeriod, mapProjectKpiPerMonth[v])
+	var weekdayLoc *time.Location
+	if byWeekdayFlag {
+		weekdayLoc = loc
 	}
-	return projectsPeriod, nil
-}
-
-// GetProjectKpiPerMonth returns the slice of ProjectPeriodKpi.
-func GetProjectKpiPerMonth(p ProjectKpi) ([]ProjectPeriodKpi, error) {
-	return GetProjectKpiPerPeriod(MonthAgg{}, p)
-}
-
-// GetProjectKpiPerYear returns the slice of ProjectPeriodKpi.
-func GetProjectKpiPerYear(p ProjectKpi) ([]ProjectPeriodKpi, error) {
-	return GetProjectKpiPerPeriod(YearAgg{}, p)
-}
 
-var (
-	libratoFlag bool
-	timeAggFlag string
-	Usage       = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Options :\n")
-		flag.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nExample:\n")
-		fmt.Fprintf(os.Stderr, "  You can restict the extraction to a project list\n")
-		fmt.Fprintf(os.Stderr, "  %s -period=month \"foo project\" \"bar project\"\n", os.Args[0])
-	}
-)
-
-func init() {
-	flag.BoolVar(&libratoFlag, "librato", false, "Push metrics to librato")
-	flag.StringVar(&timeAggFlag, "period", "year", "Time period you want to build the aggregation on : month, year")
-}
-
-func main() {
-	flag.Usage = Usage
-	flag.Parse()
-	// Grab Freckle app token from the environment
-	freckleAppToken := os.Getenv(freckleTokenVarName)
-	if freckleAppToken == "" {
-		fmt.Println(freckleTokenVarName, "environment variable is not set")
+	now := time.Now()
+	from, err := parseWindow(fromFlag, sinceFlag, now)
+	if err != nil {
+		logger.Errorf("invalid report window : %v", err)
 		os.Exit(exitCodeNotOk)
 	}
+	var window string
+	if !from.IsZero() {
+		window = fmt.Sprintf("%s to %s", from.Format("2006-01-02"), now.Format("2006-01-02"))
+		if (formatFlag == formatText || formatFlag == formatTable) && !listProjectsFlag {
+			fmt.Printf("Report from %s\n\n", window)
+		}
+	}
+	slackWebhook := firstNonEmpty(slackWebhookFlag, os.Getenv(slackWebhookVarName))
 
-	f := freckle.LetsFreckle(freckleAppName, freckleAppToken)
-	//f.Debug(true)
+	transport := newRateLimitTransport(http.DefaultTransport, maxRPSFlag, backoffFlag, logger)
+	client := &http.Client{Transport: transport}
 
-	libratoAccount := os.Getenv(libratoAccountVarName)
-	libratoToken := os.Getenv(libratoTokenVarName)
 	metrics := &librato.Metrics{
 		Counters: []librato.Metric{},
 		Gauges:   []interface{}{},
 	}
 
-	var projects []ProjectKpi
-
-	projectsPage, err := f.ProjectsAPI().ListProjects(
-		func(p freckle.Parameters) {})
-	if err != nil {
-		fmt.Println("An error occurred while getting the project list:\n\t", err)
+	// The run is abandoned when the timeout expires or on SIGINT/SIGTERM
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeoutFlag > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeoutFlag)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	// dataSource returns the DataSource of the account, the unnamed one uses the legacy token variables
+	dataSource := func(account Account) (DataSource, error) {
+		if inputFlag != "" {
+			dir := accountDir(inputFlag, account)
+			logger.Debugf("%sreading the data from %s", account.logPrefix(), dir)
+			return NewDirDataSource(dir), nil
+		}
+		freckleToken, nokoToken := freckleAppToken, nokoToken
+		if account.Name != "" {
+			freckleToken, nokoToken = account.Token, account.Token
+		}
+		ds, api, err := newDataSource(ctx, apiFlag, client, freckleToken, nokoToken, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debugf("%sfetching the data from the %s API", account.logPrefix(), api)
+		if dumpFlag != "" {
+			return newDumpDataSource(ds, accountDir(dumpFlag, account))
+		}
+		return ds, nil
 	}
 
-	projectNames := flag.Args()
-	stopWhenZero := len(projectNames)
-
-	for project := range projectsPage.AllProjects() {
-		if len(projectNames) > 0 && stopWhenZero > 0 {
-			isInProjectList := false
-			for _, name := range projectNames {
-				if name == project.Name {
-					stopWhenZero--
-					isInProjectList = true
-				}
+	// The accounts are processed in turn, a failing account doesn't prevent reporting the others
+	if listProjectsFlag {
+		var listed []listedProject
+		var failed int
+		for _, account := range accounts {
+			ds, err := dataSource(account)
+			if err != nil {
+				logger.Errorf("%s%v", account.logPrefix(), err)
+				failed++
+				continue
 			}
-			if !isInProjectList {
+			projects, skipped, err := ListProjects(ctx, ds, Options{
+				ProjectNames:    projectNames,
+				IncludeArchived: includeArchivedFlag,
+				SortKey:         sortFlag,
+				Desc:            descFlag,
+			})
+			if err != nil {
+				logger.Errorf("%san error occured while listing the projects: %v", account.logPrefix(), err)
+				failed++
 				continue
 			}
-		} else if len(projectNames) > 0 && stopWhenZero == 0 {
-			break
+			if skipped > 0 {
+				logger.Infof("%s%d archived projects skipped, use -include-archived to list them", account.logPrefix(), skipped)
+			}
+			listed = append(listed, newListedProjects(account.Name, projects)...)
 		}
-
-		var entries []freckle.Entry
-		entriesPage, err := f.ProjectsAPI().GetEntries(project.Id)
-		if err != nil {
-			log.Fatal(err)
+		if failed == len(accounts) {
+			os.Exit(exitCodeNotOk)
 		}
-		for entry := range entriesPage.AllEntries() {
-			entries = append(entries, entry)
+		if anonProjectsFlag {
+			listed = anonymizeListedProjects(listed, anonymizeSaltFlag)
 		}
-
-		projectKpi := ProjectKpi{project, entries}
-		projects = append(projects, projectKpi)
+		if err := writeProjectList(os.Stdout, listed, formatFlag, formatter); err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(exitCodeNotOk)
+		}
+		if failed > 0 {
+			os.Exit(exitCodeNotOk)
+		}
+		return
 	}
 
-	for _, project := range projects {
-		// Print out the project information
-		fmt.Println(project.String())
-		project.RegisterMetrics(metrics)
-
-		for _, p := range GetParticipantKpis(project.DetailedEntries) {
-			fmt.Println("\t", p.VerboseString(project))
-			p.RegisterMetrics(
-				metrics,
-				fmt.Sprintf("%s.%s", libratoBaseName, libratoCatParticipants),
-				project.Name)
+	var reports []AccountReport
+	var runErrs []error
+	exitCode := exitCodeOk
+	for _, account := range accounts {
+		ds, err := dataSource(account)
+		if err != nil {
+			logger.Errorf("%s%v", account.logPrefix(), err)
+			runErrs = append(runErrs, fmt.Errorf("%s%v", account.logPrefix(), err))
+			exitCode = exitCodeNotOk
+			continue
 		}
-
-		switch timeAggFlag {
-		case "month":
-			projectKpiPerPeriod, err := GetProjectKpiPerMonth(project)
-			if err != nil {
-				log.Fatal(err)
+		report, err := Run(ctx, ds, Options{
+			ProjectNames:    projectNames,
+			IncludeArchived: includeArchivedFlag,
+			SortKey:         sortFlag,
+			Desc:            descFlag,
+			From:            from,
+			Billable:        kpi.BillableFilter(billableFlag),
+			TimeAgg:         timeAgg,
+			MoreTimeAggs:    moreTimeAggs,
+			PeriodOptions:   kpi.PeriodOptions{DateBasis: kpi.DateBasis(dateBasisFlag), FillGaps: fillGapsFlag},
+			InvoiceOptions:  invoiceOpts,
+			ByClient:        byClientFlag,
+			ClientMap:       clientMap,
+			HistogramBounds: histogramBounds,
+			WeekdayLocation: weekdayLoc,
+			Utilization:     capacityFlag.IsSet(),
+			Logger:          logger,
+		})
+		if report.SkippedArchived > 0 {
+			logger.Infof("%s%d archived projects skipped, use -include-archived to report them", account.logPrefix(), report.SkippedArchived)
+		}
+		if err != nil && ctx.Err() != nil {
+			// Print a clean partial summary of the projects completed before the interruption
+			reports = append(reports, AccountReport{Account: account.Name, Report: report})
+			reports = anonymizeReports(reports)
+			report := mergeReports(reports)
+			printConsoleReports(reports, formatter)
+			logger.Errorf("the run was abandoned: %v", err)
+			logger.Errorf("projects completed before the interruption :")
+			for _, project := range report.Projects {
+				logger.Errorf("\t%s", project.Name)
 			}
-
-			// Print out the per month information
-			fmt.Println("\n\tbreakdown per month")
-			for _, ppm := range projectKpiPerPeriod {
-				fmt.Println("\t\t", ppm.String())
-				for _, participant := range ppm.Participants {
-					fmt.Println("\t\t\t", participant.String())
-				}
+			if !dryRunFlag && compareFlag == "" {
+				notifySlack(logger, slackWebhook, report, window, append(runErrs, fmt.Errorf("the run was abandoned: %v", err)), formatter)
 			}
-		case "year":
+			exit(logger, report, start, transport)
+		} else if err != nil {
+			logger.Errorf("%s%v", account.logPrefix(), err)
+			runErrs = append(runErrs, fmt.Errorf("%s%v", account.logPrefix(), err))
+			exitCode = exitCodeNotOk
+			continue
+		}
+		reports = append(reports, AccountReport{Account: account.Name, Report: report})
+	}
+	reports = anonymizeReports(reports)
+	report := mergeReports(reports)
+	if logger.Verbose() {
+		defer logTimings(logger, report, start, transport)
+	}
+	if len(reports) == 0 {
+		exit(logger, report, start, transport)
+	}
+	// The projects which couldn't be fetched are left out of the report, which is partial
+	partial := len(report.Failed) > 0
+	if partial {
+		runErrs = append(runErrs, fmt.Errorf("%d projects couldn't be fetched", len(report.Failed)))
+		exitCode = exitCodeNotOk
+	}
 
-			projectKpiPerPeriod, err := GetProjectKpiPerYear(project)
-			if err != nil {
-				log.Fatal(err)
+	if compareFlag != "" {
+		for _, r := range reports {
+			if r.Account != "" {
+				fmt.Printf("== Account %s ==\n\n", r.Account)
 			}
-
-			// Print out the per year information
-			fmt.Println("\n\tbreakdown per year")
-			for _, ppm := range projectKpiPerPeriod {
-				fmt.Println("\t\t", ppm.String())
-				ppm.RegisterMetrics(
-					metrics,
-					fmt.Sprintf("%s.%s", libratoBaseName, libratoCatYearlyParticipants))
-				for _, participant := range ppm.Participants {
-					fmt.Println("\t\t\t", participant.String())
+			for _, project := range r.Projects {
+				c := kpi.ComparePeriods(project.Name, timeAgg, project.Periods, compareA, compareB, project.InvoiceOptions.Currency)
+				if err := printComparison(os.Stdout, c, formatter); err != nil {
+					logger.Errorf("%v", err)
+					os.Exit(exitCodeNotOk)
 				}
 			}
-		default:
-			fmt.Println("\nTime period options are : month or year")
-			fmt.Println(timeAggFlag, "is not a valid choice.")
-			os.Exit(exitCodeNotOk)
 		}
+		if exitCode != exitCodeOk {
+			exit(logger, report, start, transport)
+		}
+		return
+	}
+
+	// The gauges are recorded once so the stream and the librato metrics can't drift
+	gauges := &libratoexport.RecordingSink{}
+	for _, r := range reports {
+		registerMetrics(libratoexport.AccountSink{Sink: gauges, Account: r.Account}, r.Report)
+		if postOnPartialFlag {
+			libratoexport.RegisterFailedProjects(libratoexport.AccountSink{Sink: gauges, Account: r.Account}, len(r.Failed))
+		}
+	}
+	var conflicts []libratoexport.Conflict
+	gauges.Gauges, conflicts = libratoexport.Deduplicate(gauges.Gauges, libratoexport.DuplicatePolicy(duplicateGaugesFlag))
+	for _, c := range conflicts {
+		logger.Warnf("duplicate gauge %s", c)
+	}
+	oldest := time.Now().Add(-libratoexport.MaxMeasureAge)
+	metricsSink := &libratoexport.MetricsSink{Metrics: metrics, Oldest: oldest}
+	measurementsSink := &libratoexport.MeasurementsSink{Oldest: oldest}
+	var sink libratoexport.Sink = metricsSink
+	if libratoTagsFlag {
+		sink = measurementsSink
+	}
+	for _, g := range gauges.Gauges {
+		sink.AddGauge(g)
+	}
+	skipped := metricsSink.Skipped
+	if libratoTagsFlag {
+		skipped = measurementsSink.Skipped
+	}
+	for _, g := range measurementsSink.Undescribed {
+		logger.Warnf("the gauge %s can't be converted to a tagged measurement", g.Name)
+	}
+	if formatFlag == formatNDJSONMetrics {
+		if err := writeNDJSON(os.Stdout, gauges.Gauges, ndjsonSummaryFlag); err != nil {
+			logger.Errorf("an error occured while writing the metrics: %v", err)
+			exit(logger, report, start, transport)
+		}
+	} else {
+		printConsoleReports(reports, formatter)
+	}
+	logFailedProjects(logger, reports)
+	if report.SkippedEntries > 0 || report.SkippedInvoices > 0 {
+		logger.Warnf("%d skipped entries and %d skipped invoices, their dates can't be parsed", report.SkippedEntries, report.SkippedInvoices)
+	}
+	if libratoFlag || dryRunFlag {
+		logParticipantKeyTransition(logger, report)
+		logSkippedGauges(logger, skipped)
+	}
+
+	if emailToFlag != "" {
+		if err := emailReport(reports, window, dryRunFlag, formatter); err != nil {
+			logger.Errorf("an error occured while sending the report by email: %v", err)
+			runErrs = append(runErrs, fmt.Errorf("sending the report by email: %v", err))
+			exitCode = exitCodeNotOk
+		}
+	}
+
+	if dryRunFlag {
+		groups := groupGauges(metrics)
+		if libratoTagsFlag {
+			groups = groupMeasurements(measurementsSink.Measurements)
+		}
+		if err := dryRun(os.Stdout, groups, conflicts, snapshotFlag); err != nil {
+			logger.Errorf("an error occured while printing the metrics: %v", err)
+			exit(logger, report, start, transport)
+		}
+		if exitCode != exitCodeOk {
+			exit(logger, report, start, transport)
+		}
+		return
+	}
+
+	// A partial report would push the metrics of the failed projects as missing
+	pushMetrics := !partial || postOnPartialFlag
+	if !pushMetrics && (libratoFlag || pushgatewayFlag != "") {
+		logger.Warnf("the metrics are not pushed since %d projects couldn't be fetched, use -post-on-partial to push them", len(report.Failed))
 	}
 
 	// Only report to librato if we found the environment variables
-	if libratoFlag && libratoAccount != "" && libratoToken != "" {
-		libratoClient := &librato.Client{Username: libratoAccount, Token: libratoToken}
-		err := libratoClient.PostMetrics(metrics)
+	if pushMetrics && libratoFlag && libratoAccount != "" && libratoToken != "" {
+		api := libratoAPI{
+			Client:  &http.Client{Timeout: libratoTimeoutFlag},
+			Account: libratoAccount,
+			Token:   libratoToken,
+			Retries: libratoRetriesFlag,
+		}
+		var err error
+		if libratoTagsFlag {
+			err = api.postMeasurements(ctx, measurementsSink.Measurements)
+		} else {
+			err = api.postMetrics(ctx, metrics)
+		}
 		if err != nil {
-			fmt.Println("An error occured while POSTing the metrics to librato", err)
+			logger.Errorf("an error occured while POSTing the metrics to librato: %v", err)
+			runErrs = append(runErrs, fmt.Errorf("POSTing the metrics to librato: %v", err))
+		}
+	}
+	if pushMetrics && pushgatewayFlag != "" {
+		if err := pushGauges(ctx, http.DefaultClient, pushgatewayFlag, gauges.Gauges, time.Now()); err != nil {
+			logger.Errorf("an error occured while pushing the metrics to the pushgateway: %v", err)
+			runErrs = append(runErrs, fmt.Errorf("pushing the metrics to the pushgateway: %v", err))
+			exitCode = exitCodeNotOk
+		}
+	}
+	notifySlack(logger, slackWebhook, report, window, runErrs, formatter)
+	if exitCode != exitCodeOk {
+		exit(logger, report, start, transport)
+	}
+}
+
+// anonymizeReports replaces the identities in the reports with -anonymize, the -capacity-for overrides
+// follow the pseudonyms of the participants. The diagnostics logged while fetching are not anonymized.
+func anonymizeReports(reports []AccountReport) []AccountReport {
+	if !anonymizeFlag {
+		return reports
+	}
+	a := newAnonymizer(reports, anonymizeSaltFlag, anonProjectsFlag)
+	capacityFlag = a.capacity(capacityFlag)
+	return a.reports(reports)
+}
+
+// logFailedProjects summarizes the projects which couldn't be fetched, they are left out of the reports.
+func logFailedProjects(logger *Logger, reports []AccountReport) {
+	failed := mergeReports(reports).Failed
+	if len(failed) == 0 {
+		return
+	}
+	logger.Errorf("%d projects couldn't be fetched and are left out of the report :", len(failed))
+	for _, r := range reports {
+		prefix := Account{Name: r.Account}.logPrefix()
+		for _, f := range r.Failed {
+			logger.Errorf("\t%s%s : %v", prefix, f.Name, f.Err)
+		}
+	}
+}
+
+// logSkippedGauges warns about the gauges of the periods older than the librato retention, they are not posted.
+func logSkippedGauges(logger *Logger, skipped []libratoexport.Gauge) {
+	if len(skipped) == 0 {
+		return
+	}
+	periods := make(map[string]bool)
+	var sources []string
+	for _, g := range skipped {
+		if !periods[g.Source] {
+			periods[g.Source] = true
+			sources = append(sources, g.Source)
 		}
 	}
+	logger.Warnf("%d gauges of the periods %s are measured more than a year ago, librato rejects them so they are not posted",
+		len(skipped), strings.Join(sources, ", "))
+}
+
+// logTimings logs where the time of the run was spent.
+func logTimings(logger *Logger, report Report, start time.Time, transport *rateLimitTransport) {
+	logger.Debugf("run completed in %s, %d API calls", time.Since(start), transport.Calls())
+	for _, project := range report.Projects {
+		logger.Debugf("\t%s fetched in %s", project.Name, project.FetchDuration)
+	}
+}
+
+// exit exits with a non-zero exit code, the timings are logged first in verbose mode
+// since the deferred calls don't run.
+func exit(logger *Logger, report Report, start time.Time, transport *rateLimitTransport) {
+	if logger.Verbose() {
+		logTimings(logger, report, start, transport)
+	}
+	os.Exit(exitCodeNotOk)
+}
+
+// emailReport emails the reports printed on the standard output to the -email-to recipients.
+// With -email-dry-run the message is printed instead, it is neither sent with -dry-run.
+func emailReport(reports []AccountReport, window string, dryRun bool, f kpi.Formatter) error {
+	report := mergeReports(reports)
+	subject, err := emailSubject(emailSubjectFlag, emailSubjectData{
+		Period:   latestPeriodLabel(report),
+		Window:   window,
+		Projects: len(report.Projects),
+	})
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	if window != "" {
+		fmt.Fprintf(&body, "Report from %s\n\n", window)
+	}
+	printReports(&body, reports, f)
+	to := splitAddresses(emailToFlag)
+	msg, err := composeEmail(emailFromFlag, to, subject, body.String(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	if emailDryRunFlag {
+		fmt.Println("\nEmail that would be sent :")
+		_, err = os.Stdout.Write(msg)
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	return sendEmail(smtpSettings{
+		Host:     os.Getenv(smtpHostVarName),
+		Port:     firstNonEmpty(os.Getenv(smtpPortVarName), defaultSMTPPort),
+		User:     os.Getenv(smtpUserVarName),
+		Password: os.Getenv(smtpPasswordVarName),
+	}, emailFromFlag, to, msg)
 }
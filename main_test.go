@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gertv/go-freckle"
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+// loadFixture decodes the JSON file from the testdata directory into v.
+func loadFixture(t *testing.T, name string, v interface{}) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fixtureDataSource returns a MemoryDataSource loaded with the testdata fixtures.
+func fixtureDataSource(t *testing.T) *MemoryDataSource {
+	ds := &MemoryDataSource{
+		EntriesByProject:  make(map[int][]freckle.Entry),
+		InvoicesByProject: make(map[int][]kpi.Invoice),
+		ExpensesByProject: make(map[int][]kpi.Expense),
+	}
+	loadFixture(t, "projects.json", &ds.ProjectList)
+	for _, project := range ds.ProjectList {
+		var entries []freckle.Entry
+		loadFixture(t, fmt.Sprintf("entries_%d.json", project.Id), &entries)
+		ds.EntriesByProject[project.Id] = entries
+
+		var invoices []kpi.Invoice
+		loadFixture(t, fmt.Sprintf("invoices_%d.json", project.Id), &invoices)
+		ds.InvoicesByProject[project.Id] = invoices
+
+		var expenses []kpi.Expense
+		loadFixture(t, fmt.Sprintf("expenses_%d.json", project.Id), &expenses)
+		ds.ExpensesByProject[project.Id] = expenses
+	}
+	return ds
+}
+
+func monthlyOptions() Options {
+	return Options{
+		TimeAgg:       kpi.MonthAgg{},
+		PeriodOptions: kpi.PeriodOptions{DateBasis: kpi.DateBasisWorked},
+	}
+}
+
+func TestRun(t *testing.T) {
+	report, err := Run(context.Background(), fixtureDataSource(t), monthlyOptions())
+	assert.NoError(t, err)
+	assert.Len(t, report.Projects, 2)
+
+	acme := report.Projects[0]
+	assert.Equal(t, "Acme Web total invoiced : $4,800.00 ($3,600.00 paid, $1,200.00 outstanding), 8.0h (600.00$/h) - Billable : 10.0h (480.00$/h) - Unbillable : 1.8h - expenses: $250.00, net invoiced: $4,550.00", acme.String())
+	assert.Len(t, acme.Participants, 2)
+	assert.Equal(t, "Alice Smith Billable : 6.0h - Unbillable : 1.0h - Entries : 3 (140min avg)", acme.Participants[0].String())
+	assert.Equal(t, "Bob Jones Billable : 4.0h - Unbillable : 0.8h - Entries : 3 (95min avg)", acme.Participants[1].String())
+
+	var periods []string
+	for _, ppm := range acme.Periods {
+		periods = append(periods, ppm.String())
+	}
+	assert.Equal(t, []string{
+		"2016-01 $0.00 invoiced, rate: 0.00$/h",
+		"2016-02 $3,600.00 invoiced ($3,600.00 paid, $0.00 outstanding), rate: n/a (+$3,600.00 vs 2016-01, hours -100%)",
+		"2016-03 $0.00 invoiced, $250.00 spent, rate: 0.00$/h (-100% vs 2016-02, hours +5.0h)",
+		"2016-04 $1,200.00 invoiced ($0.00 paid, $1,200.00 outstanding), rate: n/a (+$1,200.00 vs 2016-03, hours -100%)",
+	}, periods)
+	assert.Len(t, acme.Periods[0].Participants, 2)
+	assert.Equal(t, "Alice Smith Billable : 4.0h - Unbillable : 0.0h - Entries : 1 (240min avg)", acme.Periods[0].Participants[0].String())
+	assert.Equal(t, "Bob Jones Billable : 2.0h - Unbillable : 0.8h - Entries : 2 (82min avg)", acme.Periods[0].Participants[1].String())
+	assert.Len(t, acme.Periods[1].Participants, 0)
+
+	globex := report.Projects[1]
+	assert.Equal(t, "Globex Mobile total invoiced : $0.00 ($0.00 paid, $0.00 outstanding), 0.0h (n/a) - Billable : 4.0h (0.00$/h) - Unbillable : 1.5h - expenses: $0.00, net invoiced: $0.00", globex.String())
+	assert.Len(t, globex.Periods, 2)
+}
+
+func TestRunSelectAndSortProjects(t *testing.T) {
+	opts := monthlyOptions()
+	opts.ProjectNames = []string{"Globex Mobile", "Unknown"}
+	report, err := Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	assert.Len(t, report.Projects, 1)
+	assert.Equal(t, "Globex Mobile", report.Projects[0].Name)
+
+	opts = monthlyOptions()
+	opts.SortKey = "unbillable"
+	opts.Desc = true
+	report, err = Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, "Acme Web", report.Projects[0].Name)
+	assert.Equal(t, "Globex Mobile", report.Projects[1].Name)
+}
+
+func TestRunFrom(t *testing.T) {
+	opts := monthlyOptions()
+	opts.From = time.Date(2016, time.March, 1, 0, 0, 0, 0, time.UTC)
+	opts.ProjectNames = []string{"Acme Web"}
+	report, err := Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	assert.Len(t, report.Projects, 1)
+
+	acme := report.Projects[0]
+	assert.Equal(t, "Acme Web total invoiced : $1,200.00 ($0.00 paid, $1,200.00 outstanding), 2.0h (600.00$/h) - Billable : 4.0h (300.00$/h) - Unbillable : 1.0h - expenses: $250.00, net invoiced: $950.00", acme.String())
+	assert.Len(t, acme.Periods, 2)
+	assert.Equal(t, "2016-03 $0.00 invoiced, $250.00 spent, rate: 0.00$/h", acme.Periods[0].String())
+	assert.Equal(t, "2016-04 $1,200.00 invoiced ($0.00 paid, $1,200.00 outstanding), rate: n/a (+$1,200.00 vs 2016-03, hours -100%)", acme.Periods[1].String())
+}
+
+func TestPrintReportTop(t *testing.T) {
+	defer func(top int) { topFlag = top }(topFlag)
+	ds := fixtureDataSource(t)
+	ds.EntriesByProject[101] = append(ds.EntriesByProject[101], freckle.Entry{
+		Date: "2016-01-20", Minutes: 30, Billable: true,
+		User: freckle.Participant{Id: 3, Email: "carol@example.com", FirstName: "Carol", LastName: "White"},
+	})
+	opts := monthlyOptions()
+	opts.ProjectNames = []string{"Acme Web"}
+	report, err := Run(context.Background(), ds, opts)
+	assert.NoError(t, err)
+
+	printTop := func(top int) string {
+		topFlag = top
+		var buf bytes.Buffer
+		printReport(&buf, report, kpi.DefaultFormatter)
+		return buf.String()
+	}
+	all := printTop(0)
+	// Bob and Carol are summed on the others line
+	out := printTop(1)
+	assert.Contains(t, out, "\t Alice Smith Billable")
+	assert.NotContains(t, out, "\t Bob Jones Billable")
+	assert.Contains(t, out, "\t …and 2 others: 4.5h billable / 0.8h unbillable\n")
+	// N covering all the participants prints them all
+	assert.Equal(t, all, printTop(3))
+	assert.Equal(t, all, printTop(5))
+	assert.NotContains(t, all, "others")
+}
+
+func TestRunBillable(t *testing.T) {
+	opts := monthlyOptions()
+	opts.Billable = kpi.BillableExclude
+	opts.ProjectNames = []string{"Acme Web"}
+	report, err := Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+
+	acme := report.Projects[0]
+	assert.Equal(t, 0, acme.BillableMinutes)
+	assert.Equal(t, 105, acme.UnbillableMinutes)
+	assert.Equal(t, "Acme Web (unbillable entries only)\n"+
+		"\t invoices : total invoiced : $4,800.00 ($3,600.00 paid, $1,200.00 outstanding) - expenses: $250.00, net invoiced: $4,550.00\n"+
+		"\t entries : 0.0h invoiced - Billable : 0.0h - Unbillable : 1.8h", acme.FilteredString(opts.Billable, kpi.DefaultFormatter))
+	assert.Equal(t, "Alice Smith Billable : 0.0h - Unbillable : 1.0h - Entries : 1 (60min avg)", acme.Participants[0].String())
+	assert.Equal(t, "Bob Jones Billable : 0.0h - Unbillable : 0.8h - Entries : 1 (45min avg)", acme.Participants[1].String())
+	assert.Equal(t, "Alice Smith Billable : 0.0h (0.000000 %) - Unbillable : 1.0h (57.142857 %) - Entries : 1 (60min avg)",
+		acme.Participants[0].VerboseString(acme.ProjectKpi, kpi.DefaultFormatter))
+
+	opts.Billable = kpi.BillableOnly
+	report, err = Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	acme = report.Projects[0]
+	assert.Equal(t, 600, acme.BillableMinutes)
+	assert.Equal(t, 0, acme.UnbillableMinutes)
+	assert.Equal(t, "Alice Smith Billable : 6.0h (60.000000 %) - Unbillable : 0.0h (0.000000 %) - Entries : 2 (180min avg)",
+		acme.Participants[0].VerboseString(acme.ProjectKpi, kpi.DefaultFormatter))
+	for _, ppm := range acme.Periods {
+		for _, p := range ppm.Participants {
+			assert.Equal(t, 0, p.UnbillableMinutes)
+		}
+	}
+}
+
+// renderReport runs the report and returns its text output followed by its metrics.
+func renderReport(t *testing.T, ds DataSource, opts Options) []byte {
+	report, err := Run(context.Background(), ds, opts)
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	printReport(&buf, report, kpi.DefaultFormatter)
+	s := &libratoexport.RecordingSink{}
+	registerMetrics(s, report)
+	assert.NoError(t, writeNDJSON(&buf, s.Gauges, true))
+	return buf.Bytes()
+}
+
+func TestReportIsDeterministic(t *testing.T) {
+	ds := fixtureDataSource(t)
+	// Participants with the same total time are ordered by email whatever the entries order
+	for i, email := range []string{"dave@example.com", "carol@example.com", "erin@example.com"} {
+		ds.EntriesByProject[101] = append(ds.EntriesByProject[101], freckle.Entry{
+			Date: "2016-01-20", Minutes: 60, Billable: true,
+			User: freckle.Participant{Id: 10 + i, Email: email},
+		})
+	}
+	opts := monthlyOptions()
+	opts.ByClient = true
+	opts.HistogramBounds = kpi.DefaultHistogramBounds
+
+	expected := renderReport(t, ds, opts)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, string(expected), string(renderReport(t, ds, opts)))
+	}
+}
+
+func TestRunPeriodFormat(t *testing.T) {
+	opts := monthlyOptions()
+	tagg, err := kpi.NewFormattedAgg(kpi.MonthAgg{}, "January 2006")
+	assert.NoError(t, err)
+	opts.TimeAgg = tagg
+	opts.ProjectNames = []string{"Acme Web"}
+	report, err := Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+
+	var labels []string
+	for _, ppm := range report.Projects[0].Periods {
+		labels = append(labels, ppm.Label())
+	}
+	// The periods are still sorted chronologically
+	assert.Equal(t, []string{"January 2016", "February 2016", "March 2016", "April 2016"}, labels)
+
+	s := &libratoexport.RecordingSink{}
+	registerMetrics(s, report)
+	assert.Contains(t, sources(s.Gauges), "January 2016")
+}
+
+func TestRegisterPeriodMetrics(t *testing.T) {
+	defer func(trend bool) { trendFlag = trend }(trendFlag)
+	trendFlag = true
+
+	names := func(opts Options) map[string]bool {
+		report, err := Run(context.Background(), fixtureDataSource(t), opts)
+		assert.NoError(t, err)
+		s := &libratoexport.RecordingSink{}
+		registerMetrics(s, report)
+		names := make(map[string]bool)
+		for _, g := range s.Gauges {
+			names[g.Name+"@"+g.Source] = true
+		}
+		return names
+	}
+
+	monthly := names(monthlyOptions())
+	assert.True(t, monthly["FreckleAPI.monthlyParticipants.BillableMinutes.Acme-Web@2016-01"])
+	assert.True(t, monthly["FreckleAPI.monthlyParticipants.InvoicedAmount.Acme-Web@2016-02"])
+	assert.True(t, monthly["FreckleAPI.trend.MinutesChange.Acme-Web@2016-03"])
+	assert.False(t, monthly["FreckleAPI.yearlyParticipants.BillableMinutes.Acme-Web@2016-01"])
+
+	opts := monthlyOptions()
+	opts.TimeAgg = kpi.YearAgg{}
+	yearly := names(opts)
+	assert.True(t, yearly["FreckleAPI.yearlyParticipants.BillableMinutes.Acme-Web@2016"])
+
+	tagg, err := kpi.NewFormattedAgg(kpi.MonthAgg{}, "Jan 2006")
+	assert.NoError(t, err)
+	assert.Equal(t, libratoexport.CatMonthlyParticipants, periodCategory(tagg))
+}
+
+func TestRegisterPeriodTrend(t *testing.T) {
+	defer func(trend bool) { trendFlag = trend }(trendFlag)
+	trendFlag = true
+
+	project := kpi.ProjectKpi{
+		Project:  freckle.Project{Name: "Acme Web"},
+		Invoices: []kpi.Invoice{{InvoiceDate: "2016-02-15", TotalAmount: 50, State: "paid"}},
+		DetailedEntries: []freckle.Entry{
+			{Date: "2016-01-04", Billable: true, Minutes: 60},
+			{Date: "2016-02-04", Billable: true, Minutes: 90},
+			{Date: "2016-04-04", Billable: true, Minutes: 30},
+		},
+	}
+	periods, err := kpi.GetProjectKpiPerPeriod(kpi.MonthAgg{}, kpi.PeriodOptions{DateBasis: kpi.DateBasisWorked}, project)
+	assert.NoError(t, err)
+	s := &libratoexport.RecordingSink{}
+	registerPeriodMetrics(s, libratoexport.CatMonthlyParticipants, periods)
+	values := make(map[string]float64)
+	for _, g := range s.Gauges {
+		if strings.HasPrefix(g.Name, "FreckleAPI.trend.") {
+			values[g.Name+"@"+g.Source] = g.Value
+		}
+	}
+	// January invoiced nothing, the change of February has no percentage, April follows a gap and the first period has no change
+	assert.Equal(t, map[string]float64{
+		"FreckleAPI.trend.InvoicedAmountChange.Acme-Web@2016-02": 50,
+		"FreckleAPI.trend.MinutesChange.Acme-Web@2016-02":        30,
+		"FreckleAPI.trend.MinutesChangePercent.Acme-Web@2016-02": 50,
+	}, values)
+}
+
+func TestRegisterFilledGaps(t *testing.T) {
+	project := kpi.ProjectKpi{
+		Project:         freckle.Project{Name: "Acme Web"},
+		Invoices:        []kpi.Invoice{{InvoiceDate: "2016-04-15", TotalAmount: 50, State: "paid"}},
+		DetailedEntries: []freckle.Entry{{Date: "2016-01-04", Billable: true, Minutes: 60}},
+	}
+	gauges := func(fillGaps bool) (labels []string, values map[string]float64) {
+		periods, err := kpi.GetProjectKpiPerPeriod(kpi.MonthAgg{}, kpi.PeriodOptions{DateBasis: kpi.DateBasisWorked, FillGaps: fillGaps}, project)
+		assert.NoError(t, err)
+		for _, ppm := range periods {
+			labels = append(labels, ppm.Label())
+		}
+		s := &libratoexport.RecordingSink{}
+		registerPeriodMetrics(s, libratoexport.CatMonthlyParticipants, periods)
+		values = make(map[string]float64)
+		for _, g := range s.Gauges {
+			values[g.Name+"@"+g.Source] = g.Value
+		}
+		return labels, values
+	}
+
+	labels, values := gauges(false)
+	assert.Equal(t, []string{"2016-01", "2016-04"}, labels)
+	_, ok := values["FreckleAPI.monthlyParticipants.BillableMinutes.Acme-Web@2016-02"]
+	assert.False(t, ok)
+
+	// The gaps between the first period worked and the last one invoiced are pushed with zero values
+	labels, values = gauges(true)
+	assert.Equal(t, []string{"2016-01", "2016-02", "2016-03", "2016-04"}, labels)
+	assert.Equal(t, 60.0, values["FreckleAPI.monthlyParticipants.BillableMinutes.Acme-Web@2016-01"])
+	for _, month := range []string{"2016-02", "2016-03"} {
+		for _, name := range []string{"BillableMinutes.Acme-Web", "UnbillableMinutes.Acme-Web", "InvoicedAmount.Acme-Web"} {
+			value, ok := values["FreckleAPI.monthlyParticipants."+name+"@"+month]
+			assert.True(t, ok, "%s@%s", name, month)
+			assert.Equal(t, 0.0, value, "%s@%s", name, month)
+		}
+	}
+	assert.Equal(t, 50.0, values["FreckleAPI.monthlyParticipants.InvoicedAmount.Acme-Web@2016-04"])
+	assert.Equal(t, 0.0, values["FreckleAPI.monthlyParticipants.BillableMinutes.Acme-Web@2016-04"])
+}
+
+func TestParsePeriods(t *testing.T) {
+	periods, err := parsePeriods("month, year,month")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"month", "year"}, periods)
+	periods, err = parsePeriods("year,all")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"year", "month"}, periods)
+	_, err = parsePeriods("month,week")
+	assert.Error(t, err)
+	_, err = parsePeriods("")
+	assert.Error(t, err)
+}
+
+func TestRunSeveralPeriods(t *testing.T) {
+	opts := monthlyOptions()
+	opts.MoreTimeAggs = []kpi.TimeAggregater{kpi.YearAgg{}}
+	report, err := Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	monthly, err := Run(context.Background(), fixtureDataSource(t), monthlyOptions())
+	assert.NoError(t, err)
+
+	acme := report.Projects[0]
+	assert.Equal(t, monthly.Projects[0].Periods, acme.Periods, "the main breakdown is unchanged")
+	if assert.Len(t, acme.Breakdowns, 2) {
+		assert.Equal(t, acme.Periods, acme.Breakdowns[0].Periods)
+		if assert.Len(t, acme.Breakdowns[1].Periods, 1) {
+			assert.Equal(t, "2016", acme.Breakdowns[1].Periods[0].Label())
+		}
+	}
+
+	var buf bytes.Buffer
+	printReport(&buf, report, kpi.DefaultFormatter)
+	assert.Contains(t, buf.String(), "\n\tbreakdown per month (worked date)\n\t\t 2016-01")
+	assert.Contains(t, buf.String(), "\n\tbreakdown per year (worked date)\n\t\t 2016 $4,800.00 invoiced")
+
+	s := &libratoexport.RecordingSink{}
+	registerMetrics(s, report)
+	var monthlyGauges, yearlyGauges int
+	for _, g := range s.Gauges {
+		switch {
+		case strings.HasPrefix(g.Name, "FreckleAPI.monthlyParticipants.BillableMinutes.Acme-Web"):
+			monthlyGauges++
+		case strings.HasPrefix(g.Name, "FreckleAPI.yearlyParticipants.BillableMinutes.Acme-Web"):
+			yearlyGauges++
+		}
+	}
+	assert.Equal(t, len(acme.Periods), monthlyGauges)
+	assert.Equal(t, 1, yearlyGauges)
+}
+
+// sources returns the distinct sources of the gauges.
+func sources(gauges []libratoexport.Gauge) []string {
+	var sources []string
+	seen := make(map[string]bool)
+	for _, g := range gauges {
+		if !seen[g.Source] {
+			seen[g.Source] = true
+			sources = append(sources, g.Source)
+		}
+	}
+	return sources
+}
+
+func TestRunSkipsArchivedProjects(t *testing.T) {
+	report, err := Run(context.Background(), fixtureDataSource(t), monthlyOptions())
+	assert.NoError(t, err)
+	assert.Len(t, report.Projects, 2)
+	assert.Equal(t, 1, report.SkippedArchived)
+
+	opts := monthlyOptions()
+	opts.IncludeArchived = true
+	report, err = Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	assert.Len(t, report.Projects, 3)
+	assert.Equal(t, 0, report.SkippedArchived)
+
+	// A project named explicitly is reported even when archived
+	opts = monthlyOptions()
+	opts.ProjectNames = []string{"Initech Legacy"}
+	report, err = Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	assert.Len(t, report.Projects, 1)
+	assert.Equal(t, "Initech Legacy", report.Projects[0].Name)
+}
+
+// cancelingDataSource cancels the context once the entries of the first project have been fetched.
+type cancelingDataSource struct {
+	*MemoryDataSource
+	cancel context.CancelFunc
+}
+
+func (ds cancelingDataSource) Invoices(ctx context.Context, projectID int) ([]kpi.Invoice, error) {
+	invoices, err := ds.MemoryDataSource.Invoices(ctx, projectID)
+	ds.cancel()
+	return invoices, err
+}
+
+func TestRunCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	report, err := Run(ctx, cancelingDataSource{fixtureDataSource(t), cancel}, monthlyOptions())
+	assert.Equal(t, context.Canceled, err)
+	// Only the project completed before the cancellation is reported
+	assert.Len(t, report.Projects, 1)
+	assert.Equal(t, "Acme Web", report.Projects[0].Name)
+}
+
+// failingDataSource fails to fetch the entries of a project, or the projects when failProjects is set.
+type failingDataSource struct {
+	*MemoryDataSource
+	failProjects bool
+	projectID    int
+}
+
+func (ds failingDataSource) Projects(ctx context.Context) ([]freckle.Project, error) {
+	if ds.failProjects {
+		return nil, errors.New("HTTP 502 Bad Gateway")
+	}
+	return ds.MemoryDataSource.Projects(ctx)
+}
+
+func (ds failingDataSource) Entries(ctx context.Context, projectID int) ([]freckle.Entry, error) {
+	if projectID == ds.projectID {
+		return nil, errors.New("HTTP 500 Internal Server Error")
+	}
+	return ds.MemoryDataSource.Entries(ctx, projectID)
+}
+
+func TestRunFailedProject(t *testing.T) {
+	ds := fixtureDataSource(t)
+	report, err := Run(context.Background(), failingDataSource{MemoryDataSource: ds, projectID: ds.ProjectList[0].Id}, monthlyOptions())
+	assert.NoError(t, err)
+	// The failed project is left out, the others are still reported
+	assert.Len(t, report.Projects, 1)
+	assert.Equal(t, "Globex Mobile", report.Projects[0].Name)
+	if assert.Len(t, report.Failed, 1) {
+		assert.Equal(t, "Acme Web", report.Failed[0].Name)
+		assert.EqualError(t, report.Failed[0].Err, "HTTP 500 Internal Server Error")
+	}
+
+	_, err = Run(context.Background(), failingDataSource{MemoryDataSource: ds, failProjects: true}, monthlyOptions())
+	assert.EqualError(t, err, "listing the projects: HTTP 502 Bad Gateway")
+}
+
+func TestRunSkipsUndatedEntriesAndInvoices(t *testing.T) {
+	ds := fixtureDataSource(t)
+	expected, err := Run(context.Background(), ds, monthlyOptions())
+	assert.NoError(t, err)
+
+	acme := ds.ProjectList[0].Id
+	ds.EntriesByProject[acme] = append(ds.EntriesByProject[acme], freckle.Entry{
+		Id: 99, Date: "12/03/2016", Minutes: 60, Billable: true, User: freckle.Participant{Id: 1, Email: "alice@example.com"},
+	})
+	ds.ProjectList[0].BillableMinutes += 60
+	ds.InvoicesByProject[acme] = append(ds.InvoicesByProject[acme], kpi.Invoice{Id: 98, State: "draft", TotalAmount: 500})
+	var buf bytes.Buffer
+	opts := monthlyOptions()
+	opts.Logger = NewLogger(&buf, LogLevelDefault)
+	report, err := Run(context.Background(), ds, opts)
+	assert.NoError(t, err)
+
+	// The skipped entry and invoice are left out of every KPI
+	assert.Equal(t, 1, report.SkippedEntries)
+	assert.Equal(t, 1, report.SkippedInvoices)
+	assert.Equal(t, expected.Projects[0].String(), report.Projects[0].String())
+	assert.Equal(t, expected.Projects[0].Periods, report.Projects[0].Periods)
+	assert.Contains(t, buf.String(), `WARNING: project Acme Web : the entry 99 of alice@example.com is skipped: "12/03/2016" is not a date`)
+	assert.Contains(t, buf.String(), `WARNING: project Acme Web : the invoice 98 is skipped: "" is not a date`)
+}
+
+func TestRunHistogram(t *testing.T) {
+	report, err := Run(context.Background(), fixtureDataSource(t), monthlyOptions())
+	assert.NoError(t, err)
+	assert.Nil(t, report.Projects[0].Histogram)
+	// The entries are aggregated as they are fetched, they are only kept on demand
+	assert.Nil(t, report.Projects[0].DetailedEntries)
+
+	opts := monthlyOptions()
+	opts.HistogramBounds = kpi.DefaultHistogramBounds
+	opts.KeepEntries = true
+	report, err = Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	for _, project := range report.Projects {
+		assert.NotNil(t, project.Histogram)
+		var count int
+		for _, b := range project.Histogram.Buckets {
+			count += b.Count()
+		}
+		assert.Equal(t, len(project.DetailedEntries), count+project.Histogram.Invalid.Count())
+	}
+}
+
+func TestRunByWeekday(t *testing.T) {
+	report, err := Run(context.Background(), fixtureDataSource(t), monthlyOptions())
+	assert.NoError(t, err)
+	assert.Nil(t, report.Projects[0].Weekdays)
+
+	opts := monthlyOptions()
+	opts.WeekdayLocation = time.UTC
+	report, err = Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	for _, project := range report.Projects {
+		if assert.NotNil(t, project.Weekdays) {
+			var billable, unbillable int
+			for _, day := range kpi.Weekdays {
+				billable += project.Weekdays.BillableMinutes[day]
+				unbillable += project.Weekdays.UnbillableMinutes[day]
+			}
+			assert.Equal(t, project.BillableMinutes, billable, project.Name)
+			assert.Equal(t, project.UnbillableMinutes, unbillable, project.Name)
+		}
+	}
+}
+
+func TestParsePrecision(t *testing.T) {
+	hours, amounts, err := parsePrecision("1,2")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, []int{hours, amounts})
+	hours, amounts, err = parsePrecision("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 0}, []int{hours, amounts})
+	for _, value := range []string{"", "a", "-1", "1,2,3", "7"} {
+		_, _, err = parsePrecision(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseBounds(t *testing.T) {
+	bounds, err := parseBounds("15, 30,60,120,240")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{15, 30, 60, 120, 240}, bounds)
+	assert.Equal(t, "15,30,60,120,240", formatBounds(bounds))
+
+	_, err = parseBounds("15,1h")
+	assert.EqualError(t, err, `"1h" is not a number of minutes`)
+	_, err = parseBounds("30,15")
+	assert.EqualError(t, err, "the bounds must be positive and increasing, 15 is not")
+	_, err = parseBounds("0,15")
+	assert.Error(t, err)
+}
+
+func TestParseClientMap(t *testing.T) {
+	clientMap, err := parseClientMap("Acme=Acme Web, Acme Mobile; Globex=Globex Mobile")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Acme Web": "Acme", "Acme Mobile": "Acme", "Globex Mobile": "Globex"}, clientMap)
+
+	clientMap, err = parseClientMap("")
+	assert.NoError(t, err)
+	assert.Empty(t, clientMap)
+
+	_, err = parseClientMap("Acme Web")
+	assert.Error(t, err)
+}
+
+func TestRunByClient(t *testing.T) {
+	opts := monthlyOptions()
+	opts.ByClient = true
+	opts.IncludeArchived = true
+	report, err := Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	assert.Len(t, report.Clients, 3)
+	assert.Equal(t, "Acme (1 projects) total invoiced : $4,800.00, 8.0h - Billable : 10.0h - Unbillable : 1.8h", report.Clients[0].String())
+	assert.Equal(t, "Globex", report.Clients[1].Name)
+	assert.Equal(t, "Initech", report.Clients[2].Name)
+}
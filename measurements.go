@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+// measurementsURL is the endpoint of the librato tagged measurements API.
+var measurementsURL = "https://metrics-api.librato.com/v1/measurements"
+
+// measurementsBatchSize is the maximum number of measurements posted per request.
+const measurementsBatchSize = 300
+
+// measurementsPayload is the body posted to the measurements endpoint.
+type measurementsPayload struct {
+	Measurements []libratoexport.Measurement `json:"measurements"`
+}
+
+// postMeasurements posts the measurements to librato in batches.
+func (api libratoAPI) postMeasurements(ctx context.Context, measurements []libratoexport.Measurement) error {
+	for start := 0; start < len(measurements); start += measurementsBatchSize {
+		end := start + measurementsBatchSize
+		if end > len(measurements) {
+			end = len(measurements)
+		}
+		batch := measurements[start:end]
+		names := make([]string, len(batch))
+		for i, m := range batch {
+			names[i] = m.Name
+		}
+		if err := api.post(ctx, measurementsURL, measurementsPayload{Measurements: batch}, names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
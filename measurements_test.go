@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+func TestPostMeasurements(t *testing.T) {
+	var batches []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, token, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "account", user)
+		assert.Equal(t, "token", token)
+		var payload measurementsPayload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		batches = append(batches, len(payload.Measurements))
+		if payload.Measurements[0].Name == "fail" {
+			http.Error(w, `{"errors":{"params":{"name":["is invalid"]}}}`, http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	defer func(url string) { measurementsURL = url }(measurementsURL)
+	measurementsURL = server.URL
+
+	measurements := make([]libratoexport.Measurement, measurementsBatchSize+1)
+	for i := range measurements {
+		measurements[i] = libratoexport.Measurement{Name: "freckle.billable_minutes", Tags: map[string]string{"project": "foo"}}
+	}
+	api := libratoAPI{Client: http.DefaultClient, Account: "account", Token: "token"}
+	assert.NoError(t, api.postMeasurements(context.Background(), measurements))
+	assert.Equal(t, []int{measurementsBatchSize, 1}, batches)
+
+	err := api.postMeasurements(context.Background(), []libratoexport.Measurement{{Name: "fail"}})
+	assert.EqualError(t, err, `librato responded 400 Bad Request to the 1 measures posted : {"errors":{"params":{"name":["is invalid"]}}}`)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+// Output formats of the report on the standard output.
+const (
+	formatText          = "text"
+	formatNDJSONMetrics = "ndjson-metrics"
+)
+
+// ndjsonGauge is a line of the ndjson-metrics stream.
+type ndjsonGauge struct {
+	Name   string  `json:"name"`
+	Source string  `json:"source"`
+	Value  float64 `json:"value"`
+	// Period is the start of the period the value is measured over, omitted for the all-time totals
+	Period string `json:"period,omitempty"`
+	// Account is the account of the measured projects, omitted unless several accounts are processed
+	Account string `json:"account,omitempty"`
+}
+
+// ndjsonSummary is the last line of the ndjson-metrics stream, to detect a truncated stream.
+type ndjsonSummary struct {
+	Summary struct {
+		Count int `json:"count"`
+	} `json:"summary"`
+}
+
+// writeNDJSON writes a JSON object per line for each gauge, followed by the summary line when summary is set.
+func writeNDJSON(w io.Writer, gauges []libratoexport.Gauge, summary bool) error {
+	enc := json.NewEncoder(w)
+	for _, g := range gauges {
+		line := ndjsonGauge{Name: g.Name, Source: g.Source, Value: g.Value, Account: g.Account}
+		if !g.Period.IsZero() {
+			line.Period = g.Period.UTC().Format(time.RFC3339)
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	if !summary {
+		return nil
+	}
+	var s ndjsonSummary
+	s.Summary.Count = len(gauges)
+	return enc.Encode(s)
+}
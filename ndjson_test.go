@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+func TestWriteNDJSON(t *testing.T) {
+	opts := monthlyOptions()
+	opts.TimeAgg = kpi.YearAgg{}
+	opts.ProjectNames = []string{"Acme Web"}
+	report, err := Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+
+	gauges := &libratoexport.RecordingSink{}
+	registerMetrics(gauges, report)
+	var buf bytes.Buffer
+	assert.NoError(t, writeNDJSON(&buf, gauges.Gauges, true))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Len(t, lines, len(gauges.Gauges)+1)
+	assert.Equal(t, `{"name":"FreckleAPI.projects.UnbillableMinutes","source":"Acme-Web","value":105}`, lines[0])
+	assert.Contains(t, lines, `{"name":"FreckleAPI.projects.ExpensesAmount","source":"Acme-Web","value":250}`)
+	assert.Contains(t, lines, `{"name":"FreckleAPI.yearlyParticipants.BillableMinutes.Acme-Web","source":"2016","value":600,"period":"2016-01-01T00:00:00Z"}`)
+	assert.Equal(t, `{"summary":{"count":19}}`, lines[len(lines)-1])
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gertv/go-freckle"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// nokoTokenVarName is the environment variable of the Noko personal access token.
+const nokoTokenVarName = "NOKO_TOKEN"
+
+// The flavors of the API the data is fetched from.
+const (
+	// apiAuto tries the Noko v2 API first when $NOKO_TOKEN is set, the legacy Freckle API otherwise
+	apiAuto = "auto"
+	// apiV1 is the legacy Freckle API, through go-freckle
+	apiV1 = "v1"
+	// apiV2 is the Noko v2 API
+	apiV2 = "v2"
+)
+
+const (
+	freckleTokenHeader = "X-FreckleToken"
+	nokoTokenHeader    = "X-NokoToken"
+)
+
+// nokoPageSize is the number of items requested per page, the maximum accepted by the Noko API.
+const nokoPageSize = 1000
+
+// nokoBaseURL is the root of the Noko v2 API, tests point it to a local server.
+var nokoBaseURL = "https://api.nokotime.com/v2"
+
+// errPageNotFound is returned by fetchPages when the API responds 404.
+var errPageNotFound = fmt.Errorf("page not found")
+
+// fetchPages GETs url then the next pages of its Link header, fn is called with the body of each page.
+// The token is sent in the tokenHeader, it returns the number of pages fetched.
+func fetchPages(ctx context.Context, client *http.Client, tokenHeader, token, url string, fn func(data []byte) error) (int, error) {
+	pages := 0
+	for url != "" {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return pages, err
+		}
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set(tokenHeader, token)
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return pages, err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return pages, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return pages, errPageNotFound
+		}
+		if resp.StatusCode >= 400 {
+			return pages, fmt.Errorf("fetching %s : %s", url, resp.Status)
+		}
+		if err := fn(data); err != nil {
+			return pages, err
+		}
+		pages++
+
+		url = ""
+		if match := nextLinkRegexp.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+			url = match[1]
+		}
+	}
+	return pages, nil
+}
+
+// fetchInvoices fetches all the pages of invoices starting at url, the token is sent in the tokenHeader.
+// The invoices are decoded with their currency, which go-freckle leaves out.
+func fetchInvoices(ctx context.Context, client *http.Client, tokenHeader, token, url string) ([]kpi.Invoice, error) {
+	var invoices []kpi.Invoice
+	_, err := fetchPages(ctx, client, tokenHeader, token, url, func(data []byte) error {
+		var page []kpi.Invoice
+		if err := json.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		invoices = append(invoices, page...)
+		return nil
+	})
+	return invoices, err
+}
+
+// nokoDataSource is a DataSource fetching the data from the Noko v2 API with a personal access token.
+// The v2 payloads have the shape of the go-freckle types, they are decoded into them but for the invoices,
+// which are decoded with their currency.
+type nokoDataSource struct {
+	client  *http.Client
+	token   string
+	baseURL string
+	logger  *Logger
+	// invoices embedded in the projects payload, they save a call per project
+	invoices map[int][]kpi.Invoice
+	// expensesURLs of the projects with expenses, from the projects payload
+	expensesURLs map[int]string
+}
+
+// NewNokoDataSource returns a DataSource backed by the Noko v2 API, the pages fetched are logged.
+func NewNokoDataSource(client *http.Client, token string, logger *Logger) DataSource {
+	return &nokoDataSource{
+		client:       client,
+		token:        token,
+		baseURL:      nokoBaseURL,
+		logger:       logger,
+		invoices:     make(map[int][]kpi.Invoice),
+		expensesURLs: make(map[int]string),
+	}
+}
+
+// nokoProject is a project of the Noko v2 API, its embedded invoices are decoded with their currency.
+type nokoProject struct {
+	freckle.Project
+	Invoices []kpi.Invoice `json:"invoices,omitempty"`
+}
+
+func (ds *nokoDataSource) url(path string) string {
+	return fmt.Sprintf("%s%s?per_page=%d", ds.baseURL, path, nokoPageSize)
+}
+
+// Projects returns all the projects of the account.
+func (ds *nokoDataSource) Projects(ctx context.Context) ([]freckle.Project, error) {
+	var projects []freckle.Project
+	pages, err := fetchPages(ctx, ds.client, nokoTokenHeader, ds.token, ds.url("/projects"), func(data []byte) error {
+		var page []nokoProject
+		if err := json.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		for _, p := range page {
+			projects = append(projects, p.Project)
+			ds.invoices[p.Id] = p.Invoices
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ds.logger.Debugf("%d projects fetched in %d pages", len(projects), pages)
+
+	for _, project := range projects {
+		if project.Expenses > 0 {
+			ds.expensesURLs[project.Id] = project.ExpensesUrl
+		}
+	}
+	return projects, nil
+}
+
+// Entries returns all the entries of the project.
+func (ds *nokoDataSource) Entries(ctx context.Context, projectID int) ([]freckle.Entry, error) {
+	var entries []freckle.Entry
+	err := ds.EachEntry(ctx, projectID, func(entry freckle.Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// EachEntry passes the entries of the project to fn as the pages are fetched, only a page is held in memory.
+// It stops at the first error returned by fn.
+func (ds *nokoDataSource) EachEntry(ctx context.Context, projectID int, fn func(freckle.Entry) error) error {
+	count := 0
+	pages, err := fetchPages(ctx, ds.client, nokoTokenHeader, ds.token, ds.url(fmt.Sprintf("/projects/%d/entries", projectID)), func(data []byte) error {
+		var page []freckle.Entry
+		if err := json.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		for _, entry := range page {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		count += len(page)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ds.logger.Debugf("project %d : %d entries fetched in %d pages", projectID, count, pages)
+	return nil
+}
+
+// Invoices returns the invoices of the project, from the projects payload when it has already been fetched.
+func (ds *nokoDataSource) Invoices(ctx context.Context, projectID int) ([]kpi.Invoice, error) {
+	if invoices, ok := ds.invoices[projectID]; ok {
+		return invoices, nil
+	}
+	return fetchInvoices(ctx, ds.client, nokoTokenHeader, ds.token, ds.url(fmt.Sprintf("/projects/%d/invoices", projectID)))
+}
+
+// Expenses returns the expenses of the project, the projects without expenses in the projects payload are not fetched.
+func (ds *nokoDataSource) Expenses(ctx context.Context, projectID int) ([]kpi.Expense, error) {
+	url, ok := ds.expensesURLs[projectID]
+	if !ok {
+		return nil, nil
+	}
+	return fetchExpenses(ctx, ds.client, nokoTokenHeader, ds.token, url)
+}
+
+// probeNoko reports whether the token is accepted by the Noko v2 API.
+func probeNoko(ctx context.Context, client *http.Client, token string) error {
+	_, err := fetchPages(ctx, client, nokoTokenHeader, token, nokoBaseURL+"/current_user", func([]byte) error { return nil })
+	return err
+}
+
+// IsValidAPI reports whether api is a flavor of the -api flag.
+func IsValidAPI(api string) bool {
+	return api == apiAuto || api == apiV1 || api == apiV2
+}
+
+// newDataSource returns the DataSource of the api flavor and the flavor used, which is resolved when api is auto.
+// freckleToken is the token of the legacy Freckle API, nokoToken the Noko personal access token.
+func newDataSource(ctx context.Context, api string, client *http.Client, freckleToken, nokoToken string, logger *Logger) (DataSource, string, error) {
+	switch api {
+	case apiV1:
+		if freckleToken == "" {
+			return nil, api, fmt.Errorf("%s environment variable is not set", freckleTokenVarName)
+		}
+	case apiV2:
+		token := firstNonEmpty(nokoToken, freckleToken)
+		if token == "" {
+			return nil, api, fmt.Errorf("%s environment variable is not set", nokoTokenVarName)
+		}
+		return NewNokoDataSource(client, token, logger), api, nil
+	case apiAuto:
+		if nokoToken != "" {
+			err := probeNoko(ctx, client, nokoToken)
+			if err == nil {
+				return NewNokoDataSource(client, nokoToken, logger), apiV2, nil
+			}
+			if freckleToken == "" {
+				return nil, apiV2, fmt.Errorf("the Noko v2 API refused the %s : %v", nokoTokenVarName, err)
+			}
+			logger.Debugf("the Noko v2 API refused the %s, falling back to the Freckle API : %v", nokoTokenVarName, err)
+		}
+		if freckleToken == "" {
+			return nil, apiV1, fmt.Errorf("%s or %s environment variable is not set", nokoTokenVarName, freckleTokenVarName)
+		}
+		api = apiV1
+	default:
+		return nil, api, fmt.Errorf("%s is not a valid choice. API options are : %s", api, strings.Join([]string{apiAuto, apiV1, apiV2}, ", "))
+	}
+	f := freckle.LetsFreckle(freckleAppName, freckleToken)
+	return NewFreckleDataSource(f, client, freckleToken, logger), api, nil
+}
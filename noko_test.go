@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gertv/go-freckle"
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// newNokoServer serves a Noko v2 account with a project whose entries span two pages.
+func newNokoServer(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(nokoTokenHeader) != "personal" {
+			http.Error(w, `{"message": "Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, "freckle-project-indicators/"+version, r.Header.Get("User-Agent"))
+		switch r.URL.Path {
+		case "/current_user":
+			fmt.Fprint(w, `{"id": 5538, "email": "john.test@example.com"}`)
+		case "/projects":
+			fmt.Fprint(w, `[{"id": 101, "name": "Foo", "enabled": true, "billable": true, "group": {"id": 3, "name": "Acme"},
+				"billable_minutes": 90, "unbillable_minutes": 30, "invoiced_minutes": 60,
+				"invoices": [{"id": 7, "reference": "AA001", "invoice_date": "2016-03-31", "state": "paid", "total_amount": 1200.5, "currency": "EUR"}]}]`)
+		case "/projects/102/invoices":
+			fmt.Fprint(w, `[{"id": 8, "invoice_date": "2016-04-30", "state": "unpaid", "total_amount": 300}]`)
+		case "/projects/101/entries":
+			assert.Equal(t, "1000", r.URL.Query().Get("per_page"))
+			if r.URL.Query().Get("page") == "" {
+				w.Header().Set("Link", fmt.Sprintf("<%s%s?page=2&per_page=1000>; rel=\"next\"", server.URL, r.URL.Path))
+				fmt.Fprint(w, `[{"id": 1, "date": "2016-03-15", "minutes": 90, "billable": true, "user": {"id": 5538, "email": "john.test@example.com"}}]`)
+				return
+			}
+			fmt.Fprint(w, `[{"id": 2, "date": "2016-04-02", "minutes": 30, "user": {"id": 5538, "email": "john.test@example.com"}}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return server
+}
+
+func TestNokoDataSource(t *testing.T) {
+	server := newNokoServer(t)
+	defer server.Close()
+	defer func(url string) { nokoBaseURL = url }(nokoBaseURL)
+	nokoBaseURL = server.URL
+
+	ds := NewNokoDataSource(server.Client(), "personal", discardLogger)
+	projects, err := ds.Projects(context.Background())
+	assert.NoError(t, err)
+	if assert.Len(t, projects, 1) {
+		assert.Equal(t, "Foo", projects[0].Name)
+		assert.Equal(t, "Acme", projects[0].Group.Name)
+		assert.Equal(t, 90, projects[0].BillableMinutes)
+	}
+
+	entries, err := ds.Entries(context.Background(), 101)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, freckle.Participant{Id: 5538, Email: "john.test@example.com"}, entries[0].User)
+		assert.True(t, entries[0].Billable)
+		assert.Equal(t, "2016-04-02", entries[1].Date)
+	}
+
+	invoices, err := ds.Invoices(context.Background(), 101)
+	assert.NoError(t, err)
+	assert.Equal(t, []kpi.Invoice{{Id: 7, Reference: "AA001", InvoiceDate: "2016-03-31", State: "paid", TotalAmount: 1200.5, Currency: "EUR"}}, invoices)
+	// The invoices of a project not listed are fetched
+	invoices, err = ds.Invoices(context.Background(), 102)
+	assert.NoError(t, err)
+	assert.Equal(t, []kpi.Invoice{{Id: 8, InvoiceDate: "2016-04-30", State: "unpaid", TotalAmount: 300}}, invoices)
+
+	_, err = ds.Entries(context.Background(), 102)
+	assert.Equal(t, errPageNotFound, err)
+}
+
+func TestNewDataSource(t *testing.T) {
+	server := newNokoServer(t)
+	defer server.Close()
+	defer func(url string) { nokoBaseURL = url }(nokoBaseURL)
+	nokoBaseURL = server.URL
+
+	cases := []struct {
+		api, freckleToken, nokoToken string
+		want                         string
+		wantErr                      bool
+	}{
+		{api: apiAuto, freckleToken: "legacy", want: apiV1},
+		{api: apiAuto, nokoToken: "personal", want: apiV2},
+		{api: apiAuto, freckleToken: "legacy", nokoToken: "personal", want: apiV2},
+		{api: apiAuto, freckleToken: "legacy", nokoToken: "revoked", want: apiV1},
+		{api: apiAuto, nokoToken: "revoked", wantErr: true},
+		{api: apiV1, nokoToken: "personal", wantErr: true},
+		{api: apiV2, freckleToken: "legacy", want: apiV2},
+		{api: "v3", freckleToken: "legacy", wantErr: true},
+	}
+	for _, c := range cases {
+		ds, api, err := newDataSource(context.Background(), c.api, server.Client(), c.freckleToken, c.nokoToken, discardLogger)
+		if c.wantErr {
+			assert.Error(t, err, "%+v", c)
+			continue
+		}
+		if assert.NoError(t, err, "%+v", c) {
+			assert.Equal(t, c.want, api, "%+v", c)
+			_, isNoko := ds.(*nokoDataSource)
+			assert.Equal(t, c.want == apiV2, isNoko, "%+v", c)
+		}
+	}
+}
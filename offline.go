@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gertv/go-freckle"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// The files of an offline snapshot, in the shapes of the Freckle API payloads.
+const (
+	projectsFileName = "projects.json"
+	entriesFileName  = "entries_%d.json"
+	invoicesFileName = "invoices_%d.json"
+	expensesFileName = "expenses_%d.json"
+)
+
+// accountDir returns the directory of the snapshot of the account, the named accounts are in a subdirectory of dir.
+func accountDir(dir string, account Account) string {
+	if account.Name == "" {
+		return dir
+	}
+	return filepath.Join(dir, account.Name)
+}
+
+// readJSON decodes the JSON file at path into v, the errors name the file.
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s is malformed : %v", path, err)
+	}
+	return nil
+}
+
+// dirDataSource is a DataSource reading a snapshot written by -dump, or exported from the API, in a directory.
+type dirDataSource struct {
+	dir string
+}
+
+// NewDirDataSource returns a DataSource reading the projects.json, entries_<projectID>.json and
+// invoices_<projectID>.json files of dir. The expenses_<projectID>.json files are optional.
+func NewDirDataSource(dir string) DataSource {
+	return &dirDataSource{dir: dir}
+}
+
+func (ds *dirDataSource) path(name string, projectID int) string {
+	if projectID == 0 {
+		return filepath.Join(ds.dir, name)
+	}
+	return filepath.Join(ds.dir, fmt.Sprintf(name, projectID))
+}
+
+// Projects returns the projects of projects.json.
+func (ds *dirDataSource) Projects(ctx context.Context) ([]freckle.Project, error) {
+	var projects []freckle.Project
+	if err := readJSON(ds.path(projectsFileName, 0), &projects); err != nil {
+		return nil, err
+	}
+	return projects, ctx.Err()
+}
+
+// Entries returns the entries of the entries file of the project.
+func (ds *dirDataSource) Entries(ctx context.Context, projectID int) ([]freckle.Entry, error) {
+	var entries []freckle.Entry
+	if err := readJSON(ds.path(entriesFileName, projectID), &entries); err != nil {
+		return nil, err
+	}
+	return entries, ctx.Err()
+}
+
+// Invoices returns the invoices of the invoices file of the project.
+func (ds *dirDataSource) Invoices(ctx context.Context, projectID int) ([]kpi.Invoice, error) {
+	var invoices []kpi.Invoice
+	if err := readJSON(ds.path(invoicesFileName, projectID), &invoices); err != nil {
+		return nil, err
+	}
+	return invoices, ctx.Err()
+}
+
+// Expenses returns the expenses of the expenses file of the project, the project has no expenses without file.
+func (ds *dirDataSource) Expenses(ctx context.Context, projectID int) ([]kpi.Expense, error) {
+	var expenses []kpi.Expense
+	err := readJSON(ds.path(expensesFileName, projectID), &expenses)
+	if os.IsNotExist(err) {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return expenses, ctx.Err()
+}
+
+// dumpDataSource is a DataSource writing the data fetched from the wrapped one to a directory,
+// in the files read by NewDirDataSource. The entries are held in memory to be written at once.
+// projects.json only lists the projects whose invoices were dumped, the last data Run fetches for a project,
+// so a snapshot of a run restricted to some projects can be replayed with any selection.
+type dumpDataSource struct {
+	ds  DataSource
+	dir string
+	// projects are the projects listed by the wrapped DataSource, dumped holds the IDs of the ones written
+	projects []freckle.Project
+	dumped   map[int]bool
+}
+
+// newDumpDataSource returns a DataSource dumping the data of ds to dir, which is created if needed.
+func newDumpDataSource(ds DataSource, dir string) (DataSource, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dumpDataSource{ds: ds, dir: dir, dumped: make(map[int]bool)}, nil
+}
+
+// writeJSON writes v as indented JSON to the file name in the dump directory.
+func (d *dumpDataSource) writeJSON(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(d.dir, name), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("dumping %s : %v", name, err)
+	}
+	return nil
+}
+
+// Projects returns the projects of the wrapped DataSource, they are written to projects.json as their invoices are dumped.
+func (d *dumpDataSource) Projects(ctx context.Context) ([]freckle.Project, error) {
+	projects, err := d.ds.Projects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.projects = projects
+	return projects, nil
+}
+
+// writeProjects writes the dumped projects to projects.json, in the order of the wrapped DataSource.
+func (d *dumpDataSource) writeProjects() error {
+	projects := []freckle.Project{}
+	for _, project := range d.projects {
+		if d.dumped[project.Id] {
+			projects = append(projects, project)
+		}
+	}
+	return d.writeJSON(projectsFileName, projects)
+}
+
+// Entries returns the entries of the wrapped DataSource and writes them to the entries file of the project.
+func (d *dumpDataSource) Entries(ctx context.Context, projectID int) ([]freckle.Entry, error) {
+	entries, err := d.ds.Entries(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return entries, d.writeJSON(fmt.Sprintf(entriesFileName, projectID), entries)
+}
+
+// Invoices returns the invoices of the wrapped DataSource and writes them to the invoices file of the project,
+// the project is then added to projects.json.
+func (d *dumpDataSource) Invoices(ctx context.Context, projectID int) ([]kpi.Invoice, error) {
+	invoices, err := d.ds.Invoices(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.writeJSON(fmt.Sprintf(invoicesFileName, projectID), invoices); err != nil {
+		return nil, err
+	}
+	d.dumped[projectID] = true
+	return invoices, d.writeProjects()
+}
+
+// Expenses returns the expenses of the wrapped DataSource, when it is an ExpenseSource,
+// and writes them to the expenses file of the project.
+func (d *dumpDataSource) Expenses(ctx context.Context, projectID int) ([]kpi.Expense, error) {
+	es, ok := d.ds.(ExpenseSource)
+	if !ok {
+		return nil, nil
+	}
+	expenses, err := es.Expenses(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return expenses, d.writeJSON(fmt.Sprintf(expensesFileName, projectID), expenses)
+}
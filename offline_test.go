@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+func TestDirDataSource(t *testing.T) {
+	// The fixtures are a snapshot of the account
+	want, err := Run(context.Background(), fixtureDataSource(t), monthlyOptions())
+	assert.NoError(t, err)
+	got, err := Run(context.Background(), NewDirDataSource("testdata"), monthlyOptions())
+	assert.NoError(t, err)
+	var wantOut, gotOut bytes.Buffer
+	printReport(&wantOut, want, kpi.DefaultFormatter)
+	printReport(&gotOut, got, kpi.DefaultFormatter)
+	assert.Equal(t, wantOut.String(), gotOut.String())
+
+	_, err = NewDirDataSource("missing").Projects(context.Background())
+	assert.True(t, os.IsNotExist(err))
+	expenses, err := NewDirDataSource("missing").(ExpenseSource).Expenses(context.Background(), 101)
+	assert.NoError(t, err)
+	assert.Nil(t, expenses)
+}
+
+func TestDirDataSourceCurrencies(t *testing.T) {
+	report, err := Run(context.Background(), NewDirDataSource(filepath.Join("testdata", "currencies")), monthlyOptions())
+	assert.NoError(t, err)
+	if !assert.Len(t, report.Projects, 1) {
+		return
+	}
+
+	// The amounts in different currencies are never added, the invoices without currency are in the default one
+	project := report.Projects[0]
+	assert.Equal(t, kpi.Amounts{"EUR": 3000, "USD": 750}, project.GetInvoicedTotalPerCurrency())
+	assert.Equal(t, kpi.Amounts{"EUR": 2000, "USD": 750}, project.GetPaidTotalPerCurrency())
+	assert.Equal(t, kpi.Amounts{"EUR": 1000}, project.GetOutstandingTotalPerCurrency())
+	if assert.Len(t, project.Periods, 2) {
+		assert.Equal(t, kpi.Amounts{"EUR": 2000, "USD": 500}, project.Periods[0].GetInvoicedAmounts())
+		assert.Equal(t, kpi.Amounts{"EUR": 1000, "USD": 250}, project.Periods[1].GetInvoicedAmounts())
+	}
+	var out bytes.Buffer
+	printReport(&out, report, kpi.DefaultFormatter)
+	assert.Contains(t, out.String(), "Hooli Web total invoiced : €3,000.00 + $750.00")
+
+	// The amounts in the default currency keep the name of the series registered before the currencies
+	gauges := &libratoexport.RecordingSink{}
+	registerMetrics(gauges, report)
+	values := make(map[string]float64)
+	for _, g := range gauges.Gauges {
+		values[g.Name+"@"+g.Source] = g.Value
+	}
+	assert.Equal(t, 750.0, values["FreckleAPI.projects.InvoicedAmount@Hooli-Web"])
+	assert.Equal(t, 3000.0, values["FreckleAPI.projects.InvoicedAmount.EUR@Hooli-Web"])
+	assert.Equal(t, 1000.0, values["FreckleAPI.projects.OutstandingAmount.EUR@Hooli-Web"])
+	assert.Equal(t, 500.0, values["FreckleAPI.monthlyParticipants.InvoicedAmount.Hooli-Web@2016-01"])
+	assert.Equal(t, 2000.0, values["FreckleAPI.monthlyParticipants.InvoicedAmount.Hooli-Web.EUR@2016-01"])
+	assert.Equal(t, 1000.0, values["FreckleAPI.monthlyParticipants.InvoicedAmount.Hooli-Web.EUR@2016-02"])
+
+	// With another default currency, the invoices without currency are in it and its amounts keep the series
+	opts := monthlyOptions()
+	opts.InvoiceOptions = kpi.InvoiceOptions{Currency: "EUR"}
+	report, err = Run(context.Background(), NewDirDataSource(filepath.Join("testdata", "currencies")), opts)
+	assert.NoError(t, err)
+	gauges = &libratoexport.RecordingSink{}
+	registerMetrics(gauges, report)
+	values = make(map[string]float64)
+	for _, g := range gauges.Gauges {
+		values[g.Name+"@"+g.Source] = g.Value
+	}
+	assert.Equal(t, 3250.0, values["FreckleAPI.projects.InvoicedAmount@Hooli-Web"])
+	assert.Equal(t, 500.0, values["FreckleAPI.projects.InvoicedAmount.USD@Hooli-Web"])
+}
+
+func TestDumpDataSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freckle-dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	snapshot := accountDir(dir, Account{Name: "acme"})
+	ds, err := newDumpDataSource(fixtureDataSource(t), snapshot)
+	assert.NoError(t, err)
+	online, err := Run(context.Background(), ds, monthlyOptions())
+	assert.NoError(t, err)
+	offline, err := Run(context.Background(), NewDirDataSource(snapshot), monthlyOptions())
+	assert.NoError(t, err)
+	var onlineOut, offlineOut bytes.Buffer
+	printReport(&onlineOut, online, kpi.DefaultFormatter)
+	printReport(&offlineOut, offline, kpi.DefaultFormatter)
+	assert.Equal(t, onlineOut.String(), offlineOut.String())
+
+	// The snapshot of a selection only lists the selected projects, so it is replayed with any selection
+	selected := accountDir(dir, Account{Name: "selected"})
+	ds, err = newDumpDataSource(fixtureDataSource(t), selected)
+	assert.NoError(t, err)
+	opts := monthlyOptions()
+	opts.ProjectNames = []string{"Acme Web"}
+	online, err = Run(context.Background(), ds, opts)
+	assert.NoError(t, err)
+	offline, err = Run(context.Background(), NewDirDataSource(selected), monthlyOptions())
+	assert.NoError(t, err)
+	assert.Empty(t, offline.Failed)
+	if assert.Len(t, offline.Projects, 1) {
+		assert.Equal(t, online.Projects[0].ProjectKpi, offline.Projects[0].ProjectKpi)
+	}
+
+	// A malformed file fails the project, the file is named
+	path := filepath.Join(snapshot, "entries_101.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("[{"), 0644))
+	report, err := Run(context.Background(), NewDirDataSource(snapshot), monthlyOptions())
+	assert.NoError(t, err)
+	if assert.Len(t, report.Failed, 1) {
+		assert.Contains(t, report.Failed[0].Err.Error(), path+" is malformed")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+// pushgatewayJob is the job the metrics are pushed under.
+const pushgatewayJob = "freckle_indicators"
+
+// pushgatewayTimeout bounds the time spent pushing a group of metrics.
+const pushgatewayTimeout = 30 * time.Second
+
+// pushgatewayRetryDelay is the delay before the single retry of a failed push.
+var pushgatewayRetryDelay = 2 * time.Second
+
+// lastRunMetric is the timestamp of the run, to alert when the cron job stops running.
+const lastRunMetric = "freckle_last_run_timestamp_seconds"
+
+// promCategories maps the gauge categories to the entity of the Prometheus metric names.
+var promCategories = map[string]string{
+	libratoexport.CatProjects:            "project",
+	libratoexport.CatClients:             "client",
+	libratoexport.CatParticipants:        "participant",
+	libratoexport.CatYearlyParticipants:  "yearly",
+	libratoexport.CatMonthlyParticipants: "monthly",
+	libratoexport.CatTrend:               "trend",
+	libratoexport.CatRun:                 "run",
+	libratoexport.CatUtilization:         "utilization",
+}
+
+// promSample is a sample of a Prometheus metric family.
+type promSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// promGroup holds the samples pushed under the same grouping key, the project ones or the job ones when Project is empty.
+// The Account is part of the grouping key when several accounts are processed.
+type promGroup struct {
+	Account string
+	Project string
+	Samples []promSample
+}
+
+// promGroupKey identifies a promGroup.
+type promGroupKey struct {
+	account, project string
+}
+
+// promGroups converts the gauges into Prometheus samples named like freckle_project_billable_minutes, the project
+// and the account are grouping labels so the samples are grouped per account and project. The groups are in the order
+// of the gauges, the job group comes first and holds the last run timestamp.
+func promGroups(gauges []libratoexport.Gauge, now time.Time) ([]promGroup, error) {
+	groups := []promGroup{{Samples: []promSample{{Name: lastRunMetric, Value: float64(now.Unix())}}}}
+	index := map[promGroupKey]int{{}: 0}
+	for _, g := range gauges {
+		d, err := libratoexport.Describe(g)
+		if err != nil {
+			return nil, err
+		}
+		key := promGroupKey{d.Labels[libratoexport.LabelAccount], d.Labels[libratoexport.LabelProject]}
+		delete(d.Labels, libratoexport.LabelProject)
+		delete(d.Labels, libratoexport.LabelAccount)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, promGroup{Account: key.account, Project: key.project})
+		}
+		groups[i].Samples = append(groups[i].Samples, promSample{
+			Name:   "freckle_" + promCategories[d.Category] + "_" + d.SnakeMetric(),
+			Labels: d.Labels,
+			Value:  g.Value,
+		})
+	}
+	return groups, nil
+}
+
+// escapeLabelValue escapes a label value of the Prometheus text format.
+var escapeLabelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
+
+// writePromText writes the samples in the Prometheus text format, the samples of a family are written together.
+func writePromText(w io.Writer, samples []promSample) error {
+	var names []string
+	families := make(map[string][]promSample)
+	for _, s := range samples {
+		if _, ok := families[s.Name]; !ok {
+			names = append(names, s.Name)
+		}
+		families[s.Name] = append(families[s.Name], s)
+	}
+	var b bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", name)
+		for _, s := range families[name] {
+			var keys []string
+			for k := range s.Labels {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			var labels []string
+			for _, k := range keys {
+				labels = append(labels, fmt.Sprintf(`%s="%s"`, k, escapeLabelValue(s.Labels[k])))
+			}
+			if len(labels) > 0 {
+				fmt.Fprintf(&b, "%s{%s} %s\n", name, strings.Join(labels, ","), strconv.FormatFloat(s.Value, 'f', -1, 64))
+			} else {
+				fmt.Fprintf(&b, "%s %s\n", name, strconv.FormatFloat(s.Value, 'f', -1, 64))
+			}
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// pushgatewayURL returns the URL of the group, the account and the project are base64 encoded so they may contain any character.
+func pushgatewayURL(gateway, account, project string) string {
+	url := strings.TrimRight(gateway, "/") + "/metrics/job/" + pushgatewayJob
+	if account != "" {
+		url += "/account@base64/" + base64.RawURLEncoding.EncodeToString([]byte(account))
+	}
+	if project != "" {
+		url += "/project@base64/" + base64.RawURLEncoding.EncodeToString([]byte(project))
+	}
+	return url
+}
+
+// putGroup replaces the metrics of the group on the Pushgateway.
+func putGroup(ctx context.Context, client *http.Client, gateway string, group promGroup) error {
+	var body bytes.Buffer
+	if err := writePromText(&body, group.Samples); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", pushgatewayURL(gateway, group.Account, group.Project), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("pushgateway responded %s : %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// pushGauges pushes the gauges to the Pushgateway with PUT, so the metrics of a group which are not
+// registered anymore are dropped. A failed push is retried once.
+func pushGauges(ctx context.Context, client *http.Client, gateway string, gauges []libratoexport.Gauge, now time.Time) error {
+	groups, err := promGroups(gauges, now)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		err = withTimeout(ctx, pushgatewayTimeout, func(ctx context.Context) error {
+			return putGroup(ctx, client, gateway, group)
+		})
+		if err != nil && ctx.Err() == nil {
+			time.Sleep(pushgatewayRetryDelay)
+			err = withTimeout(ctx, pushgatewayTimeout, func(ctx context.Context) error {
+				return putGroup(ctx, client, gateway, group)
+			})
+		}
+		if err != nil {
+			if group.Account != "" || group.Project != "" {
+				return fmt.Errorf("pushing the metrics of %s: %v", strings.TrimSpace(group.Account+" "+group.Project), err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// withTimeout calls fn with a context bounded by the timeout.
+func withTimeout(ctx context.Context, timeout time.Duration, fn func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return fn(ctx)
+}
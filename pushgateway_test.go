@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+	"github.com/yml/freckle-project-indicators/kpi/libratoexport"
+)
+
+func TestPromGroups(t *testing.T) {
+	opts := monthlyOptions()
+	opts.TimeAgg = kpi.YearAgg{}
+	opts.ByClient = true
+	opts.HistogramBounds = kpi.DefaultHistogramBounds
+	report, err := Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	s := &libratoexport.RecordingSink{}
+	registerMetrics(s, report)
+
+	// Every registered gauge is converted
+	now := time.Date(2016, time.June, 1, 0, 0, 0, 0, time.UTC)
+	groups, err := promGroups(s.Gauges, now)
+	assert.NoError(t, err)
+	var projects []string
+	count := 0
+	for _, g := range groups {
+		projects = append(projects, g.Project)
+		count += len(g.Samples)
+	}
+	// The projects are the raw names, not the sanitized sources
+	assert.Equal(t, []string{"", "Acme Web", "Globex Mobile"}, projects)
+	assert.Equal(t, len(s.Gauges)+1, count)
+	assert.Equal(t, promSample{Name: lastRunMetric, Value: 1464739200}, groups[0].Samples[0])
+	// The project is the grouping label, it is not repeated in the samples
+	assert.Equal(t, promSample{Name: "freckle_project_unbillable_minutes", Labels: map[string]string{}, Value: 105}, groups[1].Samples[0])
+}
+
+func TestWritePromText(t *testing.T) {
+	var b bytes.Buffer
+	assert.NoError(t, writePromText(&b, []promSample{
+		{Name: "freckle_participant_billable_minutes", Labels: map[string]string{"participant": "alice"}, Value: 360},
+		{Name: "freckle_yearly_invoiced_amount", Labels: map[string]string{"period": "2016", "currency": "USD"}, Value: 4800.5},
+		{Name: "freckle_participant_billable_minutes", Labels: map[string]string{"participant": `bob "b"`}, Value: 240},
+		{Name: lastRunMetric, Value: 1464739200},
+	}))
+	assert.Equal(t, `# TYPE freckle_participant_billable_minutes gauge
+freckle_participant_billable_minutes{participant="alice"} 360
+freckle_participant_billable_minutes{participant="bob \"b\""} 240
+# TYPE freckle_yearly_invoiced_amount gauge
+freckle_yearly_invoiced_amount{currency="USD",period="2016"} 4800.5
+# TYPE freckle_last_run_timestamp_seconds gauge
+freckle_last_run_timestamp_seconds 1464739200
+`, b.String())
+}
+
+func TestPushGauges(t *testing.T) {
+	defer func(delay time.Duration) { pushgatewayRetryDelay = delay }(pushgatewayRetryDelay)
+	pushgatewayRetryDelay = 0
+
+	var paths []string
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "PUT", r.Method)
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Contains(t, string(body), "# TYPE")
+		paths = append(paths, r.URL.Path)
+		if failures > 0 {
+			failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	gauges := []libratoexport.Gauge{{Name: "FreckleAPI.projects.BillableMinutes", Source: "Acme-Web", Value: 600,
+		Labels: map[string]string{libratoexport.LabelProject: "Acme-Web"}}}
+	// The first failure is retried
+	assert.NoError(t, pushGauges(context.Background(), http.DefaultClient, server.URL+"/", gauges, time.Now()))
+	project := "/metrics/job/freckle_indicators/project@base64/" + base64.RawURLEncoding.EncodeToString([]byte("Acme-Web"))
+	assert.Equal(t, []string{"/metrics/job/freckle_indicators", "/metrics/job/freckle_indicators", project}, paths)
+
+	// A second failure fails the push
+	paths, failures = nil, 2
+	err := pushGauges(context.Background(), http.DefaultClient, server.URL, gauges, time.Now())
+	assert.EqualError(t, err, "pushgateway responded 503 Service Unavailable : unavailable")
+	assert.Len(t, paths, 2)
+}
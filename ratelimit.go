@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxRateLimitRetries is the number of times a rate limited request is retried before giving up.
+const maxRateLimitRetries = 5
+
+// rateLimitTransport is an http.RoundTripper spacing out the requests and retrying
+// the ones rejected with a 429 Too Many Requests after the delay asked by the API.
+// Retrying at the request level lets the pagination resume where it left off.
+type rateLimitTransport struct {
+	next http.RoundTripper
+	// minInterval is the minimum delay between the start of 2 requests, 0 disables the throttling
+	minInterval time.Duration
+	// backoff is the delay used when the response has no usable Retry-After header
+	backoff time.Duration
+	// sleep waits for the delay, it returns the error of the context when it is done first
+	sleep  func(context.Context, time.Duration) error
+	logger *Logger
+	// calls counts the requests sent, including the retries
+	calls int64
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// newRateLimitTransport returns a rateLimitTransport sending at most maxRPS requests per second.
+func newRateLimitTransport(next http.RoundTripper, maxRPS float64, backoff time.Duration, logger *Logger) *rateLimitTransport {
+	t := &rateLimitTransport{next: next, backoff: backoff, sleep: sleepContext, logger: logger}
+	if maxRPS > 0 {
+		t.minInterval = time.Duration(float64(time.Second) / maxRPS)
+	}
+	return t
+}
+
+// sleepContext waits for the delay unless the context is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttle waits until the request can be sent without exceeding the maximum rate, or until the context is done.
+func (t *rateLimitTransport) throttle(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.minInterval == 0 {
+		return nil
+	}
+	if wait := t.last.Add(t.minInterval).Sub(time.Now()); wait > 0 {
+		if err := t.sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+	t.last = time.Now()
+	return nil
+}
+
+// Calls returns the number of requests sent, including the retries.
+func (t *rateLimitTransport) Calls() int64 {
+	return atomic.LoadInt64(&t.calls)
+}
+
+// retryAfter returns the delay asked by the Retry-After header, in seconds or as an HTTP date.
+func (t *rateLimitTransport) retryAfter(resp *http.Response) time.Duration {
+	header := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := date.Sub(time.Now()); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return t.backoff
+}
+
+// RoundTrip implements http.RoundTripper. The request is left untouched, the retries send a clone
+// of it with its body rewound. The waits end with an error as soon as the context of the request is done.
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	attempt := req
+	for retry := 0; ; retry++ {
+		if err := t.throttle(ctx); err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&t.calls, 1)
+		resp, err := t.next.RoundTrip(attempt)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || retry == maxRateLimitRetries {
+			return resp, err
+		}
+		// A request with a body can only be retried if it can be rewound
+		attempt = req.Clone(ctx)
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return resp, nil
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return resp, nil
+			}
+			attempt.Body = body
+		}
+
+		wait := t.retryAfter(resp)
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		t.logger.Infof("rate limited by %s, waiting %s before retrying", req.URL.Host, wait)
+		if err := t.sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
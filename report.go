@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/gertv/go-freckle"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// Options selects the projects and tunes the KPIs computed by Run.
+type Options struct {
+	// ProjectNames restricts the report to these project names or IDs, all the projects are reported when empty
+	ProjectNames []string
+	// IncludeArchived also reports the disabled projects, they are only reported when named in ProjectNames otherwise
+	IncludeArchived bool
+	// SortKey orders the projects, they are kept in the DataSource order when empty
+	SortKey string
+	Desc    bool
+	// From restricts the report to the entries worked and the invoices dated since then, when not zero
+	From time.Time
+	// TimeAgg is the period of the breakdown
+	TimeAgg       kpi.TimeAggregater
+	PeriodOptions kpi.PeriodOptions
+	// InvoiceOptions selects the invoices counted in the invoiced amounts and the currency of the ones without currency
+	InvoiceOptions kpi.InvoiceOptions
+	// MoreTimeAggs are the periods of the other breakdowns, computed from the same entries
+	MoreTimeAggs []kpi.TimeAggregater
+	// ByClient also aggregates the projects per client, ClientMap maps the project names
+	// to their client for the projects without freckle group
+	ByClient  bool
+	ClientMap map[string]string
+	// Utilization also merges the time of the participants in all the projects per period, to compare it to their capacity
+	Utilization bool
+	// HistogramBounds are the upper bounds in minutes of the buckets of the entry durations,
+	// the histogram is only computed when they are set
+	HistogramBounds []int
+	// WeekdayLocation is the time zone the weekday of the entries is taken in,
+	// the minutes per weekday are only computed when it is set
+	WeekdayLocation *time.Location
+	// Billable filters the entries by their billable status before any KPI is computed,
+	// the minutes of the projects are then recomputed from the kept entries
+	Billable kpi.BillableFilter
+	// KeepEntries keeps the DetailedEntries of the projects, they are aggregated as they are fetched
+	// and dropped otherwise
+	KeepEntries bool
+	// Logger receives the progress of the run, nothing is logged when nil
+	Logger *Logger
+}
+
+// ProjectReport holds the KPIs computed for a project.
+type ProjectReport struct {
+	kpi.ProjectKpi
+	Participants kpi.ParticipantKpis
+	// Periods is the breakdown per Options.TimeAgg, the first of the Breakdowns
+	Periods []kpi.ProjectPeriodKpi
+	// Breakdowns holds the breakdown per Options.TimeAgg followed by the ones per Options.MoreTimeAggs
+	Breakdowns []Breakdown
+	// FetchDuration is the time spent fetching the entries and invoices of the project
+	FetchDuration time.Duration
+	// Histogram is the distribution of the entry durations, with Options.HistogramBounds
+	Histogram *kpi.Histogram
+	// Weekdays holds the minutes per day of the week, with Options.WeekdayLocation
+	Weekdays *kpi.WeekdayKpi
+}
+
+// Breakdown is the breakdown of a project per period of TimeAgg.
+type Breakdown struct {
+	TimeAgg kpi.TimeAggregater
+	Periods []kpi.ProjectPeriodKpi
+}
+
+// Report holds the KPIs computed for all the selected projects.
+type Report struct {
+	Projects []ProjectReport
+	// SkippedArchived counts the archived projects which were not reported
+	SkippedArchived int
+	// Clients holds the KPIs aggregated per client with Options.ByClient
+	Clients []kpi.ClientKpi
+	// Utilization holds the time of the participants in all the projects per period with Options.Utilization
+	Utilization []kpi.UtilizationPeriod
+	// Failed holds the projects which couldn't be fetched, they are left out of the report
+	Failed []ProjectFailure
+	// SkippedEntries and SkippedInvoices count the entries and the invoices left out because of their dates
+	SkippedEntries  int
+	SkippedInvoices int
+}
+
+// ProjectFailure is a project which couldn't be fetched.
+type ProjectFailure struct {
+	Name string
+	Err  error
+}
+
+// matchProject reports whether the project is named by name: its name, its ID, or a glob pattern
+// matching its name like Acme*.
+func matchProject(project kpi.ProjectKpi, name string) bool {
+	if name == project.Name || name == strconv.Itoa(project.Id) {
+		return true
+	}
+	matched, err := path.Match(name, project.Name)
+	return err == nil && matched
+}
+
+// selectProjects keeps the projects whose name or ID is listed in names, in the DataSource order.
+// When names is empty all the enabled projects are kept, and the archived ones with includeArchived.
+// skipped counts the archived projects left out.
+func selectProjects(projects []kpi.ProjectKpi, names []string, includeArchived bool) (selected []kpi.ProjectKpi, skipped int) {
+	if len(names) == 0 {
+		for _, project := range projects {
+			if !project.Enabled && !includeArchived {
+				skipped++
+				continue
+			}
+			selected = append(selected, project)
+		}
+		return selected, skipped
+	}
+	for _, project := range projects {
+		for _, name := range names {
+			if matchProject(project, name) {
+				selected = append(selected, project)
+				break
+			}
+		}
+	}
+	return selected, 0
+}
+
+// fetchProjectExpenses returns the expenses of the project when the DataSource is an ExpenseSource.
+// Expenses are secondary, the project has no expenses when they can't be fetched, unless the context is done.
+func fetchProjectExpenses(ctx context.Context, ds DataSource, project kpi.ProjectKpi, logger *Logger) ([]kpi.Expense, error) {
+	es, ok := ds.(ExpenseSource)
+	if !ok {
+		return nil, nil
+	}
+	expenses, err := es.Expenses(ctx, project.Id)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		logger.Warnf("the expenses of %s are ignored: %v", project.Name, err)
+		return nil, nil
+	}
+	return expenses, nil
+}
+
+// Run fetches the selected projects from the DataSource and computes their KPIs.
+// When fetching a project fails, the project is recorded in Report.Failed and the run goes on with the others.
+// When the context is done, the returned Report holds the projects fetched before along with the error.
+func Run(ctx context.Context, ds DataSource, opts Options) (Report, error) {
+	var report Report
+	logger := opts.Logger
+	if logger == nil {
+		logger = discardLogger
+	}
+
+	projects, skipped, err := ListProjects(ctx, ds, Options{ProjectNames: opts.ProjectNames, IncludeArchived: opts.IncludeArchived})
+	if err != nil {
+		return report, fmt.Errorf("listing the projects: %v", err)
+	}
+	report.SkippedArchived = skipped
+
+	var fetchErr error
+	durations := make(map[int]time.Duration)
+	aggregates := make(map[int]kpi.EntryAggregates)
+	var fetchedProjects []kpi.ProjectKpi
+	for _, project := range projects {
+		start := time.Now()
+		var invoices []kpi.Invoice
+		var expenses []kpi.Expense
+		agg := kpi.NewEntryAggregator(kpi.AggregateOptions{
+			TimeAgg:         opts.TimeAgg,
+			MoreTimeAggs:    opts.MoreTimeAggs,
+			DateBasis:       opts.PeriodOptions.DateBasis,
+			From:            opts.From,
+			Billable:        opts.Billable,
+			HistogramBounds: opts.HistogramBounds,
+			WeekdayLocation: opts.WeekdayLocation,
+			KeepEntries:     opts.KeepEntries,
+		})
+		fetched := 0
+		fetchErr = eachEntry(ctx, ds, project.Id, func(entry freckle.Entry) error {
+			fetched++
+			agg.Add(entry)
+			return nil
+		})
+		if fetchErr == nil {
+			expenses, fetchErr = fetchProjectExpenses(ctx, ds, project, logger)
+		}
+		if fetchErr == nil {
+			invoices, fetchErr = ds.Invoices(ctx, project.Id)
+		}
+		if fetchErr != nil && ctx.Err() != nil {
+			break
+		} else if fetchErr != nil {
+			logger.Warnf("project %s is left out of the report: %v", project.Name, fetchErr)
+			report.Failed = append(report.Failed, ProjectFailure{Name: project.Name, Err: fetchErr})
+			fetchErr = nil
+			continue
+		}
+		a := agg.Aggregates()
+		for _, skipped := range a.Skipped {
+			logger.Warnf("project %s : the entry %d of %s is skipped: %v", project.Name, skipped.Entry.Id, skipped.Entry.User.Email, skipped.Err)
+		}
+		report.SkippedEntries += len(a.Skipped)
+		// The drafts have no date yet, the undated invoices are left out of all the invoiced amounts
+		invoices, undated := kpi.SplitDatedInvoices(invoices)
+		for _, invoice := range undated {
+			logger.Warnf("project %s : the invoice %d is skipped: %q is not a date", project.Name, invoice.Id, invoice.InvoiceDate)
+		}
+		report.SkippedInvoices += len(undated)
+		aggregates[project.Id] = a
+		project.DetailedEntries = a.Entries
+		project.Invoices = invoices
+		project.Expenses = expenses
+		project.InvoiceOptions = opts.InvoiceOptions
+		durations[project.Id] = time.Since(start)
+		logger.Debugf("project %s : %d entries and %d invoices fetched in %s", project.Name, fetched, len(invoices), durations[project.Id])
+		if excluded := project.ExcludedInvoices(); excluded > 0 {
+			logger.Debugf("project %s : %d invoices excluded by their state", project.Name, excluded)
+		}
+		if !opts.From.IsZero() {
+			project, err = kpi.FilterInvoicesFrom(project, opts.From)
+			if err != nil {
+				return report, err
+			}
+		}
+		if !opts.From.IsZero() || opts.Billable.IsActive() || len(a.Skipped) > 0 {
+			project.BillableMinutes = a.BillableMinutes
+			project.UnbillableMinutes = a.UnbillableMinutes
+			project.InvoicedMinutes = a.InvoicedMinutes
+		}
+		fetchedProjects = append(fetchedProjects, project)
+	}
+	projects = fetchedProjects
+
+	if opts.SortKey != "" {
+		kpi.SortProjectKpis(projects, opts.SortKey, opts.Desc)
+	}
+
+	participants := make(map[int]kpi.ParticipantKpis)
+	var projectPeriods [][]kpi.ProjectPeriodKpi
+	for _, project := range projects {
+		a := aggregates[project.Id]
+		periods, err := kpi.BuildProjectKpiPerPeriod(opts.TimeAgg, opts.PeriodOptions, project, a.Periods)
+		if err != nil {
+			return report, err
+		}
+		pr := ProjectReport{
+			ProjectKpi:    project,
+			Participants:  a.Participants,
+			Periods:       periods,
+			Breakdowns:    []Breakdown{{TimeAgg: opts.TimeAgg, Periods: periods}},
+			FetchDuration: durations[project.Id],
+			Histogram:     a.Histogram,
+			Weekdays:      a.Weekdays,
+		}
+		for i, tagg := range opts.MoreTimeAggs {
+			more, err := kpi.BuildProjectKpiPerPeriod(tagg, opts.PeriodOptions, project, a.MorePeriods[i])
+			if err != nil {
+				return report, err
+			}
+			pr.Breakdowns = append(pr.Breakdowns, Breakdown{TimeAgg: tagg, Periods: more})
+		}
+		if a.Histogram != nil {
+			if invalid := a.Histogram.Invalid.Count(); invalid > 0 {
+				logger.Warnf("project %s : %d entries with zero or negative minutes", project.Name, invalid)
+			}
+		}
+		participants[project.Id] = a.Participants
+		projectPeriods = append(projectPeriods, periods)
+		report.Projects = append(report.Projects, pr)
+	}
+	if opts.ByClient {
+		report.Clients = kpi.GetClientKpis(projects, participants, opts.ClientMap)
+	}
+	if opts.Utilization {
+		report.Utilization, err = kpi.GetUtilizationPeriods(projectPeriods)
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, fetchErr
+}
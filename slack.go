@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// slackWebhookVarName is the environment variable used when -slack-webhook is not set.
+const slackWebhookVarName = "SLACK_WEBHOOK_URL"
+
+// slackTopProjects is the number of projects listed in the digest.
+const slackTopProjects = 3
+
+// slackTimeout bounds the time spent posting the digest.
+const slackTimeout = 10 * time.Second
+
+// slackMaxTextLength is the maximum length of the text of a Slack section block.
+const slackMaxTextLength = 3000
+
+// slackText is the mrkdwn text of a Slack block.
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// slackBlock is a section block of a Slack message.
+type slackBlock struct {
+	Type string    `json:"type"`
+	Text slackText `json:"text"`
+}
+
+// slackMessage is the payload posted to a Slack incoming webhook.
+type slackMessage struct {
+	// Text is the fallback shown in the notifications
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+// truncateLines keeps the lines of s fitting in max characters, the dropped lines are counted on a last line.
+func truncateLines(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	lines := strings.Split(s, "\n")
+	for n := len(lines) - 1; n > 0; n-- {
+		truncated := strings.Join(lines[:n], "\n") + fmt.Sprintf("\n…and %d more lines", len(lines)-n)
+		if len(truncated) <= max {
+			return truncated
+		}
+	}
+	return s[:max-len("…")] + "…"
+}
+
+// newSlackDigest summarizes the report and the errors of the run in a Slack message.
+// The amounts and hours are printed in a code block so they are aligned.
+func newSlackDigest(report Report, window string, errs []error, f kpi.Formatter) slackMessage {
+	invoiced := make(kpi.Amounts)
+	var minutes int
+	projects := make([]kpi.ProjectKpi, len(report.Projects))
+	for i, project := range report.Projects {
+		for currency, amount := range project.GetInvoicedTotalPerCurrency() {
+			invoiced[currency] += amount
+		}
+		minutes += project.BillableMinutes + project.UnbillableMinutes
+		projects[i] = project.ProjectKpi
+	}
+	kpi.SortProjectKpis(projects, "invoiced", true)
+
+	summary := fmt.Sprintf("*Freckle indicators* : %d projects processed, %s invoiced, %s", len(report.Projects), f.FormatAmounts(invoiced), f.FormatDuration(float64(minutes)))
+	if window != "" {
+		summary += " (" + window + ")"
+	}
+	msg := slackMessage{
+		Text:   summary,
+		Blocks: []slackBlock{{Type: "section", Text: slackText{Type: "mrkdwn", Text: summary}}},
+	}
+
+	if len(projects) > slackTopProjects {
+		projects = projects[:slackTopProjects]
+	}
+	if len(projects) > 0 {
+		var width int
+		for _, project := range projects {
+			if len(project.Name) > width {
+				width = len(project.Name)
+			}
+		}
+		var lines []string
+		for _, project := range projects {
+			duration := f.FormatDuration(float64(project.BillableMinutes + project.UnbillableMinutes))
+			lines = append(lines, fmt.Sprintf("%-*s  %15s  %9s", width, project.Name, f.FormatAmounts(project.GetInvoicedTotalPerCurrency()), duration))
+		}
+		title := fmt.Sprintf("*Top %d projects by invoiced amount*\n", len(projects))
+		table := truncateLines(strings.Join(lines, "\n"), slackMaxTextLength-len(title)-len("``````"))
+		msg.Blocks = append(msg.Blocks, slackBlock{Type: "section", Text: slackText{Type: "mrkdwn", Text: title + "```" + table + "```"}})
+	}
+
+	if len(errs) > 0 {
+		var lines []string
+		for _, err := range errs {
+			lines = append(lines, "• "+err.Error())
+		}
+		text := truncateLines(":warning: *Errors*\n"+strings.Join(lines, "\n"), slackMaxTextLength)
+		msg.Blocks = append(msg.Blocks, slackBlock{Type: "section", Text: slackText{Type: "mrkdwn", Text: text}})
+	}
+	return msg
+}
+
+// postSlack posts the message to the Slack incoming webhook.
+func postSlack(ctx context.Context, client *http.Client, webhook string, msg slackMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("slack webhook responded %s : %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// notifySlack posts the digest of the run when a webhook is configured.
+// Delivering the metrics is the primary job of the run, a failure is only reported as a warning.
+func notifySlack(logger *Logger, webhook string, report Report, window string, errs []error, f kpi.Formatter) {
+	if webhook == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), slackTimeout)
+	defer cancel()
+	if err := postSlack(ctx, http.DefaultClient, webhook, newSlackDigest(report, window, errs, f)); err != nil {
+		logger.Warnf("an error occured while posting the digest to slack: %v", err)
+	}
+}
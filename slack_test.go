@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+func TestNewSlackDigest(t *testing.T) {
+	report, err := Run(context.Background(), fixtureDataSource(t), monthlyOptions())
+	assert.NoError(t, err)
+
+	msg := newSlackDigest(report, "2016-01-01 to 2016-12-31", []error{errors.New("POSTing the metrics to librato: 401")}, kpi.DefaultFormatter)
+	assert.Equal(t, "*Freckle indicators* : 2 projects processed, $4,800.00 invoiced, 17.2h (2016-01-01 to 2016-12-31)", msg.Text)
+	assert.Len(t, msg.Blocks, 3)
+	assert.Equal(t, "*Top 2 projects by invoiced amount*\n```"+
+		"Acme Web             $4,800.00      11.8h\n"+
+		"Globex Mobile            $0.00       5.5h```", msg.Blocks[1].Text.Text)
+	assert.Equal(t, ":warning: *Errors*\n• POSTing the metrics to librato: 401", msg.Blocks[2].Text.Text)
+}
+
+func TestTruncateLines(t *testing.T) {
+	assert.Equal(t, "a\nb", truncateLines("a\nb", 3))
+	assert.Equal(t, "aaaa\n…and 5 more lines", truncateLines("aaaa\nbbbb\ncccc\ndddd\neeee\nffff", 25))
+	assert.True(t, len(truncateLines(strings.Repeat("a", 100), 10)) <= 10)
+}
+
+func TestPostSlack(t *testing.T) {
+	var received slackMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		if received.Text == "fail" {
+			http.Error(w, "invalid_payload", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	assert.NoError(t, postSlack(context.Background(), server.Client(), server.URL, slackMessage{Text: "digest"}))
+	assert.Equal(t, "digest", received.Text)
+
+	err := postSlack(context.Background(), server.Client(), server.URL, slackMessage{Text: "fail"})
+	assert.EqualError(t, err, "slack webhook responded 400 Bad Request : invalid_payload")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+// formatTable prints the report as aligned columns, optionally colored, see -color.
+const formatTable = "table"
+
+// Values of the -color flag.
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// The ANSI sequences highlighting the cells of the table. Every cell is wrapped when the colors are on,
+// the plain ones in colorDefault, so the sequences add the same width to all of them and the columns stay aligned.
+const (
+	colorDefault = "\x1b[39m"
+	colorRed     = "\x1b[31m"
+	colorYellow  = "\x1b[33m"
+	colorReset   = "\x1b[0m"
+)
+
+// tableHeader names the columns of the table.
+var tableHeader = []string{"PROJECT", "INVOICED", "BILLABLE", "UNBILLABLE", "BILLABLE %", "CHANGE"}
+
+// IsValidColor reports whether c is a choice of the -color flag.
+func IsValidColor(c string) bool {
+	return c == colorAuto || c == colorAlways || c == colorNever
+}
+
+// useColor resolves the -color flag. auto colors the output when f is a terminal, unless $NO_COLOR is set or $TERM is dumb.
+func useColor(mode string, f *os.File) bool {
+	switch mode {
+	case colorAlways:
+		return true
+	case colorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// tableCell is a cell of the table, color highlights it when the colors are on.
+type tableCell struct {
+	text  string
+	color string
+}
+
+// table lays out rows of len(tableHeader) cells in aligned columns.
+type table struct {
+	buf   bytes.Buffer
+	tw    *tabwriter.Writer
+	color bool
+	// threshold is the billable ratio under which the ratios are highlighted
+	threshold float64
+	format    kpi.Formatter
+}
+
+func newTable(color bool, threshold float64, f kpi.Formatter) *table {
+	t := &table{color: color, threshold: threshold, format: f}
+	t.tw = tabwriter.NewWriter(&t.buf, 0, 0, 2, ' ', 0)
+	return t
+}
+
+func (t *table) row(cells ...tableCell) {
+	texts := make([]string, len(tableHeader))
+	for i := range texts {
+		var c tableCell
+		if i < len(cells) {
+			c = cells[i]
+		}
+		texts[i] = c.text
+		if t.color {
+			color := c.color
+			if color == "" {
+				color = colorDefault
+			}
+			texts[i] = color + c.text + colorReset
+		}
+	}
+	fmt.Fprintln(t.tw, strings.Join(texts, "\t"))
+}
+
+// blank separates the sections of the table without breaking the alignment of its columns.
+func (t *table) blank() {
+	fmt.Fprintln(t.tw, strings.Repeat("\t", len(tableHeader)-1))
+}
+
+// minutes returns the billable, unbillable and billable ratio cells, the ratios under the threshold
+// are highlighted in yellow and a participant or a period without billable time in red.
+func (t *table) minutes(billable, unbillable int) []tableCell {
+	cells := []tableCell{
+		{text: t.format.FormatDuration(float64(billable))},
+		{text: t.format.FormatDuration(float64(unbillable))},
+		{text: "n/a"},
+	}
+	total := billable + unbillable
+	if total == 0 {
+		return cells
+	}
+	if billable == 0 {
+		cells[0].color = colorRed
+	}
+	ratio := float64(billable) / float64(total)
+	cells[2].text = fmt.Sprintf("%.0f%%", ratio*100)
+	if ratio < t.threshold {
+		cells[2].color = colorYellow
+	}
+	return cells
+}
+
+// participants adds a row per participant, the ones after the -top are summed on one row.
+func (t *table) participants(indent string, participants kpi.ParticipantKpis) {
+	top, others := participants.Split(topFlag)
+	for _, p := range top {
+		t.row(append([]tableCell{{text: indent + p.DisplayName()}, {}}, t.minutes(p.BillableMinutes, p.UnbillableMinutes)...)...)
+	}
+	if len(others) > 0 {
+		var billable, unbillable int
+		for _, p := range others {
+			billable += p.BillableMinutes
+			unbillable += p.UnbillableMinutes
+		}
+		name := fmt.Sprintf("%s…and %d others", indent, len(others))
+		t.row(append([]tableCell{{text: name}, {}}, t.minutes(billable, unbillable)...)...)
+	}
+}
+
+// flush writes the table to w, without the padding trailing the last non empty cell of the rows.
+func (t *table) flush(w io.Writer) error {
+	if err := t.tw.Flush(); err != nil {
+		return err
+	}
+	for _, line := range strings.SplitAfter(t.buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		if _, err := io.WriteString(w, strings.TrimRight(line, " \n")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printTable prints the report to w as a table: a row per project followed by its participants and its periods,
+// then the clients. The change of a period versus the previous one is highlighted in red when it decreases.
+// threshold is the billable ratio under which the ratios are highlighted, color turns the highlighting on.
+// The durations and the amounts are printed with the display settings of f.
+func printTable(w io.Writer, report Report, color bool, threshold float64, f kpi.Formatter) {
+	t := newTable(color, threshold, f)
+	header := make([]tableCell, len(tableHeader))
+	for i, name := range tableHeader {
+		header[i] = tableCell{text: name}
+	}
+	t.row(header...)
+
+	for _, project := range report.Projects {
+		t.blank()
+		t.row(append([]tableCell{{text: project.Name}, {text: f.FormatAmounts(project.GetInvoicedTotalPerCurrency())}},
+			t.minutes(project.BillableMinutes, project.UnbillableMinutes)...)...)
+		t.participants("  ", project.Participants)
+		if project.Weekdays != nil {
+			for _, day := range kpi.Weekdays {
+				t.row(append([]tableCell{{text: "  " + day.String()}, {}},
+					t.minutes(project.Weekdays.BillableMinutes[day], project.Weekdays.UnbillableMinutes[day])...)...)
+			}
+		}
+
+		for _, b := range project.Breakdowns {
+			// The breakdowns are only labeled when there are several of them
+			if len(project.Breakdowns) > 1 {
+				t.row(tableCell{text: "  per " + periodName(b.TimeAgg)})
+			}
+			for _, ppm := range b.Periods {
+				billable, unbillable := ppm.GetMinutes()
+				cells := append([]tableCell{{text: "  " + ppm.Label()}, {text: f.FormatAmounts(ppm.GetInvoicedAmounts())}},
+					t.minutes(billable, unbillable)...)
+				if ppm.Trend != nil {
+					change := tableCell{text: ppm.Trend.Format(f)}
+					if isDecrease(*ppm.Trend) {
+						change.color = colorRed
+					}
+					cells = append(cells, change)
+				}
+				t.row(cells...)
+				t.participants("    ", ppm.Participants)
+			}
+		}
+	}
+
+	if len(report.Clients) > 0 {
+		t.blank()
+		t.row(tableCell{text: "CLIENT"})
+	}
+	for _, client := range report.Clients {
+		t.row(append([]tableCell{{text: client.Name}, {text: f.FormatAmounts(client.Invoiced)}},
+			t.minutes(client.BillableMinutes, client.UnbillableMinutes)...)...)
+		t.participants("  ", client.Participants)
+	}
+	t.flush(w)
+}
+
+// isDecrease reports whether the invoiced amounts or the hours of the period decrease versus the previous one.
+func isDecrease(trend kpi.PeriodTrend) bool {
+	if trend.Minutes.Absolute < 0 {
+		return true
+	}
+	for _, d := range trend.Invoiced {
+		if d.Absolute < 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yml/freckle-project-indicators/kpi"
+)
+
+func TestPrintTable(t *testing.T) {
+	report, err := Run(context.Background(), fixtureDataSource(t), monthlyOptions())
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	printTable(&buf, report, false, 0.5, kpi.DefaultFormatter)
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, []string{
+		"PROJECT          INVOICED   BILLABLE  UNBILLABLE  BILLABLE %  CHANGE",
+		"",
+		"Acme Web         $4,800.00  10.0h     1.8h        85%",
+		"  Alice Smith               6.0h      1.0h        86%",
+		"  Bob Jones                 4.0h      0.8h        84%",
+		"  2016-01        $0.00      6.0h      0.8h        89%",
+		"    Alice Smith             4.0h      0.0h        100%",
+		"    Bob Jones               2.0h      0.8h        73%",
+		"  2016-02        $3,600.00  0.0h      0.0h        n/a         +$3,600.00 vs 2016-01, hours -100%",
+	}, lines[:9])
+	assert.NotContains(t, buf.String(), "\x1b[")
+
+	buf.Reset()
+	printTable(&buf, report, true, 0.5, kpi.DefaultFormatter)
+	out := buf.String()
+	assert.Contains(t, out, colorDefault+"  Alice Smith"+colorReset+"    "+colorDefault+colorReset+"           "+colorRed+"0.0h"+colorReset,
+		"the participant without billable time is highlighted")
+	assert.Contains(t, out, colorYellow+"0%"+colorReset, "the ratio under the threshold is highlighted")
+	assert.Contains(t, out, colorRed+"-100% vs 2016-02, hours +5.0h"+colorReset, "the decrease is highlighted")
+	assert.NotContains(t, out, colorYellow+"85%")
+
+	// The clients are formatted like the projects
+	opts := monthlyOptions()
+	opts.ByClient = true
+	report, err = Run(context.Background(), fixtureDataSource(t), opts)
+	assert.NoError(t, err)
+	buf.Reset()
+	printTable(&buf, report, false, 0.5, kpi.Formatter{Durations: kpi.DurationHours, HoursPrecision: 1, AmountPrecision: 0})
+	assert.Contains(t, buf.String(), "\nAcme Web         $4,800 ")
+	assert.NotContains(t, buf.String(), ".00")
+}
+
+func TestUseColor(t *testing.T) {
+	assert.True(t, useColor(colorAlways, nil))
+	assert.False(t, useColor(colorNever, nil))
+
+	f, err := ioutil.TempFile("", "table")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	assert.False(t, useColor(colorAuto, f), "a file is not a terminal")
+}
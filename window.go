@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var sinceRegexp = regexp.MustCompile(`^([0-9]+)([dwmy])$`)
+
+// parseSince translates a relative window like 7d, 12w, 6m or 1y into the midnight it starts at.
+// Months and years are calendar months and years, not 30 or 365 days, so they match the finance reports.
+func parseSince(since string, now time.Time) (time.Time, error) {
+	match := sinceRegexp.FindStringSubmatch(since)
+	if match == nil {
+		return time.Time{}, fmt.Errorf("%q is not a valid window, e.g. 7d, 12w, 6m or 1y", since)
+	}
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch match[2] {
+	case "d":
+		return today.AddDate(0, 0, -n), nil
+	case "w":
+		return today.AddDate(0, 0, -7*n), nil
+	case "m":
+		return today.AddDate(0, -n, 0), nil
+	}
+	return today.AddDate(-n, 0, 0), nil
+}
+
+// parseWindow returns the date the report starts from according to the -from and -since flags,
+// the zero time when neither is set.
+func parseWindow(from, since string, now time.Time) (time.Time, error) {
+	switch {
+	case from != "" && since != "":
+		return time.Time{}, fmt.Errorf("-from and -since are mutually exclusive")
+	case from != "":
+		return time.ParseInLocation("2006-01-02", from, now.Location())
+	case since != "":
+		return parseSince(since, now)
+	}
+	return time.Time{}, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2016, time.March, 31, 15, 4, 5, 0, time.UTC)
+	for since, expected := range map[string]string{
+		"7d":  "2016-03-24",
+		"30d": "2016-03-01",
+		"12w": "2016-01-07",
+		"1m":  "2016-03-02",
+		"6m":  "2015-10-01",
+		"1y":  "2015-03-31",
+	} {
+		from, err := parseSince(since, now)
+		assert.NoError(t, err, since)
+		assert.Equal(t, expected+"T00:00:00Z", from.Format(time.RFC3339), since)
+	}
+
+	for _, since := range []string{"", "7", "d", "-7d", "7h", "1.5y"} {
+		_, err := parseSince(since, now)
+		assert.Error(t, err, since)
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	now := time.Date(2016, time.March, 31, 15, 4, 5, 0, time.UTC)
+
+	from, err := parseWindow("", "", now)
+	assert.NoError(t, err)
+	assert.True(t, from.IsZero())
+
+	from, err = parseWindow("2016-01-15", "", now)
+	assert.NoError(t, err)
+	assert.Equal(t, "2016-01-15", from.Format("2006-01-02"))
+
+	_, err = parseWindow("2016-01-15", "7d", now)
+	assert.Error(t, err)
+}